@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/proxima/common"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Same default as influx
+	kDefaultChunkSize = 10000
+)
+
+// chunkResultType is a single result in a chunked response
+type chunkResultType struct {
+	StatementId int               `json:"statement_id"`
+	Series      []models.Row      `json:"series,omitempty"`
+	Messages    []*client.Message `json:"messages,omitempty"`
+	Partial     bool              `json:"partial,omitempty"`
+	Err         string            `json:"error,omitempty"`
+}
+
+// chunkType is a single chunk in a chunked response
+type chunkType struct {
+	Results []chunkResultType `json:"results"`
+}
+
+// chunkWriterType writes query results to an http response using the same
+// chunked format as influx. Each chunk holds at most chunkSize values of
+// one series. chunkWriterType holds back one chunk so that it can tell
+// whether more chunks for the same statement follow.
+type chunkWriterType struct {
+	encoder     *json.Encoder
+	flusher     http.Flusher
+	chunkSize   int
+	statementId int
+	pending     *chunkResultType
+	// Messages for the last chunk of the current statement
+	messages []*client.Message
+}
+
+func newChunkWriter(w http.ResponseWriter, chunkSize int) *chunkWriterType {
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	return &chunkWriterType{
+		encoder:   json.NewEncoder(w),
+		flusher:   flusher,
+		chunkSize: chunkSize,
+	}
+}
+
+func (c *chunkWriterType) write(result *chunkResultType) error {
+	if err := c.encoder.Encode(
+		&chunkType{Results: []chunkResultType{*result}}); err != nil {
+		return err
+	}
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return nil
+}
+
+// queue writes out the pending chunk and makes result the pending chunk.
+func (c *chunkWriterType) queue(result *chunkResultType) error {
+	if c.pending != nil {
+		c.pending.Partial = true
+		if err := c.write(c.pending); err != nil {
+			return err
+		}
+	}
+	c.pending = result
+	return nil
+}
+
+func (c *chunkWriterType) WriteRow(row models.Row) error {
+	values := row.Values
+	for {
+		piece := row
+		length := len(values)
+		if length > c.chunkSize {
+			length = c.chunkSize
+		}
+		piece.Values, values = values[:length], values[length:]
+		piece.Partial = row.Partial || len(values) > 0
+		if err := c.queue(&chunkResultType{
+			StatementId: c.statementId,
+			Series:      []models.Row{piece},
+		}); err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			return nil
+		}
+	}
+}
+
+// flushPending writes out the pending chunk as the last chunk of the
+// current statement.
+func (c *chunkWriterType) flushPending() error {
+	if c.pending == nil {
+		return nil
+	}
+	c.pending.Partial = false
+	err := c.write(c.pending)
+	c.pending = nil
+	return err
+}
+
+// WriteMessage adds a message to the last chunk of the current statement.
+func (c *chunkWriterType) WriteMessage(level, text string) error {
+	c.messages = append(
+		c.messages, &client.Message{Level: level, Text: text})
+	return nil
+}
+
+func (c *chunkWriterType) EndStatement() error {
+	if c.pending == nil {
+		// Like influx, every statement gets a result
+		c.pending = &chunkResultType{StatementId: c.statementId}
+	}
+	c.pending.Messages, c.messages = c.messages, nil
+	if err := c.flushPending(); err != nil {
+		return err
+	}
+	c.statementId++
+	return nil
+}
+
+// WriteError reports err as the result of the current statement.
+func (c *chunkWriterType) WriteError(err error) error {
+	if err := c.flushPending(); err != nil {
+		return err
+	}
+	return c.write(&chunkResultType{
+		StatementId: c.statementId,
+		Err:         err.Error(),
+	})
+}
+
+// chunkSize returns the chunk_size parameter or the influx default if it
+// is missing or invalid.
+func chunkSize(chunkSizeStr string) int {
+	result, err := strconv.Atoi(chunkSizeStr)
+	if err != nil || result <= 0 {
+		return kDefaultChunkSize
+	}
+	return result
+}
+
+// performChunkedQuery works like performQuery except that it writes the
+// results directly to w in chunks as they become available.
+func performChunkedQuery(
+	ctx context.Context,
+	w http.ResponseWriter,
+	executer *executerType,
+	user *common.User,
+	query, db, epoch string,
+	chunkSize int,
+	logger log.Logger) {
+	writer := newChunkWriter(w, chunkSize)
+	var err error
+	if isShowDatabases(query) {
+		if err = writer.WriteRow(databasesRow(executer.Names(user))); err == nil {
+			err = writer.EndStatement()
+		}
+	} else {
+		err = executer.QueryStream(
+			ctx, user, query, db, epoch, chunkSize, logger, writer)
+	}
+	if err != nil {
+		if err := writer.WriteError(err); err != nil && logger != nil {
+			logger.Println(err)
+		}
+	}
+}
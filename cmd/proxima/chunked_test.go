@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newFakeChunkingInflux returns a fake influx server that answers chunked
+// queries with a cpu series split across two chunks. For queries of the
+// broken measurement, the second chunk is an error.
+func newFakeChunkingInflux() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ping" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			r.ParseForm()
+			if r.Form.Get("chunked") != "true" {
+				fmt.Fprintf(w, `{"results":[%s]}`+"\n", kSeriesResult)
+				return
+			}
+			fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1000,10],[1200,11]],"partial":true}],"partial":true}]}`)
+			if strings.Contains(r.Form.Get("q"), "broken") {
+				fmt.Fprintln(w, `{"results":[{"statement_id":0,"error":"shard went away"}]}`)
+				return
+			}
+			fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1400,12]]}]}]}`)
+		}))
+}
+
+// readChunks returns the chunks in body.
+func readChunks(body string) ([]chunkType, error) {
+	var result []chunkType
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	for {
+		var chunk chunkType
+		if err := decoder.Decode(&chunk); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, chunk)
+	}
+}
+
+func TestChunkedQueries(t *testing.T) {
+	Convey("Given proxima with a chunking influx", t, func() {
+		influx := newFakeChunkingInflux()
+		defer influx.Close()
+		executer, err := newTestExecuter(fmt.Sprintf(`
+databases:
+- name: regular
+  influxes:
+  - hostAndPort: %s
+    duration: 24h
+    database: regular
+`, influx.URL))
+		So(err, ShouldBeNil)
+		server := newQueryServer(executer)
+		defer server.Close()
+		query := func(q string) []chunkType {
+			params := url.Values{
+				"db":         {"regular"},
+				"q":          {q},
+				"epoch":      {"ms"},
+				"chunked":    {"true"},
+				"chunk_size": {"2"},
+			}
+			resp, err := http.Get(server.URL + "/query?" + params.Encode())
+			So(err, ShouldBeNil)
+			code, body := readResponse(resp)
+			So(code, ShouldEqual, http.StatusOK)
+			chunks, err := readChunks(body)
+			So(err, ShouldBeNil)
+			return chunks
+		}
+
+		Convey("Results should stream back in chunks", func() {
+			chunks := query(
+				"select value from cpu where time >= now() - 1h; select value from cpu where time >= now() - 1h")
+			So(chunks, ShouldHaveLength, 4)
+			for i, chunk := range chunks {
+				So(chunk.Results, ShouldHaveLength, 1)
+				result := chunk.Results[0]
+				So(result.StatementId, ShouldEqual, i/2)
+				So(result.Err, ShouldBeEmpty)
+				So(result.Series, ShouldHaveLength, 1)
+				if i%2 == 0 {
+					So(result.Partial, ShouldBeTrue)
+					So(result.Series[0].Values, ShouldHaveLength, 2)
+				} else {
+					So(result.Partial, ShouldBeFalse)
+					So(result.Series[0].Values, ShouldHaveLength, 1)
+				}
+			}
+		})
+
+		Convey("Backend errors midway should end the stream", func() {
+			chunks := query("select value from broken where time >= now() - 1h")
+			So(chunks, ShouldNotBeEmpty)
+			last := chunks[len(chunks)-1]
+			So(last.Results, ShouldHaveLength, 1)
+			So(last.Results[0].Err, ShouldEqual, "shard went away")
+		})
+
+		Convey("Bad parameters should fail before streaming", func() {
+			params := url.Values{
+				"db":      {"regular"},
+				"q":       {"select value from cpu where host = $host"},
+				"params":  {"{"},
+				"chunked": {"true"},
+			}
+			resp, err := http.Get(server.URL + "/query?" + params.Encode())
+			So(err, ShouldBeNil)
+			code, _ := readResponse(resp)
+			So(code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/Symantec/Dominator/lib/log"
 	"github.com/Symantec/proxima/common"
 	"github.com/Symantec/proxima/config"
@@ -11,6 +13,7 @@ import (
 	"github.com/Symantec/tricorder/go/tricorder"
 	"github.com/Symantec/tricorder/go/tricorder/units"
 	"github.com/influxdata/influxdb/client/v2"
+	"html"
 	"io"
 	"strconv"
 	"time"
@@ -69,7 +72,8 @@ func (e *executerType) SetupWithStream(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	if err := registerProxima(proximaConfig); err != nil {
+	if err := registerProxima(proximaConfig, proxima); err != nil {
+		proxima.Close()
 		return err
 	}
 	e.proxima.Set(proxima)
@@ -77,7 +81,9 @@ func (e *executerType) SetupWithStream(r io.Reader) error {
 }
 
 func registerInflux(
-	influx config.Influx, dir *tricorder.DirectorySpec) error {
+	influx config.Influx,
+	duration func() time.Duration,
+	dir *tricorder.DirectorySpec) error {
 	if err := dir.RegisterMetric(
 		"endpoint",
 		&influx.HostAndPort,
@@ -94,16 +100,26 @@ func registerInflux(
 	}
 	if err := dir.RegisterMetric(
 		"retentionPolicy",
-		&influx.Duration,
+		duration,
 		units.None,
 		"retention policy of influx server"); err != nil {
 		return err
 	}
+	discovered := influx.Duration == 0
+	if err := dir.RegisterMetric(
+		"retentionPolicyDiscovered",
+		&discovered,
+		units.None,
+		"true if proxima asks influx server for its retention policy"); err != nil {
+		return err
+	}
 	return nil
 }
 
 func registerInfluxes(
-	influxes []config.Influx, dir *tricorder.DirectorySpec) error {
+	influxes []config.Influx,
+	db *common.Database,
+	dir *tricorder.DirectorySpec) error {
 	influxesDir, err := dir.RegisterDirectory("influxes")
 	if err != nil {
 		return err
@@ -113,7 +129,129 @@ func registerInfluxes(
 		if err != nil {
 			return err
 		}
-		if err := registerInflux(influxes[i], influxDir); err != nil {
+		index := i
+		duration := func() time.Duration {
+			return db.InfluxDuration(index)
+		}
+		if err := registerInflux(influxes[i], duration, influxDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerOpenTSDB(
+	openTSDB config.OpenTSDB, dir *tricorder.DirectorySpec) error {
+	if err := dir.RegisterMetric(
+		"endpoint",
+		&openTSDB.HostAndPort,
+		units.None,
+		"endpoint of OpenTSDB server"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"retentionPolicy",
+		&openTSDB.Duration,
+		units.None,
+		"how far back data in OpenTSDB server goes"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func registerOpenTSDBs(
+	openTSDBs []config.OpenTSDB, dir *tricorder.DirectorySpec) error {
+	openTSDBsDir, err := dir.RegisterDirectory("openTSDBs")
+	if err != nil {
+		return err
+	}
+	for i := range openTSDBs {
+		openTSDBDir, err := openTSDBsDir.RegisterDirectory(strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		if err := registerOpenTSDB(openTSDBs[i], openTSDBDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerPrometheus(
+	prometheus config.Prometheus, dir *tricorder.DirectorySpec) error {
+	if err := dir.RegisterMetric(
+		"endpoint",
+		&prometheus.HostAndPort,
+		units.None,
+		"endpoint of prometheus server"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"retentionPolicy",
+		&prometheus.Duration,
+		units.None,
+		"how far back data in prometheus server goes"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func registerPrometheuses(
+	prometheuses []config.Prometheus, dir *tricorder.DirectorySpec) error {
+	prometheusesDir, err := dir.RegisterDirectory("prometheuses")
+	if err != nil {
+		return err
+	}
+	for i := range prometheuses {
+		prometheusDir, err := prometheusesDir.RegisterDirectory(strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		if err := registerPrometheus(prometheuses[i], prometheusDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerGraphite(
+	graphite config.Graphite, dir *tricorder.DirectorySpec) error {
+	if err := dir.RegisterMetric(
+		"endpoint",
+		&graphite.HostAndPort,
+		units.None,
+		"endpoint of graphite server"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"retentionPolicy",
+		&graphite.Duration,
+		units.None,
+		"how far back data in graphite server goes"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"template",
+		&graphite.Template,
+		units.None,
+		"maps measurements and tags onto graphite paths"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func registerGraphites(
+	graphites []config.Graphite, dir *tricorder.DirectorySpec) error {
+	graphitesDir, err := dir.RegisterDirectory("graphites")
+	if err != nil {
+		return err
+	}
+	for i := range graphites {
+		graphiteDir, err := graphitesDir.RegisterDirectory(strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		if err := registerGraphite(graphites[i], graphiteDir); err != nil {
 			return err
 		}
 	}
@@ -136,6 +274,15 @@ func registerScotty(
 		if err := registerScotties(scotty.Partials, "partials", dir); err != nil {
 			return err
 		}
+		if scotty.Sharding != nil {
+			if err := dir.RegisterMetric(
+				"shardTag",
+				&scotty.Sharding.Tag,
+				units.None,
+				"tag that decides which partial has a series"); err != nil {
+				return err
+			}
+		}
 		return nil
 	}
 	if len(scotty.Scotties) != 0 {
@@ -165,47 +312,172 @@ func registerScotties(
 	return nil
 }
 
+func registerBackend(
+	database *common.Database,
+	index int,
+	dir *tricorder.DirectorySpec) error {
+	health := database.Health()[index]
+	if err := dir.RegisterMetric(
+		"endpoint",
+		&health.HostAndPort,
+		units.None,
+		"endpoint of backend"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"kind",
+		&health.Kind,
+		units.None,
+		"kind of backend"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"state",
+		func() string {
+			return database.Health()[index].State
+		},
+		units.None,
+		"circuit breaker state: closed, open, or half-open"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"consecutiveFailures",
+		func() int64 {
+			return int64(database.Health()[index].ConsecutiveFailures)
+		},
+		units.None,
+		"queries and pings in a row that failed"); err != nil {
+		return err
+	}
+	if err := dir.RegisterMetric(
+		"lastError",
+		func() string {
+			return database.Health()[index].LastError
+		},
+		units.None,
+		"most recent failure"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func registerBackends(
+	database *common.Database, dir *tricorder.DirectorySpec) error {
+	backendsDir, err := dir.RegisterDirectory("backends")
+	if err != nil {
+		return err
+	}
+	for i := range database.Health() {
+		backendDir, err := backendsDir.RegisterDirectory(strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		if err := registerBackend(database, i, backendDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func registerDatabase(
-	db config.Database, dir *tricorder.DirectorySpec) error {
+	db config.Database,
+	database *common.Database,
+	dir *tricorder.DirectorySpec) error {
 	databaseDir, err := dir.RegisterDirectory(db.Name)
 	if err != nil {
 		return err
 	}
-	if err := registerInfluxes(db.Influxes, databaseDir); err != nil {
+	if err := registerInfluxes(db.Influxes, database, databaseDir); err != nil {
 		return err
 	}
 	if err := registerScotties(db.Scotties, "scotties", databaseDir); err != nil {
 		return err
 	}
+	if err := registerOpenTSDBs(db.OpenTSDBs, databaseDir); err != nil {
+		return err
+	}
+	if err := registerPrometheuses(db.Prometheuses, databaseDir); err != nil {
+		return err
+	}
+	if err := registerGraphites(db.Graphites, databaseDir); err != nil {
+		return err
+	}
+	if err := registerBackends(database, databaseDir); err != nil {
+		return err
+	}
 	return nil
 }
 
-func registerProxima(proximaConfig config.Proxima) error {
+func registerProxima(
+	proximaConfig config.Proxima, proxima *common.Proxima) error {
 	tricorder.UnregisterPath(kDatabasesTricorderPath)
 	databasesDir, err := tricorder.RegisterDirectory(kDatabasesTricorderPath)
 	if err != nil {
 		return err
 	}
 	for _, db := range proximaConfig.Dbs {
-		if err := registerDatabase(db, databasesDir); err != nil {
+		if err := registerDatabase(
+			db, proxima.ByName(db.Name), databasesDir); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (e *executerType) Names() []string {
+// WriteHtml writes the health of each backend of each database as an
+// html table.
+func (e *executerType) WriteHtml(writer io.Writer) {
+	id, p := e.proxima.Get()
+	defer e.proxima.Put(id)
+	fmt.Fprintln(writer, "<h2>Backends</h2>")
+	fmt.Fprintln(writer, "<table border=\"1\">")
+	fmt.Fprintln(writer, "<tr><th>Database</th><th>Kind</th><th>Endpoint</th><th>State</th><th>Since</th><th>Failures</th><th>Last error</th></tr>")
+	for _, name := range p.Names() {
+		for _, health := range p.ByName(name).Health() {
+			fmt.Fprintf(
+				writer,
+				"<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+				html.EscapeString(name),
+				html.EscapeString(health.Kind),
+				html.EscapeString(health.HostAndPort),
+				health.State,
+				health.Since.Format(time.RFC3339),
+				health.ConsecutiveFailures,
+				html.EscapeString(health.LastError))
+		}
+	}
+	fmt.Fprintln(writer, "</table>")
+}
+
+// Authenticate returns the user with given credentials.
+func (e *executerType) Authenticate(creds common.Credentials) (
+	*common.User, error) {
+	id, p := e.proxima.Get()
+	defer e.proxima.Put(id)
+	return p.Authenticate(creds)
+}
+
+// Names returns the names of the databases that user may query.
+func (e *executerType) Names(user *common.User) []string {
 	id, p := e.proxima.Get()
 	defer e.proxima.Put(id)
-	return p.Names()
+	return user.Filter(p.Names())
 }
 
 // Query runs a query against multiple influx db instances merging the results
 // Query uses the logger instance to report any influx instances that are
-// down.
+// down. Cancelling ctx aborts the query. user is the user running the
+// query.
 func (e *executerType) Query(
-	queryStr, database, epoch string, logger log.Logger) (
-	*client.Response, error) {
+	ctx context.Context,
+	user *common.User,
+	queryStr, database, epoch string,
+	logger log.Logger) (*client.Response, error) {
+	if !user.CanRead(database) {
+		return nil, fmt.Errorf(
+			"User %s not authorized to read database %s",
+			user.Name(), database)
+	}
 	id, p := e.proxima.Get()
 	defer e.proxima.Put(id)
 	now := time.Now()
@@ -217,5 +489,34 @@ func (e *executerType) Query(
 	if db == nil {
 		return nil, kErrNoSuchDatabase
 	}
-	return db.Query(query, epoch, now, logger)
+	return db.Query(ctx, query, epoch, now, logger)
+}
+
+// QueryStream works like Query except that it writes the results to w as
+// they become available. chunkSize is the maximum number of values per
+// row to request from each backend at a time.
+func (e *executerType) QueryStream(
+	ctx context.Context,
+	user *common.User,
+	queryStr, database, epoch string,
+	chunkSize int,
+	logger log.Logger,
+	w common.RowWriter) error {
+	if !user.CanRead(database) {
+		return fmt.Errorf(
+			"User %s not authorized to read database %s",
+			user.Name(), database)
+	}
+	id, p := e.proxima.Get()
+	defer e.proxima.Put(id)
+	now := time.Now()
+	query, err := qlutils.NewQuery(queryStr, now)
+	if err != nil {
+		return err
+	}
+	db := p.ByName(database)
+	if db == nil {
+		return kErrNoSuchDatabase
+	}
+	return db.QueryStream(ctx, query, epoch, now, chunkSize, logger, w)
 }
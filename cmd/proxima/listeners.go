@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/Symantec/Dominator/lib/fsutil"
+	"github.com/Symantec/Dominator/lib/log"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// certificateType holds the TLS certificate proxima serves. Whenever the
+// certificate or key file changes, certificateType reloads the
+// certificate. certificateType instances are safe to use with multiple
+// goroutines.
+type certificateType struct {
+	certFile string
+	keyFile  string
+	logger   log.Logger
+	mu       sync.Mutex
+	cert     *tls.Certificate
+}
+
+// newCertificate loads the certificate in certFile and keyFile and starts
+// watching both files for changes.
+func newCertificate(certFile, keyFile string, logger log.Logger) (
+	*certificateType, error) {
+	result := &certificateType{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := result.reload(); err != nil {
+		return nil, err
+	}
+	go result.watch(fsutil.WatchFile(certFile, logger))
+	go result.watch(fsutil.WatchFile(keyFile, logger))
+	return result, nil
+}
+
+func (c *certificateType) watch(changeCh <-chan io.ReadCloser) {
+	for readCloser := range changeCh {
+		readCloser.Close()
+		// If only one of the files has changed so far, this fails. The
+		// reload triggered by the other file will succeed.
+		if err := c.reload(); err != nil {
+			c.logger.Println(err)
+		}
+	}
+}
+
+func (c *certificateType) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the current certificate. It has the signature
+// tls.Config.GetCertificate requires.
+func (c *certificateType) GetCertificate(*tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// listenUnix listens on the unix socket at path removing any stale socket
+// file from a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// nonEmpty returns the non empty strings in values
+func nonEmpty(values []string) (result []string) {
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return
+}
+
+// newListeners returns listeners for all the plain ports, tls ports, and
+// unix sockets given on the command line.
+func newListeners(logger log.Logger) (result []net.Listener, err error) {
+	for _, port := range nonEmpty(fPorts) {
+		listener, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, listener)
+	}
+	tlsPorts := nonEmpty(fTlsPorts)
+	if len(tlsPorts) != 0 {
+		if *fTlsCertFile == "" || *fTlsKeyFile == "" {
+			return nil, errors.New(
+				"tlsCertFile and tlsKeyFile required with tlsPorts")
+		}
+		cert, err := newCertificate(*fTlsCertFile, *fTlsKeyFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{GetCertificate: cert.GetCertificate}
+		for _, port := range tlsPorts {
+			listener, err := net.Listen("tcp", ":"+port)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, tls.NewListener(listener, tlsConfig))
+		}
+	}
+	for _, path := range nonEmpty(fUnixSockets) {
+		listener, err := listenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, listener)
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Symantec/Dominator/lib/flagutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self signed certificate for 127.0.0.1 and its
+// key to dir. writeCertificate returns the certificate and key file names
+// along with the certificate.
+func writeCertificate(dir, name string) (
+	certFile, keyFile string, cert *x509.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	if err = ioutil.WriteFile(
+		certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0600); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(
+		keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		0600)
+	return
+}
+
+// pingServer serves /ping on listener until listener is closed.
+func pingServer(listener net.Listener) {
+	go http.Serve(listener, uuidHandler(dateHandler()))
+}
+
+func TestListeners(t *testing.T) {
+	logger := stdlog.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "proxima")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPorts, oldTlsPorts, oldUnixSockets := fPorts, fTlsPorts, fUnixSockets
+	oldCertFile, oldKeyFile := *fTlsCertFile, *fTlsKeyFile
+	defer func() {
+		fPorts, fTlsPorts, fUnixSockets = oldPorts, oldTlsPorts, oldUnixSockets
+		*fTlsCertFile, *fTlsKeyFile = oldCertFile, oldKeyFile
+	}()
+
+	Convey("Given TLS ports and unix sockets", t, func() {
+		certFile, keyFile, cert, err := writeCertificate(dir, "first")
+		So(err, ShouldBeNil)
+		socket := filepath.Join(dir, "proxima.sock")
+		fPorts = nil
+		fTlsPorts = flagutil.StringList{"0"}
+		fUnixSockets = flagutil.StringList{socket}
+		*fTlsCertFile, *fTlsKeyFile = certFile, keyFile
+		listeners, err := newListeners(logger)
+		So(err, ShouldBeNil)
+		So(listeners, ShouldHaveLength, 2)
+		for _, listener := range listeners {
+			defer listener.Close()
+			pingServer(listener)
+		}
+
+		Convey("TLS ports should serve https with the certificate", func() {
+			roots := x509.NewCertPool()
+			roots.AddCert(cert)
+			httpClient := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{RootCAs: roots},
+				},
+			}
+			_, port, err := net.SplitHostPort(listeners[0].Addr().String())
+			So(err, ShouldBeNil)
+			resp, err := httpClient.Get("https://127.0.0.1:" + port + "/ping")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+			So(resp.Header.Get("X-Influxdb-Version"), ShouldNotBeEmpty)
+		})
+
+		Convey("Unix sockets should serve http", func() {
+			httpClient := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(
+						ctx context.Context, network, addr string) (
+						net.Conn, error) {
+						var dialer net.Dialer
+						return dialer.DialContext(ctx, "unix", socket)
+					},
+				},
+			}
+			resp, err := httpClient.Get("http://proxima/ping")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+		})
+	})
+
+	Convey("TLS ports need a certificate and key", t, func() {
+		fPorts, fUnixSockets = nil, nil
+		fTlsPorts = flagutil.StringList{"0"}
+		*fTlsCertFile, *fTlsKeyFile = "", ""
+		_, err := newListeners(logger)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Reloading should pick up a new certificate", t, func() {
+		certFile, keyFile, _, err := writeCertificate(dir, "reload")
+		So(err, ShouldBeNil)
+		certificate, err := newCertificate(certFile, keyFile, logger)
+		So(err, ShouldBeNil)
+		first, err := certificate.GetCertificate(nil)
+		So(err, ShouldBeNil)
+		_, _, second, err := writeCertificate(dir, "reload")
+		So(err, ShouldBeNil)
+		So(certificate.reload(), ShouldBeNil)
+		current, err := certificate.GetCertificate(nil)
+		So(err, ShouldBeNil)
+		So(current, ShouldNotEqual, first)
+		So(current.Certificate[0], ShouldResemble, second.Raw)
+	})
+
+	Convey("Stale unix sockets should be replaced", t, func() {
+		socket := filepath.Join(dir, "stale.sock")
+		stale, err := net.ListenUnix(
+			"unix", &net.UnixAddr{Name: socket, Net: "unix"})
+		So(err, ShouldBeNil)
+		stale.SetUnlinkOnClose(false)
+		stale.Close()
+		listener, err := listenUnix(socket)
+		So(err, ShouldBeNil)
+		listener.Close()
+	})
+
+	Convey("Files that aren't sockets should be left alone", t, func() {
+		path := filepath.Join(dir, "regular")
+		So(ioutil.WriteFile(path, []byte("keep"), 0600), ShouldBeNil)
+		_, err := listenUnix(path)
+		So(err, ShouldNotBeNil)
+		contents, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(string(contents), ShouldEqual, "keep")
+	})
+}
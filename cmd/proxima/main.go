@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"github.com/Symantec/Dominator/lib/flagutil"
 	"github.com/Symantec/Dominator/lib/fsutil"
 	"github.com/Symantec/Dominator/lib/log"
 	"github.com/Symantec/Dominator/lib/log/serverlogger"
 	"github.com/Symantec/proxima/cmd/proxima/splash"
+	"github.com/Symantec/proxima/common"
 	"github.com/Symantec/scotty/influx/responses"
 	"github.com/Symantec/scotty/lib/apiutil"
 	"github.com/Symantec/tricorder/go/healthserver"
@@ -14,6 +17,7 @@ import (
 	"github.com/influxdata/influxdb/client/v2"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/uuid"
+	"net"
 	"net/http"
 	"net/rpc"
 	"net/url"
@@ -24,11 +28,22 @@ import (
 var (
 	fConfigFile = flag.String(
 		"config", "/etc/proxima/proxima.yaml", "config file")
-	fPorts = flagutil.StringList{"8086"}
+	fPorts       = flagutil.StringList{"8086"}
+	fTlsPorts    flagutil.StringList
+	fTlsCertFile = flag.String(
+		"tlsCertFile", "", "PEM certificate file for tlsPorts")
+	fTlsKeyFile = flag.String(
+		"tlsKeyFile", "", "PEM key file for tlsPorts")
+	fUnixSockets flagutil.StringList
 )
 
 func init() {
 	flag.Var(&fPorts, "ports", "Comma separated list of ports")
+	flag.Var(&fTlsPorts, "tlsPorts", "Comma separated list of https ports")
+	flag.Var(
+		&fUnixSockets,
+		"unixSockets",
+		"Comma separated list of unix socket paths")
 }
 
 func setHeader(w http.ResponseWriter, r *http.Request, key, value string) {
@@ -45,59 +60,199 @@ func uuidHandler(inner http.Handler) http.Handler {
 	})
 }
 
+type messageType struct {
+	Level string `json:"level"`
+	Text  string `json:"text"`
+}
+
 type seriesListType struct {
-	Series []models.Row `json:"series"`
+	Series   []models.Row  `json:"series,omitempty"`
+	Messages []messageType `json:"messages,omitempty"`
 }
 
 type resultListType struct {
 	Results []seriesListType `json:"results"`
 }
 
+// isShowDatabases returns true if query is SHOW DATABASES which proxima
+// answers itself.
+func isShowDatabases(query string) bool {
+	// POST bodies often end with a semicolon or newline
+	return strings.ToUpper(
+		strings.TrimRight(query, "; \t\r\n")) == "SHOW DATABASES"
+}
+
+// databasesRow returns the response row for SHOW DATABASES.
+func databasesRow(dbNames []string) models.Row {
+	values := make([][]interface{}, len(dbNames))
+	for i := range dbNames {
+		values[i] = []interface{}{dbNames[i]}
+	}
+	return models.Row{
+		Name:    "databases",
+		Columns: []string{"name"},
+		Values:  values,
+	}
+}
+
 func performQuery(
+	ctx context.Context,
 	executer *executerType,
+	user *common.User,
 	query, db, epoch string,
 	logger log.Logger) (interface{}, error) {
-	switch strings.ToUpper(query) {
-	case "SHOW MEASUREMENTS LIMIT 1":
+	if isShowDatabases(query) {
 		return responses.Serialise(&client.Response{
 			Results: []client.Result{
 				{
 					Series: []models.Row{
-						{
-							Name:    "measurements",
-							Columns: []string{"name"},
-							Values:  [][]interface{}{{"aname"}},
-						},
+						databasesRow(executer.Names(user)),
 					},
 				},
 			},
 		})
-	case "SHOW DATABASES":
-		dbNames := executer.Names()
-		values := make([][]interface{}, len(dbNames))
-		for i := range dbNames {
-			values[i] = []interface{}{dbNames[i]}
+	}
+	resp, err := executer.Query(ctx, user, query, db, epoch, logger)
+	if err != nil {
+		return nil, err
+	}
+	if hasMessages(resp) && resp.Error() == nil {
+		return withMessages(resp), nil
+	}
+	return responses.Serialise(resp)
+}
+
+// hasMessages returns true if any result in resp has messages.
+func hasMessages(resp *client.Response) bool {
+	for _, result := range resp.Results {
+		if len(result.Messages) != 0 {
+			return true
 		}
-		return responses.Serialise(&client.Response{
-			Results: []client.Result{
-				{
-					Series: []models.Row{
-						{
-							Name:    "databases",
-							Columns: []string{"name"},
-							Values:  values,
-						},
-					},
-				},
-			},
-		})
-	default:
-		resp, err := executer.Query(query, db, epoch, logger)
-		if err != nil {
-			return nil, err
+	}
+	return false
+}
+
+// withMessages returns resp ready for JSON encoding including the
+// messages of each result.
+func withMessages(resp *client.Response) *resultListType {
+	result := &resultListType{
+		Results: make([]seriesListType, len(resp.Results)),
+	}
+	for i := range resp.Results {
+		result.Results[i].Series = resp.Results[i].Series
+		for _, message := range resp.Results[i].Messages {
+			result.Results[i].Messages = append(
+				result.Results[i].Messages,
+				messageType{Level: message.Level, Text: message.Text})
 		}
-		return responses.Serialise(resp)
 	}
+	return result
+}
+
+// credentials returns the credentials in r. Like influx, credentials can
+// come from the u and p parameters, basic auth, or a bearer token.
+// Caller must call r.ParseForm() first.
+func credentials(r *http.Request) common.Credentials {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return common.Credentials{
+			Token: strings.TrimPrefix(auth, "Bearer "),
+		}
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return common.Credentials{Username: username, Password: password}
+	}
+	return common.Credentials{
+		Username: r.Form.Get("u"),
+		Password: r.Form.Get("p"),
+	}
+}
+
+func writeAuthError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Basic realm="proxima"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// queryString returns the query in req with any bound parameters from
+// the params parameter substituted.
+func queryString(req url.Values) (string, error) {
+	query := req.Get("q")
+	paramsStr := req.Get("params")
+	if paramsStr == "" {
+		return query, nil
+	}
+	var params map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(paramsStr))
+	decoder.UseNumber()
+	if err := decoder.Decode(&params); err != nil {
+		return "", err
+	}
+	return common.BindParameters(query, params)
+}
+
+// queryHandler serves /query. Like influx, parameters may come from
+// the URL or from a form encoded POST body. Backend queries are cancelled
+// if the client disconnects. With chunked=true, results stream back in
+// chunks of at most chunk_size values as they become available.
+func queryHandler(executer *executerType, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "POST" {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(
+				w,
+				http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+		// Parses both URL and body parameters into r.Form
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		user, err := executer.Authenticate(credentials(r))
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		params := r.Form
+		if params.Get("chunked") == "true" {
+			query, err := queryString(params)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			performChunkedQuery(
+				ctx,
+				w,
+				executer,
+				user,
+				query,
+				params.Get("db"),
+				params.Get("epoch"),
+				chunkSize(params.Get("chunk_size")),
+				logger)
+			return
+		}
+		apiutil.NewHandler(
+			func(url.Values) (interface{}, error) {
+				query, err := queryString(params)
+				if err != nil {
+					return nil, err
+				}
+				return performQuery(
+					ctx,
+					executer,
+					user,
+					query,
+					params.Get("db"),
+					params.Get("epoch"),
+					logger)
+			},
+			nil,
+		).ServeHTTP(w, r)
+	})
 }
 
 func dateHandler() http.Handler {
@@ -136,7 +291,8 @@ func main() {
 	}()
 	http.Handle("/",
 		&splash.Handler{
-			Log: logger,
+			Log:      logger,
+			Backends: executer,
 		})
 	http.Handle(
 		"/ping",
@@ -144,36 +300,24 @@ func main() {
 	)
 	http.Handle(
 		"/query",
-		uuidHandler(
-			apiutil.NewHandler(
-				func(req url.Values) (interface{}, error) {
-					resp, err := performQuery(
-						executer,
-						req.Get("q"),
-						req.Get("db"),
-						req.Get("epoch"),
-						logger)
-					if err != nil {
-						return nil, err
-					}
-					return resp, err
-				},
-				nil,
-			),
-		),
+		uuidHandler(queryHandler(executer, logger)),
 	)
-	if len(fPorts) == 0 {
-		logger.Fatal("At least one port required.")
+	listeners, err := newListeners(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(listeners) == 0 {
+		logger.Fatal("At least one port or unix socket required.")
 	}
-	for _, port := range fPorts[1:] {
-		go func(port string) {
-			if err := http.ListenAndServe(":"+port, nil); err != nil {
+	for _, listener := range listeners[1:] {
+		go func(listener net.Listener) {
+			if err := http.Serve(listener, nil); err != nil {
 				logger.Fatal(err)
 			}
-		}(port)
+		}(listener)
 	}
 	healthserver.SetReady()
-	if err := http.ListenAndServe(":"+fPorts[0], nil); err != nil {
+	if err := http.Serve(listeners[0], nil); err != nil {
 		logger.Fatal(err)
 	}
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/proxima/common"
+	"github.com/influxdata/influxdb/client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	kSeriesResult = `{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1000,10]]}]}`
+)
+
+// newFakeInflux returns a fake influx server that answers every query
+// with a single cpu series. The fake records the form of each query in
+// queries.
+func newFakeInflux(queries chan<- url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ping" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			r.ParseForm()
+			if queries != nil {
+				queries <- r.Form
+			}
+			fmt.Fprintf(w, `{"results":[%s]}`+"\n", kSeriesResult)
+		}))
+}
+
+// newTestExecuter returns an executer set up with configStr.
+func newTestExecuter(configStr string) (*executerType, error) {
+	executer := newExecuter()
+	if err := executer.SetupWithStream(strings.NewReader(configStr)); err != nil {
+		return nil, err
+	}
+	return executer, nil
+}
+
+// newQueryServer returns a proxima server for /query that uses executer.
+func newQueryServer(executer *executerType) *httptest.Server {
+	return httptest.NewServer(uuidHandler(queryHandler(executer, nil)))
+}
+
+// readResponse returns the status code and body of resp and closes it.
+func readResponse(resp *http.Response) (int, string) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, ""
+	}
+	return resp.StatusCode, string(body)
+}
+
+// decodeResponse decodes body, which holds a non chunked response.
+func decodeResponse(body string) (*client.Response, error) {
+	var result client.Response
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func TestCredentials(t *testing.T) {
+	Convey("Credentials should come from the request", t, func() {
+		r := httptest.NewRequest("GET", "/query?u=alice&p=secret", nil)
+		r.ParseForm()
+		So(credentials(r), ShouldResemble, common.Credentials{
+			Username: "alice", Password: "secret"})
+
+		Convey("Basic auth should win over u and p", func() {
+			r.SetBasicAuth("bob", "hunter2")
+			So(credentials(r), ShouldResemble, common.Credentials{
+				Username: "bob", Password: "hunter2"})
+		})
+
+		Convey("Bearer tokens should win over u and p", func() {
+			r.Header.Set("Authorization", "Bearer abcd")
+			So(credentials(r), ShouldResemble, common.Credentials{
+				Token: "abcd"})
+		})
+	})
+
+	Convey("Given proxima with users", t, func() {
+		influx := newFakeInflux(nil)
+		defer influx.Close()
+		executer, err := newTestExecuter(fmt.Sprintf(`
+databases:
+- name: regular
+  influxes:
+  - hostAndPort: %s
+    duration: 24h
+    database: regular
+- name: secret
+  influxes:
+  - hostAndPort: %s
+    duration: 24h
+    database: secret
+users:
+- name: alice
+  password: wonderland
+  databases:
+  - regular
+- name: bob
+  token: abcd
+  allDatabases: true
+`, influx.URL, influx.URL))
+		So(err, ShouldBeNil)
+		server := newQueryServer(executer)
+		defer server.Close()
+		query := func(params url.Values, setAuth func(r *http.Request)) (
+			int, string) {
+			r, err := http.NewRequest(
+				"GET", server.URL+"/query?"+params.Encode(), nil)
+			So(err, ShouldBeNil)
+			if setAuth != nil {
+				setAuth(r)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			So(err, ShouldBeNil)
+			return readResponse(resp)
+		}
+		selectParams := url.Values{
+			"db": {"regular"},
+			"q":  {"select value from cpu where time >= now() - 1h"},
+		}
+
+		Convey("Missing credentials should be rejected", func() {
+			code, _ := query(selectParams, nil)
+			So(code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Wrong passwords should be rejected", func() {
+			code, _ := query(selectParams, func(r *http.Request) {
+				r.SetBasicAuth("alice", "wrong")
+			})
+			So(code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("The u and p parameters should authenticate", func() {
+			params := url.Values{
+				"u": {"alice"}, "p": {"wonderland"}}
+			for key, value := range selectParams {
+				params[key] = value
+			}
+			code, body := query(params, nil)
+			So(code, ShouldEqual, http.StatusOK)
+			response, err := decodeResponse(body)
+			So(err, ShouldBeNil)
+			So(response.Results[0].Series[0].Name, ShouldEqual, "cpu")
+		})
+
+		Convey("Basic auth should authenticate", func() {
+			code, _ := query(selectParams, func(r *http.Request) {
+				r.SetBasicAuth("alice", "wonderland")
+			})
+			So(code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Bearer tokens should authenticate", func() {
+			params := url.Values{
+				"db": {"secret"}, "q": selectParams["q"]}
+			code, _ := query(params, func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer abcd")
+			})
+			So(code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Users should read only their databases", func() {
+			params := url.Values{
+				"db": {"secret"}, "q": selectParams["q"]}
+			_, body := query(params, func(r *http.Request) {
+				r.SetBasicAuth("alice", "wonderland")
+			})
+			So(body, ShouldContainSubstring, "not authorized")
+		})
+
+		Convey("SHOW DATABASES should list only the user's databases", func() {
+			code, body := query(
+				url.Values{"q": {"show databases"}},
+				func(r *http.Request) {
+					r.SetBasicAuth("alice", "wonderland")
+				})
+			So(code, ShouldEqual, http.StatusOK)
+			response, err := decodeResponse(body)
+			So(err, ShouldBeNil)
+			So(response.Results[0].Series[0].Values, ShouldResemble,
+				[][]interface{}{{"regular"}})
+		})
+	})
+}
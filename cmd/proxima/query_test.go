@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPostQueries(t *testing.T) {
+	Convey("Given proxima with an influx", t, func() {
+		queries := make(chan url.Values, 10)
+		influx := newFakeInflux(queries)
+		defer influx.Close()
+		executer, err := newTestExecuter(fmt.Sprintf(`
+databases:
+- name: regular
+  influxes:
+  - hostAndPort: %s
+    duration: 24h
+    database: regular
+`, influx.URL))
+		So(err, ShouldBeNil)
+		server := newQueryServer(executer)
+		defer server.Close()
+
+		Convey("Queries should come from form encoded POST bodies", func() {
+			resp, err := http.PostForm(server.URL+"/query", url.Values{
+				"db": {"regular"},
+				"q":  {"select value from cpu where time >= now() - 1h"},
+			})
+			So(err, ShouldBeNil)
+			code, body := readResponse(resp)
+			So(code, ShouldEqual, http.StatusOK)
+			response, err := decodeResponse(body)
+			So(err, ShouldBeNil)
+			So(response.Results[0].Series[0].Name, ShouldEqual, "cpu")
+			backendQuery := <-queries
+			So(backendQuery.Get("db"), ShouldEqual, "regular")
+			So(backendQuery.Get("q"), ShouldStartWith, "SELECT value FROM cpu")
+		})
+
+		Convey("URL and body parameters should combine", func() {
+			resp, err := http.PostForm(
+				server.URL+"/query?db=regular",
+				url.Values{
+					"q":      {"select value from cpu where host = $host and time >= now() - 1h"},
+					"params": {`{"host": "it's"}`},
+				})
+			So(err, ShouldBeNil)
+			code, _ := readResponse(resp)
+			So(code, ShouldEqual, http.StatusOK)
+			backendQuery := <-queries
+			So(backendQuery.Get("db"), ShouldEqual, "regular")
+			So(backendQuery.Get("q"), ShouldContainSubstring, `host = 'it\'s'`)
+		})
+
+		Convey("Bad parameters should fail", func() {
+			resp, err := http.PostForm(server.URL+"/query", url.Values{
+				"db":     {"regular"},
+				"q":      {"select value from cpu where host = $host"},
+				"params": {`{"host": `},
+			})
+			So(err, ShouldBeNil)
+			code, _ := readResponse(resp)
+			So(code, ShouldNotEqual, http.StatusOK)
+			So(queries, ShouldBeEmpty)
+		})
+
+		Convey("SHOW DATABASES should work from a POST body", func() {
+			resp, err := http.Post(
+				server.URL+"/query",
+				"application/x-www-form-urlencoded",
+				strings.NewReader("q=SHOW+DATABASES%3B%0A"))
+			So(err, ShouldBeNil)
+			code, body := readResponse(resp)
+			So(code, ShouldEqual, http.StatusOK)
+			response, err := decodeResponse(body)
+			So(err, ShouldBeNil)
+			So(response.Results[0].Series[0].Values, ShouldResemble,
+				[][]interface{}{{"regular"}})
+		})
+
+		Convey("Other methods should not be allowed", func() {
+			r, err := http.NewRequest("PUT", server.URL+"/query", nil)
+			So(err, ShouldBeNil)
+			resp, err := http.DefaultClient.Do(r)
+			So(err, ShouldBeNil)
+			code, _ := readResponse(resp)
+			So(code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(resp.Header.Get("Allow"), ShouldEqual, "GET, POST")
+		})
+	})
+}
@@ -14,6 +14,8 @@ type HtmlWriter interface {
 
 type Handler struct {
 	Log HtmlWriter
+	// The health of the backends. Optional.
+	Backends HtmlWriter
 }
 
 func (h *Handler) ServeHTTP(
@@ -29,6 +31,10 @@ func (h *Handler) ServeHTTP(
 	fmt.Fprintln(writer, "</center>")
 	html.WriteHeaderNoGC(writer)
 	fmt.Fprintln(writer, "<br>")
+	if h.Backends != nil {
+		h.Backends.WriteHtml(writer)
+		fmt.Fprintln(writer, "<br>")
+	}
 	h.Log.WriteHtml(writer)
 	fmt.Fprintln(writer, "</body>")
 	fmt.Fprintln(writer, "</html>")
@@ -2,28 +2,47 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"github.com/Symantec/Dominator/lib/log"
 	"github.com/Symantec/proxima/config"
 	"github.com/influxdata/influxdb/client/v2"
 	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"sync"
 	"time"
 )
 
+var (
+	// ErrAuthFailed means that the client could not be authenticated.
+	ErrAuthFailed = errors.New("authorization failed")
+)
+
 // Influx represents a single influx backend.
 type Influx struct {
-	data      config.Influx
+	data config.Influx
+	// The kind of backend e.g "influx" or "openTSDB"
+	kind      string
 	dbQueryer dbQueryerType
+	// nil means queries need no renaming
+	names *namesType
+	// If true, proxima asks the backend for the duration of its retention
+	// policy.
+	discover bool
 }
 
 func NewInflux(influx config.Influx) (*Influx, error) {
-	return newInfluxForTesting(influx, influxCreateDbQueryer)
+	return newInfluxForTesting(influx, createDbQueryer)
 }
 
-// Query runs a query against this backend.
+// Query runs a query against this backend. Cancelling ctx aborts the
+// query.
 func (d *Influx) Query(
-	query *influxql.Query, epoch string, logger log.Logger) (
-	*client.Response, error) {
-	return d.dbQueryer.Query(query.String(), d.data.Database, epoch)
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	return d.query(ctx, query, epoch, logger)
 }
 
 // Close frees any resources associated with this instance.
@@ -34,21 +53,44 @@ func (d *Influx) Close() error {
 // InfluxList represents a group of influx backends.
 // nil represents the group of zero influx backends.
 type InfluxList struct {
+	// Guards the order of instances and the durations of the influx
+	// backends which change as proxima discovers durations.
+	lock sync.RWMutex
+	// All the backends ordered by duration in descending order
 	instances []*Influx
+	// Just the influx backends in config order
+	influxes []*Influx
+	// If true, each backend covers only the times that no backend with
+	// finer grained data covers.
+	disjoint bool
+	// Closing stops rediscovering durations. nil if there are none to
+	// discover.
+	done chan struct{}
+	// Closed once the first discovery of durations finishes. nil if there
+	// are none to discover.
+	discovered chan struct{}
+	// Closed once rediscovering durations stops. nil if there are none to
+	// discover.
+	stopped chan struct{}
+	// Responses for times fully in the past. nil means no caching.
+	cache *responseCacheType
 }
 
 // NewInfluxList returns a new instancce. If the length of influxes is 0,
 // NewInfluxList returns nil.
 func NewInfluxList(influxes config.InfluxList) (*InfluxList, error) {
-	return newInfluxListForTesting(influxes, influxCreateDbQueryer)
+	return newInfluxListForTesting(influxes, createDbQueryer)
 }
 
 // Query runs a query against the backends in this group merging the resuls
-// into a single response.
+// into a single response. Cancelling ctx aborts the query.
 func (l *InfluxList) Query(
-	query *influxql.Query, epoch string, now time.Time, logger log.Logger) (
-	*client.Response, error) {
-	return l.query(query, epoch, now, logger)
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	return l.query(ctx, query, epoch, now, logger)
 }
 
 // Close frees any resources associated with this instance.
@@ -67,16 +109,33 @@ type Scotty struct {
 
 	// Each scotty represents the same data.
 	scotties *ScottyList
+
+	// The scotty dbQueryer connects to. Only applies with dbQueryer.
+	hostAndPort string
+
+	// The database to query. Only applies with dbQueryer.
+	database string
+
+	// How far back data goes. 0 means as far back as queries ask.
+	duration time.Duration
+
+	// How long to wait for a response. 0 means forever.
+	timeout time.Duration
 }
 
 func NewScotty(scotty config.Scotty) (*Scotty, error) {
-	return newScottyForTesting(scotty, influxCreateDbQueryer)
+	return newScottyForTesting(scotty, createDbQueryer)
 }
 
+// Query runs a query against this scotty server. now is the current time.
+// Cancelling ctx aborts the query.
 func (s *Scotty) Query(
-	query *influxql.Query, epoch string, logger log.Logger) (
-	*client.Response, error) {
-	return s.query(query, epoch, logger)
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	return s.query(ctx, query, epoch, now, logger)
 }
 
 // Close frees any resources associated with this instance.
@@ -85,19 +144,39 @@ func (s *Scotty) Close() error {
 }
 
 // ScottyPartials represents a list of scotties where all the scotties
-// together represent the data. All scotties must respond to each query.
+// together represent the data. All scotties that may have data for a
+// query must respond to it.
 type ScottyPartials struct {
 	instances []*Scotty
+	// Decides which partials a statement goes to. nil means all.
+	router *shardRouterType
+	// The most raw points to fetch for an aggregation. 0 means no limit
+	// but no percentile or median.
+	maxRawPoints int
 }
 
-func NewScottyPartials(scotties config.ScottyList) (*ScottyPartials, error) {
-	return newScottyPartialsForTesting(scotties, influxCreateDbQueryer)
+// NewScottyPartials returns a new instance. sharding tells how series are
+// divided among scotties. nil means every query goes to every scotty.
+// maxRawPoints is the most raw points to fetch to compute aggregations
+// such as percentile and median. 0 means percentile and median are not
+// supported.
+func NewScottyPartials(
+	scotties config.ScottyList,
+	sharding *config.Sharding,
+	maxRawPoints int) (*ScottyPartials, error) {
+	return newScottyPartialsForTesting(
+		scotties, sharding, maxRawPoints, createDbQueryer)
 }
 
+// Query runs a query against all the scotties aggregating the results.
+// now is the current time. Cancelling ctx aborts the query.
 func (l *ScottyPartials) Query(
-	query *influxql.Query, epoch string, logger log.Logger) (
-	*client.Response, error) {
-	return l.query(query, epoch, logger)
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	return l.query(ctx, query, epoch, now, logger)
 }
 
 func (l *ScottyPartials) Close() error {
@@ -109,20 +188,38 @@ func (l *ScottyPartials) Close() error {
 // nil represents the group of zero scotty servers.
 type ScottyList struct {
 	instances []*Scotty
+	// One of the config.StrategyXXX constants
+	strategy   string
+	hedgeDelay time.Duration
+	// The scotty the next round robin query starts with
+	next uint32
+	// Guards latencies
+	lock sync.Mutex
+	// Moving average of how long each scotty takes to respond. 0 means
+	// not yet known.
+	latencies []time.Duration
 }
 
-// NewScottyList returns a new instancce. If the length of scotties is 0,
-// NewScottyList returns nil.
-func NewScottyList(scotties config.ScottyList) (*ScottyList, error) {
-	return newScottyListForTesting(scotties, influxCreateDbQueryer)
+// NewScottyList returns a new instancce. redundancy tells how to use
+// the scotties. nil means send each query to every scotty. If the length
+// of scotties is 0, NewScottyList returns nil.
+func NewScottyList(
+	scotties config.ScottyList,
+	redundancy *config.Redundancy) (*ScottyList, error) {
+	return newScottyListForTesting(scotties, redundancy, createDbQueryer)
 }
 
-// Query runs a query against the servers in this group merging the resuls
-// into a single response.
+// Query runs a query against the servers in this group. With
+// config.StrategyMergeAll, Query merges the responses into a single
+// response; otherwise Query returns the response of one server. now is
+// the current time. Cancelling ctx aborts the query.
 func (l *ScottyList) Query(
-	query *influxql.Query, epoch string, logger log.Logger) (
-	*client.Response, error) {
-	return l.query(query, epoch, logger)
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	return l.query(ctx, query, epoch, now, logger)
 }
 
 // Close frees any resources associated with this instance.
@@ -130,29 +227,98 @@ func (l *ScottyList) Close() error {
 	return l._close()
 }
 
+// States of a backend's circuit breaker
+const (
+	// Queries go to the backend.
+	BreakerClosed = "closed"
+	// The backend is down. Queries fail without reaching it.
+	BreakerOpen = "open"
+	// The backend may be back up. A single probe query goes to it.
+	BreakerHalfOpen = "half-open"
+)
+
+// BackendHealth is the health of a single backend as proxima sees it.
+type BackendHealth struct {
+	// The kind of backend: "influx", "openTSDB", "prometheus", or
+	// "graphite". Scotty servers are of kind "influx".
+	Kind        string
+	HostAndPort string
+	// One of BreakerClosed, BreakerOpen, or BreakerHalfOpen
+	State string
+	// When the backend entered State
+	Since time.Time
+	// How many queries and pings in a row have failed
+	ConsecutiveFailures int
+	// The most recent failure. Empty if there has been none.
+	LastError string
+}
+
 // Database represents a single proxima configuration.
 type Database struct {
 	name     string
 	influxes *InfluxList
 	scotties *ScottyList
+	timeout  time.Duration
+	// One of the config.PartialFailuresXXX constants
+	partialFailures string
+	// If true, time ranges snap to GROUP BY time boundaries.
+	alignTimes bool
+	// Every backend in this configuration in the order created
+	backends []*backendType
 }
 
 func NewDatabase(db config.Database) (*Database, error) {
-	return newDatabaseForTesting(db, influxCreateDbQueryer)
+	return newDatabaseForTesting(db, createDbQueryer)
 }
 
 func (d *Database) Name() string {
 	return d.name
 }
 
+// InfluxDuration returns how far back the data in the ith influx backend
+// of the configuration goes. For influx backends configured without a
+// duration, InfluxDuration returns the duration that proxima discovered,
+// or 0 if proxima has yet to discover it.
+func (d *Database) InfluxDuration(i int) time.Duration {
+	return d.influxes.duration(i)
+}
+
+// Health returns the health of every backend in this configuration. The
+// order of the backends is the same from call to call.
+func (d *Database) Health() []BackendHealth {
+	return d.health()
+}
+
 // Query runs a query against the influx backends and scotty servers in this
-// proxima configuration.
+// proxima configuration. Cancelling ctx aborts the query and any
+// outstanding requests to the backends. If some backends fail while
+// others answer, what Query does depends on the partial failures mode of
+// this configuration.
 func (d *Database) Query(
+	ctx context.Context,
 	query *influxql.Query,
 	epoch string,
 	now time.Time,
 	logger log.Logger) (*client.Response, error) {
-	return d.query(query, epoch, now, logger)
+	return d.query(ctx, query, epoch, now, logger)
+}
+
+// QueryStream works like Query except that it writes results to w as they
+// become available rather than returning them all at once. chunkSize is
+// the maximum number of values per row to request from each backend at a
+// time; 0 means the backend default. QueryStream runs the statements in
+// query one at a time calling w.EndStatement after each. If QueryStream
+// returns an error, the current statement failed and the remaining
+// statements did not run.
+func (d *Database) QueryStream(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	chunkSize int,
+	logger log.Logger,
+	w RowWriter) error {
+	return d.queryStream(ctx, query, epoch, now, chunkSize, logger, w)
 }
 
 // Close frees any resources associated with this instance.
@@ -160,14 +326,70 @@ func (d *Database) Close() error {
 	return d._close()
 }
 
+// RowWriter receives the results of Database.QueryStream.
+type RowWriter interface {
+	// WriteRow writes a series or part of a series for the current
+	// statement. If row.Partial is true, the next call to WriteRow
+	// continues the same series.
+	WriteRow(row models.Row) error
+	// WriteMessage writes a message such as a warning for the current
+	// statement.
+	WriteMessage(level, text string) error
+	// EndStatement marks the end of the results for the current statement.
+	EndStatement() error
+}
+
+// Credentials are what a client presents to proxima to authenticate.
+type Credentials struct {
+	// Username and Password from basic auth or the u and p parameters
+	Username string
+	Password string
+	// Bearer token
+	Token string
+}
+
+// User represents an authenticated user of proxima.
+type User struct {
+	name         string
+	allDatabases bool
+	databases    map[string]bool
+}
+
+// Name returns the name of this user. Name returns the empty string
+// for the anonymous user.
+func (u *User) Name() string {
+	return u.name
+}
+
+// CanRead returns true if this user may query the named database.
+func (u *User) CanRead(database string) bool {
+	return u.allDatabases || u.databases[database]
+}
+
+// Filter returns the database names in names that this user may query.
+func (u *User) Filter(names []string) []string {
+	return u.filter(names)
+}
+
+// BindParameters substitutes each $-parameter in queryStr with the
+// corresponding value in params the way influxdb does for its params query
+// parameter and returns the resulting query. Values must be strings,
+// booleans, or numbers which should be of type json.Number.
+func BindParameters(
+	queryStr string, params map[string]interface{}) (string, error) {
+	return bindParameters(queryStr, params)
+}
+
 // Proxima represents all the configurations of a proxima application.
 // A Proxima instance does the heavy lifting for the proxima application.
 type Proxima struct {
-	dbs map[string]*Database
+	dbs        map[string]*Database
+	users      map[string]*userWithSecretsType
+	usersByTok map[string]*userWithSecretsType
 }
 
 func NewProxima(proxima config.Proxima) (*Proxima, error) {
-	return newProximaForTesting(proxima, influxCreateDbQueryer)
+	return newProximaForTesting(proxima, createDbQueryer)
 }
 
 // ByName returns the configuration with given name or nil if no such
@@ -181,6 +403,19 @@ func (p *Proxima) Names() (result []string) {
 	return p.names()
 }
 
+// AuthEnabled returns true if clients must authenticate to query.
+func (p *Proxima) AuthEnabled() bool {
+	return len(p.users) != 0
+}
+
+// Authenticate returns the user with given credentials. If AuthEnabled()
+// is false, Authenticate returns an anonymous user that may query every
+// database. Authenticate returns ErrAuthFailed if the credentials are
+// wrong or missing.
+func (p *Proxima) Authenticate(creds Credentials) (*User, error) {
+	return p.authenticate(creds)
+}
+
 // Close frees any resources associated with this instance.
 func (p *Proxima) Close() error {
 	return p._close()
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/influxdata/influxdb/influxql"
+)
+
+var (
+	// The user when authentication is disabled.
+	kAnonymousUser = &User{allDatabases: true}
+)
+
+// userWithSecretsType represents a configured user along with what the
+// user must present to authenticate.
+type userWithSecretsType struct {
+	User
+	password string
+	token    string
+}
+
+func newUser(user config.User) (*userWithSecretsType, error) {
+	if user.Name == "" {
+		return nil, errors.New("User must have a name")
+	}
+	password, err := secretFromConfig(
+		user.Password, user.PasswordFile, "password")
+	if err != nil {
+		return nil, err
+	}
+	token, err := secretFromConfig(user.Token, user.TokenFile, "token")
+	if err != nil {
+		return nil, err
+	}
+	if password == "" && token == "" {
+		return nil, fmt.Errorf(
+			"User %s must have a password or a token", user.Name)
+	}
+	result := &userWithSecretsType{
+		User: User{
+			name:         user.Name,
+			allDatabases: user.AllDatabases,
+			databases:    make(map[string]bool),
+		},
+		password: password,
+		token:    token,
+	}
+	for _, db := range user.Databases {
+		result.databases[db] = true
+	}
+	return result, nil
+}
+
+// addUsers adds the users to this instance.
+func (p *Proxima) addUsers(users []config.User) error {
+	p.users = make(map[string]*userWithSecretsType)
+	p.usersByTok = make(map[string]*userWithSecretsType)
+	for _, userSpec := range users {
+		user, err := newUser(userSpec)
+		if err != nil {
+			return err
+		}
+		if _, ok := p.users[user.name]; ok {
+			return fmt.Errorf("Duplicate user name: %s", user.name)
+		}
+		p.users[user.name] = user
+		if user.token != "" {
+			if _, ok := p.usersByTok[user.token]; ok {
+				return fmt.Errorf("Duplicate token for user: %s", user.name)
+			}
+			p.usersByTok[user.token] = user
+		}
+	}
+	return nil
+}
+
+// secretsEqual compares secrets in constant time.
+func secretsEqual(x, y string) bool {
+	return subtle.ConstantTimeCompare(([]byte)(x), ([]byte)(y)) == 1
+}
+
+func (p *Proxima) authenticate(creds Credentials) (*User, error) {
+	if !p.AuthEnabled() {
+		return kAnonymousUser, nil
+	}
+	if creds.Token != "" {
+		for token, user := range p.usersByTok {
+			if secretsEqual(token, creds.Token) {
+				return &user.User, nil
+			}
+		}
+		return nil, ErrAuthFailed
+	}
+	user, ok := p.users[creds.Username]
+	if !ok || user.password == "" || !secretsEqual(
+		user.password, creds.Password) {
+		return nil, ErrAuthFailed
+	}
+	return &user.User, nil
+}
+
+func (u *User) filter(names []string) (result []string) {
+	for _, name := range names {
+		if u.CanRead(name) {
+			result = append(result, name)
+		}
+	}
+	return
+}
+
+// statementDatabase returns the database that stmt names in an ON clause
+// or nil if stmt has no such clause.
+func statementDatabase(stmt influxql.Statement) *string {
+	switch s := stmt.(type) {
+	case *influxql.ShowMeasurementsStatement:
+		return &s.Database
+	case *influxql.ShowTagKeysStatement:
+		return &s.Database
+	case *influxql.ShowTagValuesStatement:
+		return &s.Database
+	case *influxql.ShowFieldKeysStatement:
+		return &s.Database
+	case *influxql.ShowSeriesStatement:
+		return &s.Database
+	case *influxql.ShowRetentionPoliciesStatement:
+		return &s.Database
+	}
+	return nil
+}
+
+// visitDatabaseNames calls visit with each database name that query
+// names either in its sources or in ON clauses.
+func visitDatabaseNames(query *influxql.Query, visit func(name *string)) {
+	influxql.WalkFunc(query, func(node influxql.Node) {
+		if measurement, ok := node.(*influxql.Measurement); ok {
+			visit(&measurement.Database)
+		}
+	})
+	for _, stmt := range query.Statements {
+		if name := statementDatabase(stmt); name != nil {
+			visit(name)
+		}
+	}
+}
+
+// withoutDatabaseNames returns query with the database names in its
+// sources and ON clauses removed since each backend has its own database.
+// Users may name only the configuration they query, database, so that
+// they can't read other databases on the same backends.
+func withoutDatabaseNames(query *influxql.Query, database string) (
+	*influxql.Query, error) {
+	var err error
+	named := false
+	visitDatabaseNames(query, func(name *string) {
+		if *name == "" {
+			return
+		}
+		named = true
+		if *name != database && err == nil {
+			err = fmt.Errorf("Query may not read database %s", *name)
+		}
+	})
+	if err != nil || !named {
+		return query, err
+	}
+	// Parse a fresh copy so that we don't change the caller's query.
+	result, err := influxql.ParseQuery(query.String())
+	if err != nil {
+		return nil, err
+	}
+	visitDatabaseNames(result, func(name *string) {
+		*name = ""
+	})
+	return result, nil
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"context"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	Convey("Given a proxima with no users", t, func() {
+		proxima, err := NewProxima(config.Proxima{
+			Dbs: []config.Database{{Name: "foo"}, {Name: "bar"}},
+		})
+		So(err, ShouldBeNil)
+		So(proxima.AuthEnabled(), ShouldBeFalse)
+
+		Convey("Anyone may query any database", func() {
+			user, err := proxima.Authenticate(Credentials{})
+			So(err, ShouldBeNil)
+			So(user.CanRead("foo"), ShouldBeTrue)
+			So(user.Filter(proxima.Names()), ShouldResemble, []string{
+				"bar", "foo"})
+		})
+	})
+
+	Convey("Given a proxima with users", t, func() {
+		proxima, err := NewProxima(config.Proxima{
+			Dbs: []config.Database{
+				{Name: "foo"}, {Name: "bar"}, {Name: "baz"}},
+			Users: []config.User{
+				{
+					Name:      "alice",
+					Password:  "secret",
+					Databases: []string{"foo", "baz"},
+				},
+				{
+					Name:         "bob",
+					Token:        "abcd",
+					AllDatabases: true,
+				},
+			},
+		})
+		So(err, ShouldBeNil)
+		So(proxima.AuthEnabled(), ShouldBeTrue)
+
+		Convey("Correct password should authenticate", func() {
+			user, err := proxima.Authenticate(Credentials{
+				Username: "alice", Password: "secret"})
+			So(err, ShouldBeNil)
+			So(user.Name(), ShouldEqual, "alice")
+			So(user.CanRead("foo"), ShouldBeTrue)
+			So(user.CanRead("bar"), ShouldBeFalse)
+			So(user.Filter(proxima.Names()), ShouldResemble, []string{
+				"baz", "foo"})
+		})
+
+		Convey("Wrong password should fail", func() {
+			_, err := proxima.Authenticate(Credentials{
+				Username: "alice", Password: "wrong"})
+			So(err, ShouldEqual, ErrAuthFailed)
+		})
+
+		Convey("Missing credentials should fail", func() {
+			_, err := proxima.Authenticate(Credentials{})
+			So(err, ShouldEqual, ErrAuthFailed)
+		})
+
+		Convey("User with only a token cannot use a password", func() {
+			_, err := proxima.Authenticate(Credentials{Username: "bob"})
+			So(err, ShouldEqual, ErrAuthFailed)
+		})
+
+		Convey("Correct token should authenticate", func() {
+			user, err := proxima.Authenticate(Credentials{Token: "abcd"})
+			So(err, ShouldBeNil)
+			So(user.Name(), ShouldEqual, "bob")
+			So(user.Filter(proxima.Names()), ShouldResemble, []string{
+				"bar", "baz", "foo"})
+		})
+
+		Convey("Wrong token should fail", func() {
+			_, err := proxima.Authenticate(Credentials{Token: "abce"})
+			So(err, ShouldEqual, ErrAuthFailed)
+		})
+	})
+
+	Convey("Duplicate user names should produce an error", t, func() {
+		_, err := NewProxima(config.Proxima{
+			Users: []config.User{
+				{Name: "alice", Password: "secret"},
+				{Name: "alice", Password: "other"},
+			},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("User without password or token should produce an error", t, func() {
+		_, err := NewProxima(config.Proxima{
+			Users: []config.User{{Name: "alice"}},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a database on a shared influx", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{"alpha": &fakeDbQueryerType{}}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "foo",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a", Duration: time.Hour},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		Convey("Queries naming other databases should never reach it", func() {
+			for _, queryStr := range []string{
+				`select * from "otherdb".."cpu" where time >= now() - 1h`,
+				`select value from cpu, "otherdb".autogen.mem where time >= now() - 1h`,
+				`show measurements on otherdb`,
+			} {
+				query, err := qlutils.NewQuery(queryStr, now)
+				So(err, ShouldBeNil)
+				_, err = db.Query(context.Background(), query, "ms", now, nil)
+				So(err, ShouldNotBeNil)
+				var recorder rowRecorderType
+				err = db.QueryStream(
+					context.Background(), query, "ms", now, 0, nil, &recorder)
+				So(err, ShouldNotBeNil)
+			}
+			So(store["alpha"].NoMoreQueries(), ShouldBeTrue)
+		})
+
+		Convey("Queries naming their own database should lose the name", func() {
+			query, err := qlutils.NewQuery(
+				`select value from "foo".."cpu" where time >= now() - 1h`, now)
+			So(err, ShouldBeNil)
+			_, err = db.Query(context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			queryStr, database, _ := store["alpha"].NextQuery()
+			So(queryStr, ShouldNotContainSubstring, "foo")
+			So(queryStr, ShouldContainSubstring, "FROM cpu")
+			So(database, ShouldEqual, "a")
+		})
+	})
+}
@@ -0,0 +1,401 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/Symantec/scotty/influx/responses"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultCacheBucket    = time.Hour
+	kDefaultCacheMinAge    = time.Hour
+	kDefaultCacheMaxValues = 1000000
+)
+
+// cacheKeyType identifies the response of a backend for a time bucket.
+type cacheKeyType struct {
+	// The backend
+	tier  *Influx
+	epoch string
+	// The statement with its time range set to the bucket
+	statement string
+	// Start of the bucket in nanoseconds since the epoch
+	bucket int64
+}
+
+type cacheEntryType struct {
+	key    cacheKeyType
+	result client.Result
+	// Number of values in result plus 1 so that empty results count
+	size int
+}
+
+// responseCacheType is a size bounded LRU cache of the responses of the
+// influx, OpenTSDB, prometheus, and graphite backends for time buckets
+// fully in the past. nil means no caching.
+type responseCacheType struct {
+	bucket    time.Duration
+	minAge    time.Duration
+	maxValues int
+	// Guards the rest of the fields
+	lock sync.Mutex
+	size int
+	// Most recently used first
+	entries *list.List
+	byKey   map[cacheKeyType]*list.Element
+}
+
+// newResponseCache returns a new cache configured by spec. If spec is nil,
+// newResponseCache returns nil.
+func newResponseCache(spec *config.Cache) (*responseCacheType, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	if spec.Bucket < 0 || spec.MinAge < 0 || spec.MaxValues < 0 {
+		return nil, errors.New(
+			"Cache bucket, minAge, and maxValues must not be negative")
+	}
+	result := &responseCacheType{
+		bucket:    spec.Bucket,
+		minAge:    spec.MinAge,
+		maxValues: spec.MaxValues,
+		entries:   list.New(),
+		byKey:     make(map[cacheKeyType]*list.Element),
+	}
+	if result.bucket == 0 {
+		result.bucket = kDefaultCacheBucket
+	}
+	if result.minAge == 0 {
+		result.minAge = kDefaultCacheMinAge
+	}
+	if result.maxValues == 0 {
+		result.maxValues = kDefaultCacheMaxValues
+	}
+	return result, nil
+}
+
+// Get returns the cached result for key and true or false if there is none.
+func (c *responseCacheType) Get(key cacheKeyType) (client.Result, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.byKey[key]
+	if !ok {
+		return client.Result{}, false
+	}
+	c.entries.MoveToFront(element)
+	result := element.Value.(*cacheEntryType).result
+	// So that callers can't change what is cached
+	result.Series = append([]models.Row(nil), result.Series...)
+	return result, true
+}
+
+// Put caches result under key evicting the least recently used results
+// as needed to stay within size.
+func (c *responseCacheType) Put(key cacheKeyType, result client.Result) {
+	entry := &cacheEntryType{key: key, result: result, size: 1}
+	for i := range result.Series {
+		// Appending to cached values must not change them.
+		values := result.Series[i].Values
+		result.Series[i].Values = values[:len(values):len(values)]
+		entry.size += len(values)
+	}
+	if entry.size > c.maxValues {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.byKey[key]; ok {
+		c.size -= element.Value.(*cacheEntryType).size
+		c.entries.Remove(element)
+	}
+	c.byKey[key] = c.entries.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.maxValues {
+		oldest := c.entries.Back()
+		evicted := oldest.Value.(*cacheEntryType)
+		c.entries.Remove(oldest)
+		delete(c.byKey, evicted.key)
+		c.size -= evicted.size
+	}
+}
+
+// Len returns the number of cached results.
+func (c *responseCacheType) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries.Len()
+}
+
+// cacheableRange returns the time range of query and the part of it made
+// up of whole buckets that ended at least minAge before now. The end of
+// each range is exclusive. ok is false if query cannot be split into
+// buckets or if it has no such buckets.
+func (c *responseCacheType) cacheableRange(
+	query *influxql.Query, now time.Time) (
+	min, max, start, end time.Time, ok bool) {
+	if len(query.Statements) != 1 {
+		return
+	}
+	stmt, isSelect := query.Statements[0].(*influxql.SelectStatement)
+	if !isSelect || !splitsIntoBuckets(stmt, c.bucket) {
+		return
+	}
+	min, max, err := influxql.TimeRange(stmt.Condition)
+	if err != nil || min.IsZero() || max.IsZero() {
+		return
+	}
+	// TimeRange makes max inclusive.
+	max = max.Add(time.Nanosecond)
+	start = ceilTime(min, c.bucket)
+	end = now.Add(-c.minAge)
+	if max.Before(end) {
+		end = max
+	}
+	end = floorTime(end, c.bucket)
+	ok = start.Before(end)
+	return
+}
+
+// floorTime returns t rounded down to a multiple of d since the epoch.
+// Influx aligns GROUP BY time intervals the same way.
+func floorTime(t time.Time, d time.Duration) time.Time {
+	remainder := t.UnixNano() % int64(d)
+	if remainder < 0 {
+		remainder += int64(d)
+	}
+	return t.Add(-time.Duration(remainder))
+}
+
+// ceilTime returns t rounded up to a multiple of d since the epoch.
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	result := floorTime(t, d)
+	if result.Before(t) {
+		result = result.Add(d)
+	}
+	return result
+}
+
+// splitsIntoBuckets returns true if querying each time bucket of given
+// size separately and merging the results gives the same answer as
+// querying all the buckets at once.
+func splitsIntoBuckets(
+	stmt *influxql.SelectStatement, bucket time.Duration) bool {
+	if stmt.Target != nil || !stmt.TimeAscending() {
+		return false
+	}
+	if stmt.Limit != 0 || stmt.Offset != 0 ||
+		stmt.SLimit != 0 || stmt.SOffset != 0 {
+		return false
+	}
+	// Filled values depend on values in earlier buckets.
+	if stmt.Fill == influxql.PreviousFill || stmt.Fill == influxql.LinearFill {
+		return false
+	}
+	interval, err := stmt.GroupByInterval()
+	if err != nil {
+		return false
+	}
+	if interval == 0 {
+		return stmt.IsRawQuery
+	}
+	offset, err := stmt.GroupByOffset()
+	return err == nil && offset == 0 && bucket%interval == 0
+}
+
+// splitByBucket splits result, which must be for times starting at start,
+// into results for consecutive buckets of given size. The values in
+// result must have times in the units of epoch. splitByBucket returns
+// false if it cannot tell the time of a value.
+func splitByBucket(
+	result client.Result,
+	start time.Time,
+	bucket time.Duration,
+	count int,
+	epoch string) ([]client.Result, bool) {
+	unit := epochUnit(epoch)
+	results := make([]client.Result, count)
+	for _, row := range result.Series {
+		valuesByBucket := make([][][]interface{}, count)
+		for _, values := range row.Values {
+			t, ok := timeOf(values)
+			if !ok {
+				return nil, false
+			}
+			if unit != 0 {
+				t *= int64(unit)
+			}
+			i := int((t - start.UnixNano()) / int64(bucket))
+			if i < 0 || i >= count {
+				return nil, false
+			}
+			valuesByBucket[i] = append(valuesByBucket[i], values)
+		}
+		for i := range valuesByBucket {
+			if len(valuesByBucket[i]) == 0 {
+				continue
+			}
+			piece := row
+			piece.Values = valuesByBucket[i]
+			results[i].Series = append(results[i].Series, piece)
+		}
+	}
+	return results, true
+}
+
+// endpoint returns the endpoint for querying chain as of now. The
+// endpoint uses this cache if this cache is non-nil.
+func (c *responseCacheType) endpoint(
+	chain influxChainType, now time.Time) queryerType {
+	if c == nil {
+		return chain
+	}
+	return &cachedChainType{chain: chain, cache: c, now: now}
+}
+
+// cachedChainType queries a chain of backends using a cache for time
+// buckets fully in the past. Only responses from the first backend in the
+// chain get cached.
+type cachedChainType struct {
+	chain influxChainType
+	cache *responseCacheType
+	now   time.Time
+}
+
+func (c *cachedChainType) String() string {
+	return c.chain.String()
+}
+
+// fetchType is a time range that a cachedChainType must fetch from its
+// chain.
+type fetchType struct {
+	query *influxql.Query
+	// The start of the time range
+	start time.Time
+	// The buckets in the time range to cache. Empty if none.
+	keys     []cacheKeyType
+	response *client.Response
+	primary  bool
+	err      error
+}
+
+func (c *cachedChainType) Query(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	min, max, start, end, ok := c.cache.cacheableRange(query, c.now)
+	if !ok {
+		return c.chain.Query(ctx, query, epoch, logger)
+	}
+	var cached []*client.Response
+	var fetches []*fetchType
+	addFetch := func(min, max time.Time, keys []cacheKeyType) error {
+		fetchQuery, err := qlutils.QuerySetTimeRange(query, min, max)
+		if err != nil {
+			return err
+		}
+		if fetchQuery != nil {
+			fetches = append(fetches, &fetchType{
+				query: fetchQuery, start: min, keys: keys})
+		}
+		return nil
+	}
+	// The head and tail are not whole buckets or are too recent to cache.
+	if err := addFetch(min, start, nil); err != nil {
+		return nil, err
+	}
+	if err := addFetch(end, max, nil); err != nil {
+		return nil, err
+	}
+	// Fetch each run of missing buckets with a single query.
+	var runStart time.Time
+	var runKeys []cacheKeyType
+	for bucketStart := start; bucketStart.Before(end); {
+		bucketEnd := bucketStart.Add(c.cache.bucket)
+		bucketQuery, err := qlutils.QuerySetTimeRange(
+			query, bucketStart, bucketEnd)
+		if err != nil {
+			return nil, err
+		}
+		key := cacheKeyType{
+			tier:      c.chain[0],
+			epoch:     epoch,
+			statement: bucketQuery.String(),
+			bucket:    bucketStart.UnixNano(),
+		}
+		if result, ok := c.cache.Get(key); ok {
+			if len(runKeys) != 0 {
+				if err := addFetch(runStart, bucketStart, runKeys); err != nil {
+					return nil, err
+				}
+				runKeys = nil
+			}
+			cached = append(
+				cached, &client.Response{Results: []client.Result{result}})
+		} else {
+			if len(runKeys) == 0 {
+				runStart = bucketStart
+			}
+			runKeys = append(runKeys, key)
+		}
+		bucketStart = bucketEnd
+	}
+	if len(runKeys) != 0 {
+		if err := addFetch(runStart, end, runKeys); err != nil {
+			return nil, err
+		}
+	}
+	var wg sync.WaitGroup
+	for _, fetch := range fetches {
+		wg.Add(1)
+		go func(fetch *fetchType) {
+			fetch.response, fetch.primary, fetch.err = c.chain.query(
+				ctx, fetch.query, epoch, logger)
+			wg.Done()
+		}(fetch)
+	}
+	wg.Wait()
+	toMerge := cached
+	for _, fetch := range fetches {
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+		if fetch.response.Error() != nil {
+			return fetch.response, nil
+		}
+		toMerge = append(toMerge, fetch.response)
+		if len(fetch.keys) != 0 && fetch.primary {
+			c.put(fetch, epoch)
+		}
+	}
+	return responses.Merge(toMerge...)
+}
+
+// put caches the response of fetch by bucket.
+func (c *cachedChainType) put(fetch *fetchType, epoch string) {
+	var result client.Result
+	switch len(fetch.response.Results) {
+	case 0:
+	case 1:
+		result = fetch.response.Results[0]
+	default:
+		return
+	}
+	results, ok := splitByBucket(
+		result, fetch.start, c.cache.bucket, len(fetch.keys), epoch)
+	if !ok {
+		return
+	}
+	for i := range results {
+		c.cache.Put(fetch.keys[i], results[i])
+	}
+}
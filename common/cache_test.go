@@ -0,0 +1,166 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSeriesQueryerType is a fake backend with a single series. It
+// answers each query with the points in the time range of the query.
+type fakeSeriesQueryerType struct {
+	// Times of the points in nanoseconds
+	times []int64
+	// Guards queries
+	lock    sync.Mutex
+	queries int
+}
+
+func (f *fakeSeriesQueryerType) Query(
+	ctx context.Context, queryStr, database, epoch string) (
+	*client.Response, error) {
+	f.lock.Lock()
+	f.queries++
+	f.lock.Unlock()
+	query, err := influxql.ParseQuery(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	min, max, err := influxql.TimeRange(
+		query.Statements[0].(*influxql.SelectStatement).Condition)
+	if err != nil {
+		return nil, err
+	}
+	return f.between(min, max.Add(time.Nanosecond)), nil
+}
+
+// between returns the response for the points from min up to but not
+// including max.
+func (f *fakeSeriesQueryerType) between(min, max time.Time) *client.Response {
+	var values [][]interface{}
+	for _, t := range f.times {
+		if t >= min.UnixNano() && t < max.UnixNano() {
+			values = append(values, []interface{}{
+				json.Number(strconv.FormatInt(t, 10)), json.Number("1"),
+			})
+		}
+	}
+	var result client.Result
+	if len(values) != 0 {
+		result.Series = []models.Row{
+			{Name: "dual", Columns: kTimeValueColumns, Values: values},
+		}
+	}
+	return &client.Response{Results: []client.Result{result}}
+}
+
+// Queries returns the number of queries so far.
+func (f *fakeSeriesQueryerType) Queries() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.queries
+}
+
+func (f *fakeSeriesQueryerType) Close() error {
+	return nil
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)
+	fake := &fakeSeriesQueryerType{}
+	for t := now.Add(-12 * time.Hour); t.Before(now); t = t.Add(30 * time.Minute) {
+		fake.times = append(fake.times, t.UnixNano())
+	}
+	db, err := newDatabaseForTesting(
+		config.Database{
+			Name: "cached",
+			Influxes: config.InfluxList{
+				{HostAndPort: "alpha", Database: "a", Duration: 24 * time.Hour},
+			},
+			Cache: &config.Cache{Bucket: time.Hour, MinAge: time.Hour},
+		},
+		func(kind string, conn config.Connection, template string) (
+			dbQueryerType, error) {
+			return fake, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	Convey("Given a database with a cache", t, func() {
+		query, err := qlutils.NewQuery(
+			"select value from dual where time >= now() - 6h", now)
+		So(err, ShouldBeNil)
+		before := fake.Queries()
+		response, err := db.Query(context.Background(), query, "ns", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, fake.between(now.Add(-6*time.Hour), now))
+
+		Convey("Old buckets should be cached", func() {
+			// One query for the missing buckets and one for the last hour
+			So(fake.Queries()-before, ShouldEqual, 2)
+			So(db.influxes.cache.Len(), ShouldEqual, 5)
+		})
+
+		Convey("Repeating the query should fetch only the recent tail", func() {
+			before := fake.Queries()
+			response, err := db.Query(
+				context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, fake.between(now.Add(-6*time.Hour), now))
+			So(fake.Queries()-before, ShouldEqual, 1)
+		})
+
+		Convey("Later queries should stitch new data onto cached data", func() {
+			later := now.Add(90 * time.Minute)
+			query, err := qlutils.NewQuery(
+				"select value from dual where time >= now() - 6h", later)
+			So(err, ShouldBeNil)
+			before := fake.Queries()
+			response, err := db.Query(
+				context.Background(), query, "ns", later, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, fake.between(later.Add(-6*time.Hour), later))
+			// The head, the newly old bucket, and the tail
+			So(fake.Queries()-before, ShouldEqual, 3)
+		})
+
+		Convey("Intervals that don't divide the bucket should bypass the cache", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from dual where time >= now() - 6h group by time(7m)", now)
+			So(err, ShouldBeNil)
+			before, cached := fake.Queries(), db.influxes.cache.Len()
+			_, err = db.Query(context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(fake.Queries()-before, ShouldEqual, 1)
+			So(db.influxes.cache.Len(), ShouldEqual, cached)
+		})
+	})
+
+	Convey("The cache should evict least recently used results", t, func() {
+		cache, err := newResponseCache(&config.Cache{MaxValues: 6})
+		So(err, ShouldBeNil)
+		keys := []cacheKeyType{{bucket: 1}, {bucket: 2}, {bucket: 3}}
+		cache.Put(keys[0], newResponse(1000, 10).Results[0])
+		cache.Put(keys[1], newResponse(2000, 20).Results[0])
+		_, ok := cache.Get(keys[0])
+		So(ok, ShouldBeTrue)
+		cache.Put(keys[2], newResponse(3000, 30, 3100, 31).Results[0])
+		_, ok = cache.Get(keys[1])
+		So(ok, ShouldBeFalse)
+		result, ok := cache.Get(keys[0])
+		So(ok, ShouldBeTrue)
+		So(result, ShouldResemble, newResponse(1000, 10).Results[0])
+		So(cache.Len(), ShouldEqual, 2)
+	})
+}
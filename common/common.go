@@ -1,6 +1,11 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Symantec/Dominator/lib/log"
@@ -9,8 +14,13 @@ import (
 	"github.com/Symantec/scotty/influx/responses"
 	"github.com/influxdata/influxdb/client/v2"
 	"github.com/influxdata/influxdb/influxql"
-	"github.com/influxdata/influxdb/models"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -30,43 +40,294 @@ func (l *lastErrorType) Error() error {
 }
 
 type queryerType interface {
-	Query(q *influxql.Query, epoch string, l log.Logger) (
-		*client.Response, error)
+	Query(
+		ctx context.Context,
+		q *influxql.Query,
+		epoch string,
+		l log.Logger) (*client.Response, error)
 }
 
 // dbQueryerType represents a concrete server. Either a scotty or an influx db.
 // This interface exists to enable testing.
 type dbQueryerType interface {
-	Query(queryStr, database, epoch string) (*client.Response, error)
+	Query(ctx context.Context, queryStr, database, epoch string) (
+		*client.Response, error)
 	Close() error
 }
 
-// Real implementation of dbQueryerType
+// httpEndpointType sends requests to a backend over http.
+type httpEndpointType struct {
+	url        url.URL
+	username   string
+	password   string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+// Do sends a request to path on this endpoint with the given parameters.
+// If body is non-nil, Do sends a POST with body as JSON; otherwise Do sends
+// method with no body. Cancelling ctx aborts the request.
+func (e *httpEndpointType) Do(
+	ctx context.Context,
+	method, path string,
+	params url.Values,
+	body interface{}) (*http.Response, error) {
+	u := e.url
+	u.Path = path
+	u.RawQuery = params.Encode()
+	var bodyReader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		bodyReader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, u.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if e.username != "" {
+		req.SetBasicAuth(e.username, e.password)
+	}
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	return e.httpClient.Do(req.WithContext(ctx))
+}
+
+func (e *httpEndpointType) Close() error {
+	if transport, ok := e.httpClient.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// statusError is an error from a backend that answered with an http
+// status code other than 200.
+type statusError struct {
+	statusCode int
+	message    string
+}
+
+// statusErrorf returns a statusError for statusCode with a message
+// formatted like fmt.Sprintf.
+func statusErrorf(
+	statusCode int, format string, args ...interface{}) error {
+	return &statusError{
+		statusCode: statusCode,
+		message:    fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// Real implementation of dbQueryerType. We talk to influx directly over
+// http rather than using the influx client because the influx client
+// cannot cancel a query in progress.
 type influxQueryerType struct {
-	cl client.Client
+	*httpEndpointType
 }
 
-func (q *influxQueryerType) Query(queryStr, database, epoch string) (
+func (q *influxQueryerType) Query(
+	ctx context.Context, queryStr, database, epoch string) (
 	*client.Response, error) {
-	aQuery := client.NewQuery(queryStr, database, epoch)
-	return q.cl.Query(aQuery)
+	params := url.Values{}
+	params.Set("q", queryStr)
+	params.Set("db", database)
+	if epoch != "" {
+		params.Set("epoch", epoch)
+	}
+	resp, err := q.Do(ctx, "POST", "query", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var response client.Response
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	decodeErr := decoder.Decode(&response)
+	// An empty body is fine if we got a bad status code
+	if decodeErr != nil && decodeErr.Error() == "EOF" && resp.StatusCode != http.StatusOK {
+		decodeErr = nil
+	}
+	if decodeErr != nil {
+		return nil, statusErrorf(
+			resp.StatusCode,
+			"unable to decode json: received status code %d err: %s",
+			resp.StatusCode, decodeErr)
+	}
+	if resp.StatusCode != http.StatusOK && response.Error() == nil {
+		return &response, statusErrorf(
+			resp.StatusCode,
+			"received status code %d from server", resp.StatusCode)
+	}
+	return &response, nil
 }
 
-func (q *influxQueryerType) Close() error {
-	return q.cl.Close()
-}
+// Kinds of backends. Each kind speaks a different protocol.
+const (
+	// influx and scotty
+	kInflux     = "influx"
+	kOpenTSDB   = "openTSDB"
+	kPrometheus = "prometheus"
+	kGraphite   = "graphite"
+)
+
+const (
+	// The database to use for scotty if none configured.
+	kScottyDatabase = "scotty"
+)
+
+const (
+	// How often proxima rediscovers the durations of influx backends
+	kDurationRefresh = 5 * time.Minute
+	// How long proxima waits for influx backends to report their
+	// durations so that a hung backend can't hold up discovery
+	kDurationTimeout = 10 * time.Second
+	// Duration of influx retention policies that keep data forever
+	kInfiniteDuration = time.Duration(math.MaxInt64)
+)
 
 // Type is here for testing. Tests have a function that creates a mock
-// dbQueryerType.
-type dbQueryerCreaterType func(addr string) (dbQueryerType, error)
+// dbQueryerType. kind is the kind of backend e.g kInflux. template is the
+// graphite template for graphite backends and is empty for all others.
+type dbQueryerCreaterType func(
+	kind string, conn config.Connection, template string) (
+	dbQueryerType, error)
 
-// Creates a *real* dbQueryerType given a host and port
-func influxCreateDbQueryer(addr string) (dbQueryerType, error) {
-	cl, err := client.NewHTTPClient(client.HTTPConfig{Addr: addr})
+// readSecret returns the contents of fileName without the trailing newline.
+func readSecret(fileName string) (string, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// secretFromConfig returns the secret which is either secret itself or
+// the contents of fileName. kind is used for error messages.
+func secretFromConfig(secret, fileName, kind string) (string, error) {
+	if secret != "" && fileName != "" {
+		return "", fmt.Errorf("Only one of %s and %sFile may be specified", kind, kind)
+	}
+	if fileName != "" {
+		return readSecret(fileName)
+	}
+	return secret, nil
+}
+
+// newTLSConfig returns the TLS configuration for connecting to a server.
+// newTLSConfig returns nil if tlsSpec is nil.
+func newTLSConfig(tlsSpec *config.TLS) (*tls.Config, error) {
+	if tlsSpec == nil {
+		return nil, nil
+	}
+	result := &tls.Config{InsecureSkipVerify: tlsSpec.InsecureSkipVerify}
+	if tlsSpec.CAFile != "" {
+		pem, err := ioutil.ReadFile(tlsSpec.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", tlsSpec.CAFile)
+		}
+	}
+	if tlsSpec.CertFile != "" || tlsSpec.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsSpec.CertFile, tlsSpec.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return result, nil
+}
+
+// newHTTPEndpoint returns the endpoint for connecting to a server over
+// http. Secrets in files are read once when the endpoint is created.
+func newHTTPEndpoint(conn config.Connection) (*httpEndpointType, error) {
+	u, err := url.Parse(conn.HostAndPort)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf(
+			"Unsupported protocol scheme: %s, your address must start with http:// or https://", u.Scheme)
+	}
+	password, err := secretFromConfig(
+		conn.Password, conn.PasswordFile, "password")
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string)
+	for name, value := range conn.Headers {
+		headers[name] = value
+	}
+	for name, fileName := range conn.HeaderFiles {
+		if _, ok := headers[name]; ok {
+			return nil, fmt.Errorf("Header %s specified twice", name)
+		}
+		if headers[name], err = readSecret(fileName); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := newTLSConfig(conn.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return &httpEndpointType{
+		url:      *u,
+		username: conn.Username,
+		password: password,
+		headers:  headers,
+		httpClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// Creates a *real* dbQueryerType for an influx or scotty server given how
+// to connect to the server.
+func influxCreateDbQueryer(conn config.Connection) (dbQueryerType, error) {
+	endpoint, err := newHTTPEndpoint(conn)
 	if err != nil {
 		return nil, err
 	}
-	return &influxQueryerType{cl: cl}, nil
+	return &influxQueryerType{httpEndpointType: endpoint}, nil
+}
+
+// createDbQueryer creates a *real* dbQueryerType for the given kind of
+// backend.
+func createDbQueryer(kind string, conn config.Connection, template string) (
+	dbQueryerType, error) {
+	switch kind {
+	case kInflux:
+		return influxCreateDbQueryer(conn)
+	case kOpenTSDB:
+		return openTSDBCreateDbQueryer(conn)
+	case kPrometheus:
+		return prometheusCreateDbQueryer(conn)
+	case kGraphite:
+		return graphiteCreateDbQueryer(conn, template)
+	}
+	return nil, fmt.Errorf("Unknown backend kind: %s", kind)
+}
+
+// withTimeout returns ctx with the given timeout applied. If timeout is 0,
+// withTimeout returns a cancelable ctx with no timeout. Caller must call
+// the returned cancel function when done.
+func withTimeout(ctx context.Context, timeout time.Duration) (
+	context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 // getRawConcurrentResponses does multiple querying concurrently.
@@ -74,6 +335,7 @@ func influxCreateDbQueryer(addr string) (dbQueryerType, error) {
 // correspond to elements in endpoints 1 for 1.  The returned responseList
 // and errs are the same length as endpoints and queries.
 func getRawConcurrentResponses(
+	ctx context.Context,
 	endpoints []queryerType,
 	queries []*influxql.Query,
 	epoch string,
@@ -99,7 +361,7 @@ func getRawConcurrentResponses(
 			query *influxql.Query,
 			responseHere **client.Response,
 			errHere *error) {
-			*responseHere, *errHere = n.Query(query, epoch, logger)
+			*responseHere, *errHere = n.Query(ctx, query, epoch, logger)
 			wg.Done()
 		}(endpoints[i],
 			query,
@@ -115,12 +377,13 @@ func getRawConcurrentResponses(
 // queries and endpoints must be of the same length. Each element in queries
 // should be the same with the exception of the time range.
 func getConcurrentResponses(
+	ctx context.Context,
 	endpoints []queryerType,
 	queries []*influxql.Query,
 	epoch string,
 	logger log.Logger) (*client.Response, error) {
 	responseList, errs := getRawConcurrentResponses(
-		endpoints, queries, epoch, logger)
+		ctx, endpoints, queries, epoch, logger)
 
 	// These will be the responses from influx servers that we merge
 	var responsesToMerge []*client.Response
@@ -129,6 +392,12 @@ func getConcurrentResponses(
 	// back to client
 	var lastErrorEncountered error
 
+	// The errors of the endpoints left out if others respond
+	var failures []error
+
+	// True if an endpoint can't translate its query
+	var unsupported bool
+
 	for i := range queries {
 		if queries[i] == nil {
 			continue
@@ -140,51 +409,374 @@ func getConcurrentResponses(
 		}
 		if err == nil {
 			responsesToMerge = append(responsesToMerge, response)
+		} else if isUnsupported(err) {
+			unsupported = true
 		} else {
-			if logger != nil {
-				logger.Println(err)
-			}
+			logError(logger, err)
 			lastErrorEncountered = err
+			failures = append(failures, &backendError{
+				backend: backendName(endpoints[i]),
+				query:   queries[i],
+				err:     err,
+			})
 		}
 	}
 	// errors but no viable responses
 	if len(responsesToMerge) == 0 && lastErrorEncountered != nil {
 		return nil, lastErrorEncountered
 	}
+	if len(responsesToMerge) == 0 && unsupported {
+		return nil, qlutils.ErrUnsupported
+	}
+	for _, failure := range failures {
+		recordFailure(ctx, failure)
+	}
 	return responses.Merge(responsesToMerge...)
 }
 
 func newInfluxForTesting(
 	influx config.Influx, creater dbQueryerCreaterType) (*Influx, error) {
-	dbQueryer, err := creater(influx.HostAndPort)
+	dbQueryer, err := creater(kInflux, influx.Connection(), "")
 	if err != nil {
 		return nil, err
 	}
-	return &Influx{data: influx, dbQueryer: dbQueryer}, nil
+	return &Influx{
+		data:      influx,
+		kind:      kInflux,
+		dbQueryer: dbQueryer,
+		names:     newNames(influx),
+		discover:  influx.Duration == 0,
+	}, nil
+}
+
+func (d *Influx) String() string {
+	return d.kind + " " + d.data.HostAndPort
+}
+
+func (d *Influx) query(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	query, err := withResolution(query, d.data.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	query, originals, err := d.names.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, d.data.Timeout)
+	defer cancel()
+	response, err := d.dbQueryer.Query(
+		ctx, query.String(), d.data.Database, epoch)
+	if err != nil {
+		return nil, err
+	}
+	restoreNames(response, originals)
+	return response, nil
 }
 
 func newInfluxListForTesting(
 	influxes config.InfluxList, creater dbQueryerCreaterType) (
 	*InfluxList, error) {
-	if len(influxes) == 0 {
+	return newTiersForTesting(config.Database{Influxes: influxes}, creater)
+}
+
+// newTierForTesting returns a backend that speaks something other than
+// influxql as an Influx so that it can take part in splitting queries by
+// time.
+func newTierForTesting(
+	kind string,
+	conn config.Connection,
+	template string,
+	duration, timeout time.Duration,
+	creater dbQueryerCreaterType) (*Influx, error) {
+	dbQueryer, err := creater(kind, conn, template)
+	if err != nil {
+		return nil, err
+	}
+	return &Influx{
+		data: config.Influx{
+			HostAndPort: conn.HostAndPort,
+			Duration:    duration,
+			Timeout:     timeout,
+		},
+		kind:      kind,
+		dbQueryer: dbQueryer,
+	}, nil
+}
+
+type byDurationDescType []*Influx
+
+func (b byDurationDescType) Len() int {
+	return len(b)
+}
+
+func (b byDurationDescType) Less(i, j int) bool {
+	return b[i].duration() > b[j].duration()
+}
+
+func (b byDurationDescType) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// newTiersForTesting returns the influx, OpenTSDB, prometheus, and graphite
+// backends of db as a single InfluxList so that they all take part in
+// splitting queries by time. Backends are ordered by duration in descending
+// order. If db has none of these backends, newTiersForTesting returns nil.
+func newTiersForTesting(
+	db config.Database, creater dbQueryerCreaterType) (
+	*InfluxList, error) {
+	var disjoint bool
+	switch db.SplitMode {
+	case "", config.SplitOverlap:
+	case config.SplitDisjoint:
+		disjoint = true
+	default:
+		return nil, fmt.Errorf("Unknown split mode: %s", db.SplitMode)
+	}
+	if len(db.Influxes)+len(db.OpenTSDBs)+len(db.Prometheuses)+
+		len(db.Graphites) == 0 {
 		return nil, nil
 	}
-	influxes = influxes.Order()
-	result := &InfluxList{instances: make([]*Influx, len(influxes))}
-	for i := range influxes {
+	cache, err := newResponseCache(db.Cache)
+	if err != nil {
+		return nil, err
+	}
+	result := &InfluxList{
+		influxes: make([]*Influx, len(db.Influxes)),
+		disjoint: disjoint,
+		cache:    cache,
+	}
+	for i := range db.Influxes {
 		var err error
-		result.instances[i], err = newInfluxForTesting(influxes[i], creater)
+		result.influxes[i], err = newInfluxForTesting(db.Influxes[i], creater)
+		if err != nil {
+			return nil, err
+		}
+	}
+	instances := make([]*Influx, len(result.influxes))
+	copy(instances, result.influxes)
+	for _, openTSDB := range db.OpenTSDBs {
+		instance, err := newTierForTesting(
+			kOpenTSDB,
+			openTSDB.Connection(),
+			"",
+			openTSDB.Duration,
+			openTSDB.Timeout,
+			creater)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	for _, prometheus := range db.Prometheuses {
+		instance, err := newTierForTesting(
+			kPrometheus,
+			prometheus.Connection(),
+			"",
+			prometheus.Duration,
+			prometheus.Timeout,
+			creater)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	for _, graphite := range db.Graphites {
+		instance, err := newTierForTesting(
+			kGraphite,
+			graphite.Connection(),
+			graphite.Template,
+			graphite.Duration,
+			graphite.Timeout,
+			creater)
 		if err != nil {
 			return nil, err
 		}
+		instances = append(instances, instance)
 	}
+	result.instances = instances
+	result.start()
 	return result, nil
 }
 
+// start orders the backends by duration and, if there are durations to
+// discover, discovers them in the background and keeps them fresh until
+// Close is called. start doesn't wait for discovery, so the influxes of
+// every database discover their durations at the same time.
+func (l *InfluxList) start() {
+	sort.Stable(byDurationDescType(l.instances))
+	for _, instance := range l.influxes {
+		if instance.discover {
+			l.done = make(chan struct{})
+			l.discovered = make(chan struct{})
+			l.stopped = make(chan struct{})
+			go l.refreshDurationsLoop()
+			return
+		}
+	}
+}
+
+func (l *InfluxList) refreshDurationsLoop() {
+	defer close(l.stopped)
+	// Closing stops any discovery under way.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	l.refreshDurationsWithTimeout(ctx)
+	close(l.discovered)
+	ticker := time.NewTicker(kDurationRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.refreshDurationsWithTimeout(ctx)
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *InfluxList) refreshDurationsWithTimeout(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, kDurationTimeout)
+	defer cancel()
+	l.refreshDurations(ctx)
+}
+
+// refreshDurations discovers the durations of the influx backends that
+// have none configured and orders the backends by duration in descending
+// order. refreshDurations asks the backends concurrently. An influx
+// backend that fails to respond keeps the duration it had before; until
+// proxima discovers its duration, it gets queries for all times as if it
+// kept data forever.
+func (l *InfluxList) refreshDurations(ctx context.Context) {
+	durations := make([]time.Duration, len(l.influxes))
+	errs := make([]error, len(l.influxes))
+	var wg sync.WaitGroup
+	for i, instance := range l.influxes {
+		if !instance.discover {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, instance *Influx) {
+			durations[i], errs[i] = instance.discoverDuration(ctx)
+			wg.Done()
+		}(i, instance)
+	}
+	wg.Wait()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, instance := range l.influxes {
+		if instance.discover && errs[i] == nil {
+			instance.data.Duration = durations[i]
+		}
+	}
+	sort.Stable(byDurationDescType(l.instances))
+}
+
+// duration returns the duration of the ith influx backend in config order.
+func (l *InfluxList) duration(i int) time.Duration {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.influxes[i].data.Duration
+}
+
+// duration returns how far back the data in this backend goes. An influx
+// backend whose duration proxima has yet to discover might have any
+// data, so duration returns kInfiniteDuration for it.
+func (d *Influx) duration() time.Duration {
+	if d.discover && d.data.Duration == 0 {
+		return kInfiniteDuration
+	}
+	return d.data.Duration
+}
+
+// discoverDuration asks this influx backend for the duration of its
+// retention policy.
+func (d *Influx) discoverDuration(ctx context.Context) (
+	time.Duration, error) {
+	ctx, cancel := withTimeout(ctx, d.data.Timeout)
+	defer cancel()
+	response, err := d.dbQueryer.Query(
+		ctx,
+		"SHOW RETENTION POLICIES ON "+influxql.QuoteIdent(d.data.Database),
+		d.data.Database,
+		"")
+	if err != nil {
+		return 0, err
+	}
+	if err := response.Error(); err != nil {
+		return 0, err
+	}
+	return retentionPolicyDuration(response, d.data.RetentionPolicy)
+}
+
+// retentionPolicyDuration returns the duration of the retention policy
+// called name in response, the response to SHOW RETENTION POLICIES. If name
+// is empty, retentionPolicyDuration returns the duration of the default
+// retention policy.
+func retentionPolicyDuration(
+	response *client.Response, name string) (time.Duration, error) {
+	for _, result := range response.Results {
+		for _, row := range result.Series {
+			nameIdx, durationIdx, defaultIdx := -1, -1, -1
+			for i, column := range row.Columns {
+				switch column {
+				case "name":
+					nameIdx = i
+				case "duration":
+					durationIdx = i
+				case "default":
+					defaultIdx = i
+				}
+			}
+			if nameIdx == -1 || durationIdx == -1 || defaultIdx == -1 {
+				continue
+			}
+			for _, value := range row.Values {
+				if name != "" && value[nameIdx] != name {
+					continue
+				}
+				if name == "" && value[defaultIdx] != true {
+					continue
+				}
+				durationStr, _ := value[durationIdx].(string)
+				duration, err := time.ParseDuration(durationStr)
+				if err != nil {
+					return 0, err
+				}
+				// 0 means keep data forever
+				if duration == 0 {
+					return kInfiniteDuration, nil
+				}
+				return duration, nil
+			}
+		}
+	}
+	if name == "" {
+		return 0, errors.New("No default retention policy")
+	}
+	return 0, fmt.Errorf("No retention policy %s", name)
+}
+
 func (l *InfluxList) _close() error {
 	if l == nil {
 		return nil
 	}
+	if l.done != nil {
+		close(l.done)
+		<-l.stopped
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
 	var lastError lastErrorType
 	for _, d := range l.instances {
 		lastError.Add(d.Close())
@@ -193,92 +785,314 @@ func (l *InfluxList) _close() error {
 }
 
 // splitQuery takes a query and splits it up by time range according to the
-// retention policy of each influx server in this instance. The returned
-// slice is the same length as the number of influx servers in this instance.
+// retention policy of each influx server in this instance. splitQuery also
+// returns the backends to try in order for each split. The returned slices
+// are the same length as the number of influx servers in this instance.
 func (l *InfluxList) splitQuery(
 	query *influxql.Query, now time.Time) (
 	splitQueries []*influxql.Query,
+	chains []influxChainType,
 	err error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
 	if len(l.instances) == 0 {
 		return
 	}
-	result := make([]*influxql.Query, len(l.instances))
-	for i := range result {
-		min := l.minTime(i, now)
-		// Query up to the present for each backend. This way if
-		// an influx instance with finer grained data goes down,
-		// proxima can use an influx instance with courser grained
-		// data to fill in the missing times.
-		result[i], err = qlutils.QuerySetTimeRange(query, min, now)
+	splitQueries = make([]*influxql.Query, len(l.instances))
+	chains = make([]influxChainType, len(l.instances))
+	end := queryEnd(query, now)
+	interval, offset := groupByTime(query)
+	for i := range splitQueries {
+		min, max := l.timeRange(i, now, end, interval, offset)
+		splitQueries[i], err = qlutils.QuerySetTimeRange(query, min, max)
 		if err != nil {
-			return
+			return nil, nil, err
 		}
+		chains[i] = l.fallbacks(i)
 	}
-	return result, nil
+	return
 }
 
 func (l *InfluxList) minTime(i int, now time.Time) time.Time {
-	return now.Add(-l.instances[i].data.Duration)
+	return now.Add(-l.instances[i].duration())
+}
+
+// timeRange returns the time range to query for the ith backend. The end
+// of the range is exclusive. end is when the time range of the query ends
+// which is no earlier than now. When disjoint, the boundaries between
+// backends snap up to multiples of interval plus offset so that each
+// GROUP BY time interval comes from just one backend. An interval of 0
+// means no snapping.
+func (l *InfluxList) timeRange(
+	i int, now, end time.Time, interval, offset time.Duration) (
+	min, max time.Time) {
+	min = l.minTime(i, now)
+	// Unless disjoint, query up to the present for each backend. This
+	// way if an influx instance with finer grained data goes down,
+	// proxima can use an influx instance with courser grained data to
+	// fill in the missing times.
+	max = end
+	if !l.disjoint {
+		return
+	}
+	// The backends with the longest duration have nothing before them
+	// to take over the start of a straddling interval.
+	if l.instances[i].duration() < l.instances[0].duration() {
+		min = snapUp(min, interval, offset)
+	}
+	// Backends with the same duration have the same data, so stop where
+	// the next backend with a shorter duration begins.
+	for j := i + 1; j < len(l.instances); j++ {
+		if l.instances[j].duration() < l.instances[i].duration() {
+			max = snapUp(l.minTime(j, now), interval, offset)
+			return
+		}
+	}
+	return
+}
+
+// snapUp returns t rounded up to a multiple of interval plus offset the
+// way influx aligns GROUP BY time intervals. If interval is 0, snapUp
+// returns t.
+func snapUp(t time.Time, interval, offset time.Duration) time.Time {
+	if interval == 0 {
+		return t
+	}
+	return ceilTime(t.Add(-offset), interval).Add(offset)
+}
+
+// groupByTime returns the GROUP BY time interval and offset that all the
+// select statements in query share. groupByTime returns 0 for the
+// interval if they don't share one.
+func groupByTime(query *influxql.Query) (interval, offset time.Duration) {
+	first := true
+	for _, stmt := range query.Statements {
+		selectStmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			continue
+		}
+		stmtInterval, err := selectStmt.GroupByInterval()
+		if err != nil || stmtInterval == 0 {
+			return 0, 0
+		}
+		stmtOffset, err := selectStmt.GroupByOffset()
+		if err != nil {
+			return 0, 0
+		}
+		if !first && (stmtInterval != interval || stmtOffset != offset) {
+			return 0, 0
+		}
+		interval, offset, first = stmtInterval, stmtOffset, false
+	}
+	return
+}
+
+// fallbacks returns the backends to try in order for the time range of
+// the ith backend. When disjoint, these are the ith backend followed by
+// the backends with coarser grained data nearest first since they are
+// the only other backends with data for that time range.
+func (l *InfluxList) fallbacks(i int) influxChainType {
+	result := influxChainType{l.instances[i]}
+	if !l.disjoint {
+		return result
+	}
+	for j := i - 1; j >= 0; j-- {
+		if l.instances[j].duration() > l.instances[i].duration() {
+			result = append(result, l.instances[j])
+		}
+	}
+	return result
+}
+
+// influxChainType queries the first backend and, if it fails, each of the
+// remaining backends in turn.
+type influxChainType []*Influx
+
+func (c influxChainType) String() string {
+	return c[0].String()
+}
+
+func (c influxChainType) Query(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	response, _, err := c.query(ctx, query, epoch, logger)
+	return response, err
+}
+
+// query works like Query and also returns true if the first backend in
+// this chain answered.
+func (c influxChainType) query(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, bool, error) {
+	var response *client.Response
+	var err error
+	for i, instance := range c {
+		response, err = instance.Query(ctx, query, epoch, logger)
+		if err == nil && response.Error() == nil {
+			return response, i == 0, nil
+		}
+		if i < len(c)-1 {
+			if err != nil {
+				logError(logger, err)
+			} else {
+				logError(logger, response.Error())
+			}
+		}
+	}
+	return response, false, err
 }
 
 func (l *InfluxList) query(
-	query *influxql.Query, epoch string, now time.Time, logger log.Logger) (
-	*client.Response, error) {
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
 	if l == nil {
 		return responses.Merge()
 	}
-	querySplits, err := l.splitQuery(query, now)
+	// SHOW statements don't have time ranges. Only influxes understand
+	// them; the OpenTSDB, prometheus, and graphite tiers don't.
+	if isMetadataQuery(query) {
+		endpoints := make([]queryerType, len(l.influxes))
+		for i := range endpoints {
+			endpoints[i] = l.influxes[i]
+		}
+		return getConcurrentMetadataResponses(
+			ctx, endpoints, query, epoch, logger)
+	}
+	querySplits, chains, err := l.splitQuery(query, now)
 	if err != nil {
 		return nil, err
 	}
-	endpoints := make([]queryerType, len(l.instances))
+	endpoints := make([]queryerType, len(chains))
 	for i := range endpoints {
-		endpoints[i] = l.instances[i]
+		endpoints[i] = l.cache.endpoint(chains[i], now)
 	}
-	return getConcurrentResponses(endpoints, querySplits, epoch, logger)
+	return getConcurrentResponses(
+		ctx, endpoints, querySplits, epoch, logger)
 }
 
 func newScottyForTesting(
 	scotty config.Scotty, creater dbQueryerCreaterType) (*Scotty, error) {
-	if scotty.HostAndPort != "" {
-		dbQueryer, err := creater(scotty.HostAndPort)
-		if err != nil {
-			return nil, err
-		}
-		return &Scotty{dbQueryer: dbQueryer}, nil
+	result := &Scotty{
+		hostAndPort: scotty.HostAndPort,
+		database:    scotty.Database,
+		duration:    scotty.Duration,
+		timeout:     scotty.Timeout,
 	}
-	if len(scotty.Partials) != 0 {
-		partials, err := newScottyPartialsForTesting(scotty.Partials, creater)
-		if err != nil {
-			return nil, err
-		}
-		return &Scotty{partials: partials}, nil
+	if result.database == "" {
+		result.database = kScottyDatabase
 	}
-	if len(scotty.Scotties) != 0 {
-		scotties, err := newScottyListForTesting(scotty.Scotties, creater)
-		if err != nil {
-			return nil, err
-		}
-		return &Scotty{scotties: scotties}, nil
+	var err error
+	switch {
+	case scotty.HostAndPort != "":
+		result.dbQueryer, err = creater(kInflux, scotty.Connection(), "")
+	case len(scotty.Partials) != 0:
+		result.partials, err = newScottyPartialsForTesting(
+			scotty.Partials, scotty.Sharding, scotty.MaxRawPoints, creater)
+	case len(scotty.Scotties) != 0:
+		result.scotties, err = newScottyListForTesting(
+			scotty.Scotties, scotty.Redundancy, creater)
+	default:
+		return nil, errors.New("Scotty must have either hostAndPort, partials, or scotties")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// clip returns query with its time range clipped to the times this scotty
+// has data for. If this scotty has no data for query, clip returns nil.
+func (s *Scotty) clip(query *influxql.Query, now time.Time) (
+	*influxql.Query, error) {
+	if s.duration == 0 || isMetadataQuery(query) {
+		return query, nil
+	}
+	return qlutils.QuerySetTimeRange(
+		query, now.Add(-s.duration), queryEnd(query, now))
+}
+
+func (s *Scotty) String() string {
+	switch {
+	case s.dbQueryer != nil:
+		return "scotty " + s.hostAndPort
+	case s.partials != nil:
+		return "scotty partials"
 	}
-	return nil, errors.New("Scotty must have either hostAndPort, partials, or scotties")
+	return kScotties
 }
 
 func (s *Scotty) query(
-	query *influxql.Query, epoch string, logger log.Logger) (
-	*client.Response, error) {
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	query, err := s.clip(query, now)
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		return responses.Merge()
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
 	switch {
 	case s.dbQueryer != nil:
-		return s.dbQueryer.Query(query.String(), "scotty", epoch)
+		return s.dbQueryer.Query(ctx, query.String(), s.database, epoch)
 	case s.partials != nil:
-		return s.partials.Query(query, epoch, logger)
+		return s.partials.Query(ctx, query, epoch, now, logger)
 	case s.scotties != nil:
-		return s.scotties.Query(query, epoch, logger)
+		return s.scotties.Query(ctx, query, epoch, now, logger)
 	}
 	// Should never get here.
 	panic("query should return something")
 }
 
+// scottyAtType queries a scotty as of a particular time so that the
+// scotty can be a queryerType.
+type scottyAtType struct {
+	scotty *Scotty
+	now    time.Time
+}
+
+func (s scottyAtType) String() string {
+	return s.scotty.String()
+}
+
+func (s scottyAtType) Query(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	return s.scotty.Query(ctx, query, epoch, s.now, logger)
+}
+
+func (s scottyAtType) QueryStreams(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	chunkSize int,
+	logger log.Logger) ([]rowStreamType, error) {
+	return s.scotty.queryStreams(ctx, query, epoch, s.now, chunkSize, logger)
+}
+
+// scottyEndpoints returns scotties as queryerType instances that query
+// as of now.
+func scottyEndpoints(scotties []*Scotty, now time.Time) []queryerType {
+	result := make([]queryerType, len(scotties))
+	for i := range result {
+		result[i] = scottyAtType{scotty: scotties[i], now: now}
+	}
+	return result
+}
+
 func (s *Scotty) _close() error {
 	if s.dbQueryer != nil {
 		return s.dbQueryer.Close()
@@ -293,14 +1107,23 @@ func (s *Scotty) _close() error {
 }
 
 func newScottyPartialsForTesting(
-	scotties config.ScottyList, creater dbQueryerCreaterType) (
-	*ScottyPartials, error) {
+	scotties config.ScottyList,
+	sharding *config.Sharding,
+	maxRawPoints int,
+	creater dbQueryerCreaterType) (*ScottyPartials, error) {
 	if len(scotties) == 0 {
 		panic("Scotty list must be non-empty")
 	}
-	result := &ScottyPartials{instances: make([]*Scotty, len(scotties))}
+	router, err := newShardRouter(sharding, scotties)
+	if err != nil {
+		return nil, err
+	}
+	result := &ScottyPartials{
+		instances:    make([]*Scotty, len(scotties)),
+		router:       router,
+		maxRawPoints: maxRawPoints,
+	}
 	for i := range scotties {
-		var err error
 		result.instances[i], err = newScottyForTesting(scotties[i], creater)
 		if err != nil {
 			return nil, err
@@ -321,26 +1144,67 @@ func (l *ScottyPartials) _close() error {
 }
 
 func (l *ScottyPartials) query(
-	query *influxql.Query, epoch string, logger log.Logger) (
-	*client.Response, error) {
-	endpoints := make([]queryerType, len(l.instances))
-	for i := range endpoints {
-		endpoints[i] = l.instances[i]
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	endpoints := scottyEndpoints(l.instances, now)
+	// Metadata from each partial is just unioned together
+	if isMetadataQuery(query) {
+		return getConcurrentMetadataResponses(
+			ctx, endpoints, query, epoch, logger)
 	}
-	queries := make([]*influxql.Query, len(l.instances))
-	for i := range queries {
-		queries[i] = query
+	if l.router == nil {
+		return aggregateScottyResponses(
+			ctx, endpoints, query, l.maxRawPoints, epoch, logger)
 	}
-	return aggregateScottyResponses(endpoints, query, epoch, logger)
+	// Each statement goes to only the partials that have its data, so
+	// only those partials need to respond.
+	var results []client.Result
+	for _, stmt := range query.Statements {
+		var routed []queryerType
+		for _, i := range l.router.Route(stmt) {
+			routed = append(routed, endpoints[i])
+		}
+		var result client.Result
+		if len(routed) != 0 {
+			var err error
+			result, err = aggregateScottyStmtResponses(
+				ctx, routed, stmt, l.maxRawPoints, epoch, logger)
+			if err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, result)
+	}
+	return &client.Response{Results: results}, nil
 }
 
 func newScottyListForTesting(
-	scotties config.ScottyList, creater dbQueryerCreaterType) (
-	*ScottyList, error) {
+	scotties config.ScottyList,
+	redundancy *config.Redundancy,
+	creater dbQueryerCreaterType) (*ScottyList, error) {
 	if len(scotties) == 0 {
 		return nil, nil
 	}
-	result := &ScottyList{instances: make([]*Scotty, len(scotties))}
+	result := &ScottyList{
+		instances: make([]*Scotty, len(scotties)),
+		strategy:  config.StrategyMergeAll,
+		latencies: make([]time.Duration, len(scotties)),
+	}
+	if redundancy != nil && redundancy.Strategy != "" {
+		result.strategy = redundancy.Strategy
+		result.hedgeDelay = redundancy.HedgeDelay
+	}
+	switch result.strategy {
+	case config.StrategyMergeAll, config.StrategyFirstHealthy,
+		config.StrategyRoundRobin, config.StrategyLeastLatency,
+		config.StrategyHedged:
+	default:
+		return nil, fmt.Errorf(
+			"Unknown scotty strategy: %s", result.strategy)
+	}
 	for i := range scotties {
 		var err error
 		result.instances[i], err = newScottyForTesting(scotties[i], creater)
@@ -363,32 +1227,58 @@ func (l *ScottyList) _close() error {
 }
 
 func (l *ScottyList) query(
-	query *influxql.Query, epoch string, logger log.Logger) (
-	*client.Response, error) {
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
 	if l == nil {
 		return responses.Merge()
 	}
-	endpoints := make([]queryerType, len(l.instances))
-	for i := range endpoints {
-		endpoints[i] = l.instances[i]
+	if !l.mergesAll() {
+		return l.queryOne(ctx, query, epoch, now, logger)
+	}
+	endpoints := scottyEndpoints(l.instances, now)
+	if isMetadataQuery(query) {
+		return getConcurrentMetadataResponses(
+			ctx, endpoints, query, epoch, logger)
 	}
 	queries := make([]*influxql.Query, len(l.instances))
 	for i := range queries {
 		queries[i] = query
 	}
-	return getConcurrentResponses(endpoints, queries, epoch, logger)
+	return getConcurrentResponses(ctx, endpoints, queries, epoch, logger)
 }
 
 func newDatabaseForTesting(
 	db config.Database, creater dbQueryerCreaterType) (*Database, error) {
-	result := &Database{name: db.Name}
+	result := &Database{
+		name:            db.Name,
+		timeout:         db.Timeout,
+		partialFailures: db.PartialFailures,
+		alignTimes:      db.AlignTimes,
+	}
+	switch result.partialFailures {
+	case "":
+		result.partialFailures = config.PartialFailuresIgnore
+	case config.PartialFailuresIgnore, config.PartialFailuresWarn,
+		config.PartialFailuresStrict:
+	default:
+		return nil, fmt.Errorf(
+			"Unknown partial failures mode: %s", result.partialFailures)
+	}
+	creater = withHealthChecks(creater, &result.backends)
 	var err error
-	result.influxes, err = newInfluxListForTesting(db.Influxes, creater)
+	result.influxes, err = newTiersForTesting(db, creater)
 	if err != nil {
+		closeBackends(result.backends)
 		return nil, err
 	}
-	result.scotties, err = newScottyListForTesting(db.Scotties, creater)
+	result.scotties, err = newScottyListForTesting(
+		db.Scotties, db.Redundancy, creater)
 	if err != nil {
+		result.influxes.Close()
+		closeBackends(result.backends)
 		return nil, err
 	}
 	return result, nil
@@ -401,7 +1291,16 @@ func (d *Database) _close() error {
 	return lastError.Error()
 }
 
+func (d *Database) health() []BackendHealth {
+	result := make([]BackendHealth, len(d.backends))
+	for i := range result {
+		result[i] = d.backends[i].health()
+	}
+	return result
+}
+
 func (d *Database) query(
+	ctx context.Context,
 	query *influxql.Query,
 	epoch string,
 	now time.Time,
@@ -409,11 +1308,83 @@ func (d *Database) query(
 	if d.influxes == nil && d.scotties == nil {
 		return responses.Merge()
 	}
+	query, err := withoutDatabaseNames(query, d.name)
+	if err != nil {
+		return nil, err
+	}
+	query, err = d.align(query, now)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, d.timeout)
+	defer cancel()
+	ctx, failures := withFailures(ctx)
+	response, err := d.queryBackends(ctx, query, epoch, now, logger)
+	if err != nil {
+		return nil, err
+	}
+	return failures.Apply(response, d.partialFailures)
+}
+
+// align returns query with time ranges aligned to GROUP BY time
+// boundaries if this configuration aligns times.
+func (d *Database) align(query *influxql.Query, now time.Time) (
+	*influxql.Query, error) {
+	if !d.alignTimes {
+		return query, nil
+	}
+	return alignTimeRanges(query, now)
+}
+
+// queryBackends works like query except that it ignores the partial
+// failures mode of this configuration.
+func (d *Database) queryBackends(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	if !hasMetadataStatement(query) {
+		return d.queryData(ctx, query, epoch, now, logger)
+	}
+	// SHOW statements go to every backend while select statements get
+	// split by time so we run each statement separately.
+	result := &client.Response{}
+	for _, stmt := range query.Statements {
+		var response *client.Response
+		var err error
+		if isMetadataStatement(stmt) {
+			response, err = d.queryMetadata(ctx, stmt, epoch, logger)
+		} else {
+			response, err = d.queryData(
+				ctx, qlutils.SingleQuery(stmt), epoch, now, logger)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := response.Error(); err != nil {
+			return nil, err
+		}
+		if len(response.Results) == 0 {
+			response.Results = []client.Result{{}}
+		}
+		result.Results = append(result.Results, response.Results...)
+	}
+	return result, nil
+}
+
+// queryData runs a query with no SHOW statements.
+func (d *Database) queryData(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
 	if d.influxes == nil {
-		return d.scotties.Query(query, epoch, logger)
+		return d.scotties.Query(ctx, query, epoch, now, logger)
 	}
 	if d.scotties == nil {
-		return d.influxes.Query(query, epoch, now, logger)
+		return d.influxes.Query(ctx, query, epoch, now, logger)
 	}
 	var wg sync.WaitGroup
 	var influxResponse *client.Response
@@ -421,30 +1392,40 @@ func (d *Database) query(
 	wg.Add(1)
 	go func() {
 		influxResponse, influxError = d.influxes.Query(
-			query, epoch, now, logger)
+			ctx, query, epoch, now, logger)
 		wg.Done()
 	}()
 	var scottyResponse *client.Response
 	var scottyError error
 	wg.Add(1)
 	go func() {
-		scottyResponse, scottyError = d.scotties.Query(query, epoch, logger)
+		scottyResponse, scottyError = d.scotties.Query(
+			ctx, query, epoch, now, logger)
 		wg.Done()
 	}()
 	wg.Wait()
 	if scottyError != nil || scottyResponse.Error() != nil {
+		if influxError == nil && influxResponse.Error() == nil &&
+			!isUnsupported(scottyError) {
+			recordFailure(ctx, &backendError{
+				backend: kScotties,
+				query:   query,
+				err:     firstError(scottyError, scottyResponse),
+			})
+		}
 		return influxResponse, influxError
 	}
 	if influxError != nil || influxResponse.Error() != nil {
+		if !isUnsupported(influxError) {
+			recordFailure(ctx, &backendError{
+				backend: kInfluxBackends,
+				query:   query,
+				err:     firstError(influxError, influxResponse),
+			})
+		}
 		return scottyResponse, scottyError
 	}
 
-	var lastError lastErrorType
-	lastError.Add(influxError)
-	lastError.Add(scottyError)
-	if err := lastError.Error(); err != nil {
-		return nil, err
-	}
 	// Give scotty results preference
 	return responses.MergePreferred(influxResponse, scottyResponse)
 }
@@ -452,7 +1433,13 @@ func (d *Database) query(
 func newProximaForTesting(
 	proxima config.Proxima, creater dbQueryerCreaterType) (*Proxima, error) {
 	result := &Proxima{dbs: make(map[string]*Database)}
+	if err := result.addUsers(proxima.Users); err != nil {
+		return nil, err
+	}
 	for _, dbSpec := range proxima.Dbs {
+		if dbSpec.Timeout == 0 {
+			dbSpec.Timeout = proxima.Timeout
+		}
 		db, err := newDatabaseForTesting(dbSpec, creater)
 		if err != nil {
 			return nil, err
@@ -482,125 +1469,62 @@ func (p *Proxima) _close() error {
 	return lastError.Error()
 }
 
-// sumUpScottyResponses issues a sum or count statement to all the scotties
-// in endpoints and sums the results into a single row set.
-func sumUpScottyResponses(
-	endpoints []queryerType,
-	stmt influxql.Statement,
-	epoch string,
-	logger log.Logger) (result []models.Row, err error) {
-	queries := make([]*influxql.Query, len(endpoints))
-	query := qlutils.SingleQuery(stmt)
-	for i := range queries {
-		queries[i] = query
-	}
-	responseList, errs := getRawConcurrentResponses(
-		endpoints, queries, epoch, logger)
-
-	// If we get an error from any scotty, we might give a wrong answer
-	// so the best we can do is error out.
-	for i := range errs {
-		if errs[i] != nil {
-			return nil, errs[i]
-		}
-		if err := responseList[i].Error(); err != nil {
-			return nil, err
-		}
-	}
-	rowsFromResponses := make([][]models.Row, len(responseList))
-	for i := range rowsFromResponses {
-		rowsFromResponses[i], err = responses.ExtractRows(responseList[i])
-		if err != nil {
-			return
-		}
-	}
-	return responses.SumRowsTogether(rowsFromResponses...)
-}
-
 // aggregateScottyStmtResponses aggregates scotty responses together when each
-// scotty represents different data. The statement is very restricted. For
-// instance, it can only be a sum(), mean() or count() statement.
+// scotty represents different data. The statement is very restricted. It
+// can be a raw select or have a single sum(), mean(), count(), min(),
+// max(), spread(), or stddev() field. It can also have a single first()
+// or last() field without GROUP BY time. If maxRawPoints is positive, it
+// can also have a single percentile(), median(), first(), or last() field
+// with GROUP BY time.
 func aggregateScottyStmtResponses(
+	ctx context.Context,
 	endpoints []queryerType,
 	stmt influxql.Statement,
+	maxRawPoints int,
 	epoch string,
-	logger log.Logger) (result client.Result, err error) {
+	logger log.Logger) (client.Result, error) {
+	if isRawSelect(stmt) {
+		return unionScottyStmtResponses(ctx, endpoints, stmt, epoch, logger)
+	}
 	aggregationType, err := qlutils.AggregationType(stmt)
 	if err != nil {
-		return
+		return client.Result{}, err
 	}
-	// If it is a mean statement, issue the corresponding sum statement and
-	// count statement to the scotties. Then do the math to compute the mean
-	// ourselves.
-	if aggregationType == "mean" {
-		var sumStmt, cntStmt influxql.Statement
-		sumStmt, err = qlutils.WithAggregationType(stmt, "sum")
-		if err != nil {
-			return
-		}
-		cntStmt, err = qlutils.WithAggregationType(stmt, "count")
-		if err != nil {
-			return
-		}
-		var sumRows, cntRows []models.Row
-		// Sum the results of the sum statement from each scotty
-		sumRows, err = sumUpScottyResponses(
-			endpoints,
-			sumStmt,
-			epoch,
-			logger)
-		if err != nil {
-			return
-		}
-		// Sum the results of the count statement from each scotty
-		cntRows, err = sumUpScottyResponses(
-			endpoints,
-			cntStmt,
-			epoch,
-			logger)
-		if err != nil {
-			return
-		}
-		// compute the mean ourselves
-		var meanRows []models.Row
-		meanRows, err = responses.DivideRows(
-			sumRows, cntRows, []string{"time", "mean"})
-		if err != nil {
-			return
-		}
-		return client.Result{Series: meanRows}, nil
-	} else if aggregationType == "sum" || aggregationType == "count" {
-		// If it is a sum or count statement we issue it to all the scotties
-		// as is and sum up the results.
-		var rows []models.Row
-		rows, err = sumUpScottyResponses(
-			endpoints,
-			stmt,
-			epoch,
-			logger)
-		if err != nil {
-			return
-		}
-		return client.Result{Series: rows}, nil
-	} else {
-		err = errors.New("Only sum, count, mean queries are supported")
-		return
+	selectStmt := stmt.(*influxql.SelectStatement)
+	// Fill values from one scotty would be wrong when combined with real
+	// values from another, so we fill after combining. Times are in
+	// nanoseconds until then.
+	partialStmt := withoutFill(selectStmt)
+	rows, ok, err := aggregatePartialStmt(
+		ctx, endpoints, partialStmt, aggregationType, maxRawPoints, "ns", logger)
+	if err != nil {
+		return client.Result{}, err
 	}
-
+	if !ok {
+		return client.Result{}, errors.New(
+			"Only sum, count, mean, min, max, spread, stddev, first, last, percentile, median queries are supported")
+	}
+	rows, err = fillRows(rows, selectStmt, epoch)
+	if err != nil {
+		return client.Result{}, err
+	}
+	return client.Result{Series: rows}, nil
 }
 
 // aggregateScottyResponses aggregates scotty responses together when each
-// scotty represents different data. The query is very restricted. For
-// instance, it can contain only sum(), mean() or count() statements.
+// scotty represents different data. The query is very restricted. See
+// aggregateScottyStmtResponses.
 func aggregateScottyResponses(
+	ctx context.Context,
 	endpoints []queryerType,
 	query *influxql.Query,
+	maxRawPoints int,
 	epoch string,
 	logger log.Logger) (*client.Response, error) {
 	var results []client.Result
 	for _, stmt := range query.Statements {
 		result, err := aggregateScottyStmtResponses(
-			endpoints, stmt, epoch, logger)
+			ctx, endpoints, stmt, maxRawPoints, epoch, logger)
 		if err != nil {
 			return nil, err
 		}
@@ -1,15 +1,26 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"github.com/Symantec/proxima/config"
 	"github.com/Symantec/scotty/influx/qlutils"
 	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
 	"github.com/influxdata/influxdb/models"
 	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -33,11 +44,15 @@ type fakeResponseType struct {
 // fakeDbQueryerType represents a connection to a fake influx backend or
 // scotty server.
 type fakeDbQueryerType struct {
+	// Guards queryCalls since proxima may query the same backend
+	// concurrently.
+	lock       sync.Mutex
 	queryCalls []queryCallType
 
 	byQuery       map[string]fakeResponseType
 	queryResponse *client.Response
 	queryError    error
+	hang          bool
 	closed        bool
 }
 
@@ -58,6 +73,12 @@ func (f *fakeDbQueryerType) WhenQueriedReturn(
 	f.queryResponse, f.queryError = response, err
 }
 
+// WhenQueriedHang instructs this fake to not respond to queries until
+// the context passed to Query is done.
+func (f *fakeDbQueryerType) WhenQueriedHang() {
+	f.hang = true
+}
+
 // NextQuery returns the next query this fake received.
 // A query consists of three parts, the query string, the influx database,
 // and the epoch, the precision of the times e.g "ns", "ms", "s", etc.
@@ -65,6 +86,8 @@ func (f *fakeDbQueryerType) WhenQueriedReturn(
 // against this fake, NextQuery panics.
 func (f *fakeDbQueryerType) NextQuery() (
 	query, database, epoch string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	query = f.queryCalls[0].query
 	database = f.queryCalls[0].database
 	epoch = f.queryCalls[0].epoch
@@ -76,6 +99,8 @@ func (f *fakeDbQueryerType) NextQuery() (
 
 // NoMoreQueries returns true if NextQuery would panic.
 func (f *fakeDbQueryerType) NoMoreQueries() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	return len(f.queryCalls) == 0
 }
 
@@ -87,11 +112,13 @@ func (f *fakeDbQueryerType) Closed() bool {
 // Query sends a query to the fake influx or scotty server, records the
 // query sent, and returns the same response and error passed to
 // WhenQueriedReturn.
-func (f *fakeDbQueryerType) Query(queryStr, database, epoch string) (
+func (f *fakeDbQueryerType) Query(
+	ctx context.Context, queryStr, database, epoch string) (
 	*client.Response, error) {
 	if f.closed {
 		panic("Cannot query a closed dbQueryer")
 	}
+	f.lock.Lock()
 	f.queryCalls = append(
 		f.queryCalls,
 		queryCallType{
@@ -99,6 +126,11 @@ func (f *fakeDbQueryerType) Query(queryStr, database, epoch string) (
 			database: database,
 			epoch:    epoch,
 		})
+	f.lock.Unlock()
+	if f.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
 	response, ok := f.byQuery[strings.ToLower(queryStr)]
 	if ok {
 		return response.Response, response.Err
@@ -120,8 +152,10 @@ func (f *fakeDbQueryerType) Close() error {
 type dbQueryerStoreType map[string]*fakeDbQueryerType
 
 // Create returns the connection to the fake server given its host and port.
-func (s dbQueryerStoreType) Create(addr string) (dbQueryerType, error) {
-	result, ok := s[addr]
+func (s dbQueryerStoreType) Create(
+	kind string, conn config.Connection, template string) (
+	dbQueryerType, error) {
+	result, ok := s[conn.HostAndPort]
 	if !ok {
 		return nil, kErrCreatingDbQueryer
 	}
@@ -166,6 +200,33 @@ func newResponse(values ...int64) *client.Response {
 
 }
 
+// newLoadResponse returns a response with a single load series for the
+// subd appname. values alternate between times and string values.
+func newLoadResponse(column string, values ...interface{}) *client.Response {
+	realValues := make([][]interface{}, len(values)/2)
+	for i := range realValues {
+		realValues[i] = []interface{}{
+			json.Number(strconv.Itoa(values[2*i].(int))), nil}
+		if value, ok := values[2*i+1].(string); ok {
+			realValues[i][1] = json.Number(value)
+		}
+	}
+	return &client.Response{
+		Results: []client.Result{
+			{
+				Series: []models.Row{
+					{
+						Name:    "load",
+						Tags:    map[string]string{"appname": "subd"},
+						Columns: []string{"time", column},
+						Values:  realValues,
+					},
+				},
+			},
+		},
+	}
+}
+
 func TestScottyPartial(t *testing.T) {
 	Convey("Given fake sources", t, func() {
 		now := time.Date(2017, 5, 13, 19, 0, 0, 0, time.UTC)
@@ -323,10 +384,188 @@ func TestScottyPartial(t *testing.T) {
 			query, err := qlutils.NewQuery(
 				"select sum(value) from load where time > now() - 1h group by time(1m), appname", now)
 			So(err, ShouldBeNil)
-			_, err = db.Query(query, "ns", now, nil)
+			_, err = db.Query(context.Background(), query, "ns", now, nil)
 			So(err, ShouldEqual, kErrSomeError)
 		})
 
+		Convey("With a raw point budget", func() {
+			proximaConfig := config.Proxima{
+				Dbs: []config.Database{
+					{
+						Name: "regular",
+						Scotties: config.ScottyList{
+							{
+								Partials: config.ScottyList{
+									{HostAndPort: "alpha"},
+									{HostAndPort: "bravo"},
+								},
+								MaxRawPoints: 4,
+							},
+						},
+					},
+				},
+			}
+			proxima, err := newProximaForTesting(proximaConfig, store.Create)
+			So(err, ShouldBeNil)
+			db := proxima.ByName("regular")
+			So(db, ShouldNotBeNil)
+			store["alpha"].WhenQueryIsReturn(
+				"select value from load where time > '2017-05-13T18:00:00Z' group by appname limit 5",
+				newLoadResponse("value", 61000000000, "2", 90000000000, "9"),
+				nil)
+			store["bravo"].WhenQueryIsReturn(
+				"select value from load where time > '2017-05-13T18:00:00Z' group by appname limit 5",
+				newLoadResponse("value", 100000000000, "6", 125000000000, "3"),
+				nil)
+
+			Convey("median should use raw values", func() {
+				query, err := qlutils.NewQuery(
+					"select median(value) from load where time > now() - 1h group by time(1m), appname", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				So(response, ShouldResemble, newLoadResponse(
+					"median", 60000000000, "6", 120000000000, "3"))
+			})
+
+			Convey("median of an even number of values should average", func() {
+				query, err := qlutils.NewQuery(
+					"select median(value) from load where time > now() - 1h group by appname", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				So(response, ShouldResemble, newLoadResponse(
+					"median", 1494698400000000001, "4.5"))
+			})
+
+			Convey("percentile should select the nearest rank", func() {
+				query, err := qlutils.NewQuery(
+					"select percentile(value, 50) from load where time > now() - 1h group by time(1m), appname", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				So(response, ShouldResemble, newLoadResponse(
+					"percentile", 60000000000, "6", 120000000000, "3"))
+			})
+
+			Convey("last should use raw values", func() {
+				query, err := qlutils.NewQuery(
+					"select last(value) from load where time > now() - 1h group by time(1m), appname", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				So(response, ShouldResemble, newLoadResponse(
+					"last", 60000000000, "6", 120000000000, "3"))
+				_, _, epoch := store["alpha"].NextQuery()
+				So(epoch, ShouldEqual, "ns")
+			})
+
+			Convey("first should use raw values", func() {
+				query, err := qlutils.NewQuery(
+					"select first(value) from load where time > now() - 1h group by time(1m), appname", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				So(response, ShouldResemble, newLoadResponse(
+					"first", 60000000000, "2", 120000000000, "3"))
+			})
+		})
+
+		Convey("With a small raw point budget", func() {
+			proximaConfig := config.Proxima{
+				Dbs: []config.Database{
+					{
+						Name: "regular",
+						Scotties: config.ScottyList{
+							{
+								Partials: config.ScottyList{
+									{HostAndPort: "alpha"},
+									{HostAndPort: "bravo"},
+								},
+								MaxRawPoints: 3,
+							},
+						},
+					},
+				},
+			}
+			proxima, err := newProximaForTesting(proximaConfig, store.Create)
+			So(err, ShouldBeNil)
+			db := proxima.ByName("regular")
+			So(db, ShouldNotBeNil)
+			store["alpha"].WhenQueryIsReturn(
+				"select value from load where time > '2017-05-13T18:00:00Z' group by appname limit 4",
+				newLoadResponse("value", 61000000000, "2", 90000000000, "9"),
+				nil)
+			store["bravo"].WhenQueryIsReturn(
+				"select value from load where time > '2017-05-13T18:00:00Z' group by appname limit 4",
+				newLoadResponse("value", 100000000000, "6", 125000000000, "3"),
+				nil)
+
+			Convey("Going over the budget should fail", func() {
+				query, err := qlutils.NewQuery(
+					"select median(value) from load where time > now() - 1h group by time(1m), appname", now)
+				So(err, ShouldBeNil)
+				_, err = db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("With sharded partials", func() {
+			proximaConfig := config.Proxima{
+				Dbs: []config.Database{
+					{
+						Name: "regular",
+						Scotties: config.ScottyList{
+							{
+								Partials: config.ScottyList{
+									{HostAndPort: "alpha", ShardPrefixes: []string{"sub"}},
+									{HostAndPort: "error", ShardRegex: "^img"},
+								},
+								Sharding: &config.Sharding{Tag: "appname"},
+							},
+						},
+					},
+				},
+			}
+			proxima, err := newProximaForTesting(proximaConfig, store.Create)
+			So(err, ShouldBeNil)
+			db := proxima.ByName("regular")
+			So(db, ShouldNotBeNil)
+			store["alpha"].WhenQueryIsReturn(
+				"select sum(value) from load where appname = 'subd' and time > '2017-05-13T18:00:00Z' group by time(1m)",
+				newLoadResponse("sum", 11000, "45"),
+				nil)
+
+			Convey("Queries should go to only the owning partial", func() {
+				query, err := qlutils.NewQuery(
+					"select sum(value) from load where appname = 'subd' and time > now() - 1h group by time(1m)", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				So(response, ShouldResemble, newLoadResponse("sum", 11000, "45"))
+				So(store["error"].NoMoreQueries(), ShouldBeTrue)
+			})
+
+			Convey("Queries for a dead partial's data should fail", func() {
+				query, err := qlutils.NewQuery(
+					"select sum(value) from load where appname = 'imgserver' and time > now() - 1h group by time(1m)", now)
+				So(err, ShouldBeNil)
+				_, err = db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldEqual, kErrSomeError)
+			})
+
+			Convey("Queries for data no partial has should be empty", func() {
+				query, err := qlutils.NewQuery(
+					"select sum(value) from load where appname = 'other' and time > now() - 1h group by time(1m)", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				So(response, ShouldResemble, &client.Response{
+					Results: []client.Result{{}},
+				})
+			})
+		})
+
 		Convey("With good config", func() {
 			proximaConfig := config.Proxima{
 				Dbs: []config.Database{
@@ -358,7 +597,7 @@ func TestScottyPartial(t *testing.T) {
 				query, err := qlutils.NewQuery(
 					"select sum(value) from load where time > now() - 1h group by time(1m), appname", now)
 				So(err, ShouldBeNil)
-				response, err := db.Query(query, "ns", now, nil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
 				So(err, ShouldBeNil)
 				So(response, ShouldResemble, &client.Response{
 					Results: []client.Result{
@@ -381,7 +620,8 @@ func TestScottyPartial(t *testing.T) {
 									Values: [][]interface{}{
 										{json.Number("11000"), json.Number("72")},
 										{json.Number("11050"), json.Number("95")},
-										{json.Number("11100"), nil},
+										// Only bravo has a value
+										{json.Number("11100"), json.Number("21")},
 									},
 								},
 							},
@@ -395,7 +635,7 @@ func TestScottyPartial(t *testing.T) {
 				query, err := qlutils.NewQuery(
 					"select count(value) from load where time > now() - 1h group by time(1m), appname", now)
 				So(err, ShouldBeNil)
-				response, err := db.Query(query, "ns", now, nil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
 				So(err, ShouldBeNil)
 				So(response, ShouldResemble, &client.Response{
 					Results: []client.Result{
@@ -418,7 +658,8 @@ func TestScottyPartial(t *testing.T) {
 									Values: [][]interface{}{
 										{json.Number("11000"), json.Number("6")},
 										{json.Number("11050"), json.Number("5")},
-										{json.Number("11100"), nil},
+										// Only bravo has a value
+										{json.Number("11100"), json.Number("3")},
 									},
 								},
 							},
@@ -432,7 +673,7 @@ func TestScottyPartial(t *testing.T) {
 				query, err := qlutils.NewQuery(
 					"select mean(value) from load where time > now() - 1h group by time(1m), appname", now)
 				So(err, ShouldBeNil)
-				response, err := db.Query(query, "ns", now, nil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
 				So(err, ShouldBeNil)
 				So(response, ShouldResemble, &client.Response{
 					Results: []client.Result{
@@ -455,7 +696,8 @@ func TestScottyPartial(t *testing.T) {
 									Values: [][]interface{}{
 										{json.Number("11000"), json.Number("12")},
 										{json.Number("11050"), json.Number("19")},
-										{json.Number("11100"), nil},
+										// Only bravo has a value
+										{json.Number("11100"), json.Number("7")},
 									},
 								},
 							},
@@ -463,8 +705,219 @@ func TestScottyPartial(t *testing.T) {
 					},
 				})
 			})
+			Convey("Other aggregations should work", func() {
+				db := proxima.ByName("regular")
+				So(db, ShouldNotBeNil)
+				store["alpha"].WhenQueryIsReturn(
+					"select min(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("min", 11000, "2", 11050, "4"),
+					nil)
+				store["bravo"].WhenQueryIsReturn(
+					"select min(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("min", 11000, "6", 11050, nil),
+					nil)
+				store["alpha"].WhenQueryIsReturn(
+					"select max(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("max", 11000, "9", 11050, "4"),
+					nil)
+				store["bravo"].WhenQueryIsReturn(
+					"select max(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("max", 11000, "8", 11050, nil),
+					nil)
+				store["alpha"].WhenQueryIsReturn(
+					"select mean(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("mean", 11000, "5", 11050, "4"),
+					nil)
+				store["bravo"].WhenQueryIsReturn(
+					"select mean(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("mean", 11000, "7", 11050, nil),
+					nil)
+				store["alpha"].WhenQueryIsReturn(
+					"select stddev(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("stddev", 11000, "3.605551275463989", 11050, nil),
+					nil)
+				store["bravo"].WhenQueryIsReturn(
+					"select stddev(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("stddev", 11000, "1.4142135623730951", 11050, nil),
+					nil)
+				// count is only consulted for stddev
+				store["alpha"].WhenQueryIsReturn(
+					"select count(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("count", 11000, "3", 11050, "1"),
+					nil)
+				store["bravo"].WhenQueryIsReturn(
+					"select count(value) from load where time > '2017-05-13T18:00:00Z' group by time(1m), appname",
+					newLoadResponse("count", 11000, "2", 11050, nil),
+					nil)
+
+				Convey("max should take the largest value", func() {
+					query, err := qlutils.NewQuery(
+						"select max(value) from load where time > now() - 1h group by time(1m), appname", now)
+					So(err, ShouldBeNil)
+					response, err := db.Query(context.Background(), query, "ns", now, nil)
+					So(err, ShouldBeNil)
+					So(response, ShouldResemble, newLoadResponse(
+						"max", 11000, "9", 11050, "4"))
+				})
+
+				Convey("spread should use min and max of each partial", func() {
+					query, err := qlutils.NewQuery(
+						"select spread(value) from load where time > now() - 1h group by time(1m), appname", now)
+					So(err, ShouldBeNil)
+					response, err := db.Query(context.Background(), query, "ns", now, nil)
+					So(err, ShouldBeNil)
+					So(response, ShouldResemble, newLoadResponse(
+						"spread", 11000, "7", 11050, "0"))
+				})
+
+				Convey("stddev should combine means, counts, and stddevs", func() {
+					query, err := qlutils.NewQuery(
+						"select stddev(value) from load where time > now() - 1h group by time(1m), appname", now)
+					So(err, ShouldBeNil)
+					response, err := db.Query(context.Background(), query, "ns", now, nil)
+					So(err, ShouldBeNil)
+					values := response.Results[0].Series[0].Values
+					So(values, ShouldHaveLength, 2)
+					stddev, err := values[0][1].(json.Number).Float64()
+					So(err, ShouldBeNil)
+					// stddev of 2, 4, 9, 6, 8
+					So(stddev, ShouldAlmostEqual, math.Sqrt(8.2), 1e-9)
+					// Only one value
+					So(values[1][1], ShouldBeNil)
+				})
+
+				Convey("first and last without GROUP BY time should pick by time", func() {
+					store["alpha"].WhenQueryIsReturn(
+						"select first(value) from load where time > '2017-05-13T18:00:00Z' group by appname",
+						newLoadResponse("first", 61000000000, "2"),
+						nil)
+					store["bravo"].WhenQueryIsReturn(
+						"select first(value) from load where time > '2017-05-13T18:00:00Z' group by appname",
+						newLoadResponse("first", 100000000000, "6"),
+						nil)
+					store["alpha"].WhenQueryIsReturn(
+						"select last(value) from load where time > '2017-05-13T18:00:00Z' group by appname",
+						newLoadResponse("last", 90000000000, "9"),
+						nil)
+					store["bravo"].WhenQueryIsReturn(
+						"select last(value) from load where time > '2017-05-13T18:00:00Z' group by appname",
+						newLoadResponse("last", 125000000000, "3"),
+						nil)
+					query, err := qlutils.NewQuery(
+						"select first(value) from load where time > now() - 1h group by appname", now)
+					So(err, ShouldBeNil)
+					response, err := db.Query(context.Background(), query, "ns", now, nil)
+					So(err, ShouldBeNil)
+					So(response, ShouldResemble, newLoadResponse(
+						"first", 61000000000, "2"))
+					query, err = qlutils.NewQuery(
+						"select last(value) from load where time > now() - 1h group by appname", now)
+					So(err, ShouldBeNil)
+					response, err = db.Query(context.Background(), query, "ns", now, nil)
+					So(err, ShouldBeNil)
+					So(response, ShouldResemble, newLoadResponse(
+						"last", 125000000000, "3"))
+				})
+
+				Convey("first with GROUP BY time should need a raw point budget", func() {
+					query, err := qlutils.NewQuery(
+						"select first(value) from load where time > now() - 1h group by time(1m), appname", now)
+					So(err, ShouldBeNil)
+					_, err = db.Query(context.Background(), query, "ns", now, nil)
+					So(err, ShouldNotBeNil)
+				})
+			})
+
+			Convey("Raw selects should union the series of each partial", func() {
+				db := proxima.ByName("regular")
+				So(db, ShouldNotBeNil)
+				store["alpha"].WhenQueryIsReturn(
+					"select value from cpu where time > '2017-05-13T18:00:00Z' group by host",
+					newResponseWithTags(
+						"cpu", map[string]string{"host": "a"}, 1000, 10, 1100, 11),
+					nil)
+				store["bravo"].WhenQueryIsReturn(
+					"select value from cpu where time > '2017-05-13T18:00:00Z' group by host",
+					newResponseWithTags(
+						"cpu", map[string]string{"host": "b"}, 1000, 20),
+					nil)
+				query, err := qlutils.NewQuery(
+					"select value from cpu where time > now() - 1h group by host", now)
+				So(err, ShouldBeNil)
+				response, err := db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldBeNil)
+				expected := newResponseWithTags(
+					"cpu", map[string]string{"host": "a"}, 1000, 10, 1100, 11)
+				expected.Results[0].Series = append(
+					expected.Results[0].Series,
+					newResponseWithTags(
+						"cpu", map[string]string{"host": "b"}, 1000, 20).Results[0].Series...)
+				So(response, ShouldResemble, expected)
+			})
+
+			Convey("Unsupported aggregations should fail", func() {
+				db := proxima.ByName("regular")
+				So(db, ShouldNotBeNil)
+				query, err := qlutils.NewQuery(
+					"select mode(value) from load where time > now() - 1h group by time(1m), appname", now)
+				So(err, ShouldBeNil)
+				_, err = db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldNotBeNil)
+				// No raw point budget
+				query, err = qlutils.NewQuery(
+					"select median(value) from load where time > now() - 1h group by time(1m), appname", now)
+				So(err, ShouldBeNil)
+				_, err = db.Query(context.Background(), query, "ns", now, nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+	})
+}
+
+func TestShardRouter(t *testing.T) {
+	Convey("Given hash sharding", t, func() {
+		router, err := newShardRouter(
+			&config.Sharding{Tag: "host", Hash: true},
+			config.ScottyList{{}, {}, {}})
+		So(err, ShouldBeNil)
+
+		Convey("Each value should go to one partial", func() {
+			stmt := influxql.MustParseStatement(
+				"select value from cpu where host = 'a'")
+			route := router.Route(stmt)
+			So(route, ShouldHaveLength, 1)
+			So(route, ShouldResemble, router.owners("a"))
+		})
+
+		Convey("Multiple values should go to their partials", func() {
+			stmt := influxql.MustParseStatement(
+				"select value from cpu where (host = 'a' or host = 'b') and region = 'us'")
+			route := router.Route(stmt)
+			So(route, ShouldContain, router.owners("a")[0])
+			So(route, ShouldContain, router.owners("b")[0])
 		})
 
+		Convey("Other conditions should go to every partial", func() {
+			stmt := influxql.MustParseStatement(
+				"select value from cpu where host =~ /a/")
+			So(router.Route(stmt), ShouldResemble, []int{0, 1, 2})
+			stmt = influxql.MustParseStatement(
+				"select value from cpu where region = 'us'")
+			So(router.Route(stmt), ShouldResemble, []int{0, 1, 2})
+		})
+	})
+
+	Convey("Hash sharding with prefixes should fail", t, func() {
+		_, err := newShardRouter(
+			&config.Sharding{Tag: "host", Hash: true},
+			config.ScottyList{{ShardPrefixes: []string{"a"}}, {}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Sharding without a tag should fail", t, func() {
+		_, err := newShardRouter(&config.Sharding{}, config.ScottyList{{}})
+		So(err, ShouldNotBeNil)
 	})
 }
 
@@ -609,7 +1062,7 @@ func TestAPI(t *testing.T) {
 					query, err := qlutils.NewQuery(
 						"select mean(value) from dual where time >= now() - 5h", now)
 					So(err, ShouldBeNil)
-					response, err := db.Query(query, "ns", now, nil)
+					response, err := db.Query(context.Background(), query, "ns", now, nil)
 					So(err, ShouldBeNil)
 					So(*response, ShouldBeZeroValue)
 				})
@@ -621,7 +1074,7 @@ func TestAPI(t *testing.T) {
 					query, err := qlutils.NewQuery(
 						"select mean(value) from dual where time >= now() - 5h", now)
 					So(err, ShouldBeNil)
-					response, err := db.Query(query, "ms", now, nil)
+					response, err := db.Query(context.Background(), query, "ms", now, nil)
 					So(err, ShouldBeNil)
 					// In the case that scotty doesn't support the query,
 					// rely on the influx servers.
@@ -641,7 +1094,7 @@ func TestAPI(t *testing.T) {
 					query, err := qlutils.NewQuery(
 						"select mean(value) from dual where time >= now() - 5h", now)
 					So(err, ShouldBeNil)
-					response, err := db.Query(query, "ns", now, nil)
+					response, err := db.Query(context.Background(), query, "ns", now, nil)
 					So(err, ShouldBeNil)
 					// influx backend with shortest retention policy always
 					// takes precedence.
@@ -689,7 +1142,7 @@ func TestAPI(t *testing.T) {
 					query, err := qlutils.NewQuery(
 						"select mean(value) from dual where time >= now() - 120h and time < now() - 5h", now)
 					So(err, ShouldBeNil)
-					response, err := db.Query(query, "ns", now, nil)
+					response, err := db.Query(context.Background(), query, "ns", now, nil)
 					So(err, ShouldBeNil)
 					So(response, ShouldResemble, newResponse(
 						1000, 10,
@@ -731,7 +1184,7 @@ func TestAPI(t *testing.T) {
 					query, err := qlutils.NewQuery(
 						"select mean(value) from dual where time >= now() - 5h", now)
 					So(err, ShouldBeNil)
-					response, err := db.Query(query, "ms", now, nil)
+					response, err := db.Query(context.Background(), query, "ms", now, nil)
 					So(err, ShouldBeNil)
 					// scotty server listed last takes precedence.
 					So(response, ShouldResemble, newResponse(
@@ -772,4 +1225,568 @@ func TestAPI(t *testing.T) {
 			})
 		})
 	})
+
+	Convey("Given influxes that split time disjointly", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha":   &fakeDbQueryerType{},
+			"bravo":   &fakeDbQueryerType{},
+			"charlie": &fakeDbQueryerType{},
+			"error":   &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10, 1200, 11), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1200, 12, 1400, 13), nil)
+		store["charlie"].WhenQueriedReturn(newResponse(1400, 14, 1600, 15), nil)
+		store["error"].WhenQueriedReturn(nil, kErrSomeError)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "disjoint",
+				Influxes: config.InfluxList{
+					{HostAndPort: "charlie", Database: "c", Duration: time.Hour},
+					{HostAndPort: "alpha", Database: "a", Duration: 100 * time.Hour},
+					{HostAndPort: "bravo", Database: "b", Duration: 10 * time.Hour},
+					{HostAndPort: "error", Database: "err", Duration: 50 * time.Hour},
+				},
+				SplitMode: config.SplitDisjoint,
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		query, err := qlutils.NewQuery(
+			"select mean(value) from dual where time >= now() - 60h", now)
+		So(err, ShouldBeNil)
+
+		checkQueries := func() {
+			// 'alpha' gets its own time range along with the time range
+			// of 'error' which failed. The order is random.
+			queryStr1, _, _ := store["alpha"].NextQuery()
+			queryStr2, _, _ := store["alpha"].NextQuery()
+			So(store["alpha"].NoMoreQueries(), ShouldBeTrue)
+			So(
+				[]string{queryStr1, queryStr2},
+				ShouldContain,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-28T12:01:00Z' AND time < '2016-11-28T22:01:00Z'")
+			So(
+				[]string{queryStr1, queryStr2},
+				ShouldContain,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-28T22:01:00Z' AND time < '2016-11-30T14:01:00Z'")
+
+			// 'bravo' gets only up to where 'charlie' begins
+			queryStr, _, _ := store["bravo"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-30T14:01:00Z' AND time < '2016-11-30T23:01:00Z'")
+			So(store["bravo"].NoMoreQueries(), ShouldBeTrue)
+
+			queryStr, _, _ = store["charlie"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-30T23:01:00Z' AND time < '2016-12-01T00:01:00Z'")
+			So(store["charlie"].NoMoreQueries(), ShouldBeTrue)
+		}
+
+		Convey("Each influx should get only its own time range", func() {
+			response, err := db.Query(context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(
+				1000, 10,
+				1200, 12,
+				1400, 14,
+				1600, 15,
+			))
+			checkQueries()
+		})
+
+		Convey("Streaming should split the same way", func() {
+			var recorder rowRecorderType
+			err := db.QueryStream(
+				context.Background(), query, "ns", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				{newRow("alpha", nil, 1000, 10, 1200, 12, 1400, 14, 1600, 15)},
+			})
+			checkQueries()
+		})
+
+		Convey("Boundaries should snap to the GROUP BY time interval", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from dual where time >= now() - 60h group by time(10m)", now)
+			So(err, ShouldBeNil)
+			_, err = db.Query(context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			queryStr1, _, _ := store["alpha"].NextQuery()
+			queryStr2, _, _ := store["alpha"].NextQuery()
+			So(
+				[]string{queryStr1, queryStr2},
+				ShouldContain,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-28T12:01:00Z' AND time < '2016-11-28T22:10:00Z' GROUP BY time(10m)")
+			So(
+				[]string{queryStr1, queryStr2},
+				ShouldContain,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-28T22:10:00Z' AND time < '2016-11-30T14:10:00Z' GROUP BY time(10m)")
+			queryStr, _, _ := store["bravo"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-30T14:10:00Z' AND time < '2016-11-30T23:10:00Z' GROUP BY time(10m)")
+			queryStr, _, _ = store["charlie"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-30T23:10:00Z' AND time < '2016-12-01T00:01:00Z' GROUP BY time(10m)")
+		})
+	})
+
+	Convey("Given scotties with databases and durations", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1200, 12), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "windows",
+				Scotties: config.ScottyList{
+					{
+						HostAndPort: "alpha",
+						Database:    "gw",
+						Duration:    time.Hour,
+					},
+					{HostAndPort: "bravo"},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+
+		Convey("Each scotty should get only the time it has", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from dual where time >= now() - 5h", now)
+			So(err, ShouldBeNil)
+			response, err := db.Query(context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1000, 10, 1200, 12))
+			queryStr, database, _ := store["alpha"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-30T23:01:00Z' AND time < '2016-12-01T00:01:00Z'")
+			So(database, ShouldEqual, "gw")
+			queryStr, database, _ = store["bravo"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-30T19:01:00Z'")
+			So(database, ShouldEqual, "scotty")
+		})
+
+		Convey("Scotties should not get queries for times they lack", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from dual where time >= now() - 5h and time < now() - 2h", now)
+			So(err, ShouldBeNil)
+			var recorder rowRecorderType
+			err = db.QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				{newRow("alpha", nil, 1200, 12)},
+			})
+			So(store["alpha"].NoMoreQueries(), ShouldBeTrue)
+			queryStr, _, _ := store["bravo"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM dual WHERE time >= '2016-11-30T19:01:00Z' AND time < '2016-11-30T22:01:00Z'")
+		})
+	})
+
+	Convey("Unknown split modes should fail", t, func() {
+		_, err := newDatabaseForTesting(
+			config.Database{Name: "bad", SplitMode: "sideways"},
+			dbQueryerStoreType{}.Create)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+// newRetentionPoliciesResponse returns the response to SHOW RETENTION
+// POLICIES. values alternate between names and durations. The first
+// retention policy is the default.
+func newRetentionPoliciesResponse(values ...string) *client.Response {
+	row := models.Row{
+		Columns: []string{
+			"name", "duration", "shardGroupDuration", "replicaN", "default"},
+	}
+	for i := 0; i < len(values); i += 2 {
+		row.Values = append(row.Values, []interface{}{
+			values[i], values[i+1], "1h0m0s", json.Number("1"), i == 0})
+	}
+	return &client.Response{
+		Results: []client.Result{{Series: []models.Row{row}}},
+	}
+}
+
+func TestDiscoverDurations(t *testing.T) {
+	Convey("Given influxes with and without durations", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha":   &fakeDbQueryerType{},
+			"bravo":   &fakeDbQueryerType{},
+			"charlie": &fakeDbQueryerType{},
+			"error":   &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueryIsReturn(
+			"SHOW RETENTION POLICIES ON a",
+			newRetentionPoliciesResponse("autogen", "100h0m0s"),
+			nil)
+		store["charlie"].WhenQueryIsReturn(
+			"SHOW RETENTION POLICIES ON c",
+			newRetentionPoliciesResponse(
+				"autogen", "0s", "short", "1h0m0s"),
+			nil)
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10, 1200, 11), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1200, 12, 1400, 13), nil)
+		store["charlie"].WhenQueriedReturn(newResponse(1400, 14, 1600, 15), nil)
+		store["error"].WhenQueriedReturn(nil, kErrSomeError)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "discover",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a"},
+					{HostAndPort: "bravo", Database: "b", Duration: 10 * time.Hour},
+					{HostAndPort: "charlie", Database: "c", RetentionPolicy: "short"},
+					{HostAndPort: "error", Database: "e"},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		<-db.influxes.discovered
+		queryStr, database, _ := store["alpha"].NextQuery()
+		So(queryStr, ShouldEqual, "SHOW RETENTION POLICIES ON a")
+		So(database, ShouldEqual, "a")
+		queryStr, _, _ = store["error"].NextQuery()
+		So(queryStr, ShouldEqual, "SHOW RETENTION POLICIES ON e")
+		So(store["bravo"].NoMoreQueries(), ShouldBeTrue)
+
+		Convey("Durations should be discovered", func() {
+			So(db.InfluxDuration(0), ShouldEqual, 100*time.Hour)
+			So(db.InfluxDuration(1), ShouldEqual, 10*time.Hour)
+			So(db.InfluxDuration(2), ShouldEqual, time.Hour)
+			So(db.InfluxDuration(3), ShouldEqual, 0)
+		})
+
+		Convey("Queries should split by discovered durations", func() {
+			store["charlie"].NextQuery()
+			query, err := qlutils.NewQuery(
+				"select mean(value) from dual where time >= now() - 5h", now)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(
+				1000, 10,
+				1200, 12,
+				1400, 14,
+				1600, 15,
+			))
+			queryStr, _, _ := store["charlie"].NextQuery()
+			So(
+				queryStr,
+				ShouldEqual,
+				"SELECT mean(value) FROM short.dual WHERE time >= '2016-11-30T23:01:00Z' AND time < '2016-12-01T00:01:00Z'")
+			// An influx without a known duration might have data for
+			// any time.
+			So(store["error"].NoMoreQueries(), ShouldBeFalse)
+		})
+
+		Convey("Refreshing should reorder influxes", func() {
+			store["alpha"].WhenQueryIsReturn(
+				"SHOW RETENTION POLICIES ON a",
+				newRetentionPoliciesResponse("autogen", "5h0m0s"),
+				nil)
+			db.influxes.refreshDurations(context.Background())
+			So(db.InfluxDuration(0), ShouldEqual, 5*time.Hour)
+			So(db.influxes.instances, ShouldResemble, []*Influx{
+				db.influxes.influxes[3],
+				db.influxes.influxes[1],
+				db.influxes.influxes[0],
+				db.influxes.influxes[2],
+			})
+		})
+
+		Convey("Infinite retention policies should work", func() {
+			store["charlie"].WhenQueryIsReturn(
+				"SHOW RETENTION POLICIES ON c",
+				newRetentionPoliciesResponse("short", "0s"),
+				nil)
+			db.influxes.refreshDurations(context.Background())
+			So(db.InfluxDuration(2), ShouldEqual, kInfiniteDuration)
+		})
+
+		Convey("Failing to refresh should keep the old duration", func() {
+			store["alpha"].WhenQueryIsReturn(
+				"SHOW RETENTION POLICIES ON a", nil, kErrSomeError)
+			db.influxes.refreshDurations(context.Background())
+			So(db.InfluxDuration(0), ShouldEqual, 100*time.Hour)
+		})
+
+		Convey("Hung influxes should not hold up each other", func() {
+			store["alpha"].WhenQueriedHang()
+			store["error"].WhenQueriedHang()
+			store["charlie"].WhenQueryIsReturn(
+				"SHOW RETENTION POLICIES ON c",
+				newRetentionPoliciesResponse("short", "2h0m0s"),
+				nil)
+			ctx, cancel := context.WithTimeout(
+				context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			db.influxes.refreshDurations(ctx)
+			// Asking one at a time would take twice the timeout.
+			So(time.Since(start), ShouldBeLessThan, 200*time.Millisecond)
+			So(db.InfluxDuration(0), ShouldEqual, 100*time.Hour)
+			So(db.InfluxDuration(2), ShouldEqual, 2*time.Hour)
+		})
+	})
+
+	Convey("Discovering durations should not hold up startup", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"hung":  &fakeDbQueryerType{},
+		}
+		store["hung"].WhenQueriedHang()
+		start := time.Now()
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "hung",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a", Duration: time.Hour},
+					{HostAndPort: "hung", Database: "h"},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, kDurationTimeout)
+		So(db.InfluxDuration(1), ShouldEqual, 0)
+		// Until then the hung influx might have data for any time.
+		So(db.influxes.instances[0], ShouldEqual, db.influxes.influxes[1])
+		start = time.Now()
+		So(db.Close(), ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, kDurationTimeout)
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	Convey("Given fake sources", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+			"hung":  &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10, 1200, 11), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1200, 12, 1400, 13), nil)
+		store["hung"].WhenQueriedHang()
+		proximaConfig := config.Proxima{
+			Dbs: []config.Database{
+				{
+					Name: "influxTimeout",
+					Influxes: config.InfluxList{
+						{
+							HostAndPort: "alpha",
+							Database:    "a",
+							Duration:    100 * time.Hour,
+						},
+						{
+							HostAndPort: "hung",
+							Database:    "h",
+							Duration:    10 * time.Hour,
+							Timeout:     10 * time.Millisecond,
+						},
+					},
+				},
+				{
+					Name: "scottyTimeout",
+					Scotties: config.ScottyList{
+						{HostAndPort: "bravo"},
+						{HostAndPort: "hung", Timeout: 10 * time.Millisecond},
+					},
+				},
+				{
+					Name:    "databaseTimeout",
+					Timeout: 10 * time.Millisecond,
+					Scotties: config.ScottyList{
+						{HostAndPort: "hung"},
+					},
+				},
+				{
+					Name: "globalTimeout",
+					Scotties: config.ScottyList{
+						{HostAndPort: "hung"},
+					},
+				},
+			},
+			Timeout: 10 * time.Millisecond,
+		}
+		proxima, err := newProximaForTesting(proximaConfig, store.Create)
+		So(err, ShouldBeNil)
+		query, err := qlutils.NewQuery(
+			"select mean(value) from dual where time >= now() - 5h", now)
+		So(err, ShouldBeNil)
+
+		Convey("Timed out influx should be skipped", func() {
+			db := proxima.ByName("influxTimeout")
+			response, err := db.Query(
+				context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1000, 10, 1200, 11))
+		})
+
+		Convey("Timed out scotty should be skipped", func() {
+			db := proxima.ByName("scottyTimeout")
+			response, err := db.Query(
+				context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1200, 12, 1400, 13))
+		})
+
+		Convey("Database timeout should apply", func() {
+			db := proxima.ByName("databaseTimeout")
+			_, err := db.Query(context.Background(), query, "ns", now, nil)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+		})
+
+		Convey("Global timeout should apply", func() {
+			db := proxima.ByName("globalTimeout")
+			_, err := db.Query(context.Background(), query, "ns", now, nil)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+		})
+
+		Convey("Cancelling context should abort query", func() {
+			db := proxima.ByName("scottyTimeout")
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			// bravo responds regardless, but hung stops waiting.
+			response, err := db.Query(ctx, query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1200, 12, 1400, 13))
+		})
+	})
+}
+
+// writeFile writes contents to a new file in dir and returns its path.
+func writeFile(dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, ([]byte)(contents), 0600); err != nil {
+		panic(err)
+	}
+	return path
+}
+
+func TestInfluxQueryer(t *testing.T) {
+	Convey("Given a fake influx server", t, func() {
+		var lastRequest *http.Request
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			lastRequest = r
+			if r.Form.Get("q") == "hang" {
+				<-r.Context().Done()
+				return
+			}
+			fmt.Fprintln(w, `{"results":[{"series":[{"name":"alpha","columns":["time","value"],"values":[[1000,10]]}]}]}`)
+		})
+		dir, err := ioutil.TempDir("", "proxima")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		Convey("Credentials and headers should be sent", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			queryer, err := influxCreateDbQueryer(config.Connection{
+				HostAndPort: server.URL,
+				Access: config.Access{
+					Username:     "someUser",
+					PasswordFile: writeFile(dir, "password", "secret\n"),
+					Headers:      map[string]string{"X-Tenant": "foo"},
+					HeaderFiles: map[string]string{
+						"X-Token": writeFile(dir, "token", "abcd\n"),
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+			defer queryer.Close()
+			response, err := queryer.Query(
+				context.Background(), "select * from alpha", "adb", "ms")
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1000, 10))
+			user, password, ok := lastRequest.BasicAuth()
+			So(ok, ShouldBeTrue)
+			So(user, ShouldEqual, "someUser")
+			So(password, ShouldEqual, "secret")
+			So(lastRequest.Header.Get("X-Tenant"), ShouldEqual, "foo")
+			So(lastRequest.Header.Get("X-Token"), ShouldEqual, "abcd")
+			So(lastRequest.Form.Get("q"), ShouldEqual, "select * from alpha")
+			So(lastRequest.Form.Get("db"), ShouldEqual, "adb")
+			So(lastRequest.Form.Get("epoch"), ShouldEqual, "ms")
+		})
+
+		Convey("Cancelling context should abort query", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			queryer, err := influxCreateDbQueryer(
+				config.Connection{HostAndPort: server.URL})
+			So(err, ShouldBeNil)
+			defer queryer.Close()
+			ctx, cancel := context.WithTimeout(
+				context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err = queryer.Query(ctx, "hang", "adb", "ms")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Password and password file are mutually exclusive", func() {
+			_, err := influxCreateDbQueryer(config.Connection{
+				HostAndPort: "http://localhost:8086",
+				Access: config.Access{
+					Password:     "secret",
+					PasswordFile: writeFile(dir, "password", "secret"),
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("TLS with private CA should work", func() {
+			server := httptest.NewTLSServer(handler)
+			defer server.Close()
+			caFile := writeFile(
+				dir,
+				"ca.pem",
+				string(pem.EncodeToMemory(&pem.Block{
+					Type:  "CERTIFICATE",
+					Bytes: server.TLS.Certificates[0].Certificate[0],
+				})))
+			queryer, err := influxCreateDbQueryer(config.Connection{
+				HostAndPort: server.URL,
+				Access:      config.Access{TLS: &config.TLS{CAFile: caFile}},
+			})
+			So(err, ShouldBeNil)
+			defer queryer.Close()
+			response, err := queryer.Query(
+				context.Background(), "select * from alpha", "adb", "ms")
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1000, 10))
+
+			Convey("Without the CA, query should fail", func() {
+				queryer, err := influxCreateDbQueryer(
+					config.Connection{HostAndPort: server.URL})
+				So(err, ShouldBeNil)
+				defer queryer.Close()
+				_, err = queryer.Query(
+					context.Background(), "select * from alpha", "adb", "ms")
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
 }
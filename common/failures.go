@@ -0,0 +1,200 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Level of the messages proxima adds for backends that failed
+	kWarningLevel = "warning"
+	// Names all the influx backends of a configuration in messages
+	kInfluxBackends = "influx backends"
+	// Names all the scotties of a configuration in messages
+	kScotties = "scotties"
+)
+
+// backendError is the error from a backend that proxima left out of the
+// answer to a query.
+type backendError struct {
+	// Names the backend e.g "influx http://host:8086"
+	backend string
+	// What proxima asked the backend. nil if not known.
+	query *influxql.Query
+	err   error
+}
+
+func (e *backendError) Error() string {
+	if timeRange := timeRangeText(e.query); timeRange != "" {
+		return fmt.Sprintf("%s failed for %s: %v", e.backend, timeRange, e.err)
+	}
+	return fmt.Sprintf("%s failed: %v", e.backend, e.err)
+}
+
+// timeRangeText describes the time range of the first select statement in
+// query. If there is no such statement or it has no time range,
+// timeRangeText returns the empty string.
+func timeRangeText(query *influxql.Query) string {
+	if query == nil {
+		return ""
+	}
+	for _, stmt := range query.Statements {
+		selectStmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			continue
+		}
+		min, max, err := influxql.TimeRange(selectStmt.Condition)
+		if err != nil {
+			return ""
+		}
+		var parts []string
+		if !min.IsZero() {
+			parts = append(parts, "time >= "+min.Format(time.RFC3339))
+		}
+		if !max.IsZero() {
+			// TimeRange makes max inclusive.
+			parts = append(
+				parts,
+				"time < "+max.Add(time.Nanosecond).Format(time.RFC3339))
+		}
+		return strings.Join(parts, " AND ")
+	}
+	return ""
+}
+
+// firstError returns err if non-nil; otherwise it returns the error
+// in response.
+func firstError(err error, response *client.Response) error {
+	if err != nil {
+		return err
+	}
+	return response.Error()
+}
+
+// backendName names endpoint for error messages.
+func backendName(endpoint queryerType) string {
+	if stringer, ok := endpoint.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return "backend"
+}
+
+// failuresKeyType is the key of the failuresType in a context.
+type failuresKeyType struct{}
+
+// failuresType collects the errors of the backends that proxima left out
+// of the answer to a query.
+type failuresType struct {
+	lock sync.Mutex
+	errs []error
+}
+
+// withFailures returns a context like ctx that collects the errors of the
+// backends left out of the answer to a query.
+func withFailures(ctx context.Context) (context.Context, *failuresType) {
+	failures := &failuresType{}
+	return context.WithValue(ctx, failuresKeyType{}, failures), failures
+}
+
+// isUnsupported returns true if err means that a backend can't translate
+// a query. Such a backend was never asked, so it didn't fail.
+func isUnsupported(err error) bool {
+	return err == qlutils.ErrUnsupported
+}
+
+// recordFailure records that proxima left the backend that gave err out
+// of the answer to the query of ctx. If ctx doesn't collect failures,
+// recordFailure does nothing.
+func recordFailure(ctx context.Context, err error) {
+	failures, ok := ctx.Value(failuresKeyType{}).(*failuresType)
+	if !ok {
+		return
+	}
+	failures.lock.Lock()
+	defer failures.lock.Unlock()
+	failures.errs = append(failures.errs, err)
+}
+
+// Err returns an error if mode is config.PartialFailuresStrict and a
+// backend failed; otherwise Err returns nil.
+func (f *failuresType) Err(mode string) error {
+	if mode != config.PartialFailuresStrict {
+		return nil
+	}
+	messages := f.Messages()
+	if len(messages) == 0 {
+		return nil
+	}
+	texts := make([]string, len(messages))
+	for i := range messages {
+		texts[i] = messages[i].Text
+	}
+	return errors.New(strings.Join(texts, "; "))
+}
+
+// Messages returns a warning message for each backend that failed.
+func (f *failuresType) Messages() []*client.Message {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := make([]*client.Message, len(f.errs))
+	for i := range result {
+		result[i] = &client.Message{
+			Level: kWarningLevel,
+			Text:  f.errs[i].Error(),
+		}
+	}
+	return result
+}
+
+// Apply returns response as mode says given the backends that failed.
+// With config.PartialFailuresWarn, Apply returns a copy of response where
+// each result carries a warning message for each backend that failed.
+// With config.PartialFailuresStrict, Apply returns an error if any
+// backend failed.
+func (f *failuresType) Apply(response *client.Response, mode string) (
+	*client.Response, error) {
+	if err := f.Err(mode); err != nil {
+		return nil, err
+	}
+	if mode != config.PartialFailuresWarn {
+		return response, nil
+	}
+	messages := f.Messages()
+	if len(messages) == 0 {
+		return response, nil
+	}
+	result := *response
+	result.Results = make([]client.Result, len(response.Results))
+	copy(result.Results, response.Results)
+	if len(result.Results) == 0 {
+		result.Results = []client.Result{{}}
+	}
+	for i := range result.Results {
+		result.Results[i].Messages = append(
+			append([]*client.Message(nil), result.Results[i].Messages...),
+			messages...)
+	}
+	return &result, nil
+}
+
+// Write writes a warning message to w for each backend that failed if
+// mode is config.PartialFailuresWarn.
+func (f *failuresType) Write(w RowWriter, mode string) error {
+	if mode != config.PartialFailuresWarn {
+		return nil
+	}
+	for _, message := range f.Messages() {
+		if err := w.WriteMessage(message.Level, message.Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
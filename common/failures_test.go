@@ -0,0 +1,247 @@
+package common
+
+import (
+	"context"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestPartialFailures(t *testing.T) {
+	now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+	query, err := qlutils.NewQuery(
+		"select mean(value) from dual where time >= now() - 1h", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warning := "scotty bravo failed for time >= 2016-11-30T23:01:00Z: " +
+		kErrSomeError.Error()
+
+	newDb := func(mode string) (*Database, dbQueryerStoreType, error) {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		store["bravo"].WhenQueriedReturn(nil, kErrSomeError)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "partial",
+				Scotties: config.ScottyList{
+					{HostAndPort: "alpha"},
+					{HostAndPort: "bravo"},
+				},
+				PartialFailures: mode,
+			},
+			store.Create)
+		return db, store, err
+	}
+
+	Convey("By default failed backends should be left out silently", t, func() {
+		db, _, err := newDb("")
+		So(err, ShouldBeNil)
+		defer db.Close()
+		response, err := db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, newResponse(1000, 10))
+	})
+
+	Convey("Warn should add a warning naming the failed backend", t, func() {
+		db, _, err := newDb(config.PartialFailuresWarn)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		response, err := db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		expected := newResponse(1000, 10)
+		expected.Results[0].Messages = []*client.Message{
+			{Level: "warning", Text: warning},
+		}
+		So(response, ShouldResemble, expected)
+
+		Convey("And streamed results should carry it too", func() {
+			var recorder rowRecorderType
+			err := db.QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				newResponse(1000, 10).Results[0].Series,
+			})
+			So(recorder.messages, ShouldResemble, []string{
+				"warning: " + warning,
+			})
+		})
+	})
+
+	Convey("Warn should add nothing when every backend answers", t, func() {
+		db, store, err := newDb(config.PartialFailuresWarn)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		store["bravo"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		response, err := db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, newResponse(1000, 10))
+	})
+
+	Convey("Strict should fail the query", t, func() {
+		db, _, err := newDb(config.PartialFailuresStrict)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		_, err = db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, warning)
+
+		Convey("Before streaming any rows", func() {
+			var recorder rowRecorderType
+			err := db.QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldNotBeNil)
+			So(recorder.current, ShouldBeEmpty)
+			So(recorder.statements, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Failure of a whole side should name that side", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		store["bravo"].WhenQueriedReturn(nil, kErrSomeError)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "sides",
+				Influxes: config.InfluxList{
+					{
+						HostAndPort: "alpha",
+						Database:    "a",
+						Duration:    24 * time.Hour,
+					},
+				},
+				Scotties: config.ScottyList{
+					{HostAndPort: "bravo"},
+				},
+				PartialFailures: config.PartialFailuresStrict,
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		_, err = db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "scotties failed for time >= ")
+	})
+
+	Convey("SHOW statements should skip tiers that aren't influx", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"tsdb":  &fakeDbQueryerType{},
+		}
+		measurements := &client.Response{
+			Results: []client.Result{
+				{
+					Series: []models.Row{
+						{
+							Name:    "measurements",
+							Columns: []string{"name"},
+							Values:  [][]interface{}{{"cpu"}},
+						},
+					},
+				},
+			},
+		}
+		store["alpha"].WhenQueriedReturn(measurements, nil)
+		store["tsdb"].WhenQueriedReturn(nil, qlutils.ErrUnsupported)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "tiers",
+				Influxes: config.InfluxList{
+					{
+						HostAndPort: "alpha",
+						Database:    "a",
+						Duration:    24 * time.Hour,
+					},
+				},
+				OpenTSDBs: config.OpenTSDBList{
+					{HostAndPort: "tsdb", Duration: time.Hour},
+				},
+				PartialFailures: config.PartialFailuresStrict,
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		showQuery, err := qlutils.NewQuery("show measurements", now)
+		So(err, ShouldBeNil)
+		response, err := db.Query(
+			context.Background(), showQuery, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, measurements)
+		So(store["tsdb"].NoMoreQueries(), ShouldBeTrue)
+
+		Convey("And streamed results should skip them too", func() {
+			var recorder rowRecorderType
+			err := db.QueryStream(
+				context.Background(), showQuery, "ms", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				measurements.Results[0].Series,
+			})
+			So(store["tsdb"].NoMoreQueries(), ShouldBeTrue)
+		})
+	})
+
+	Convey("Tiers that can't translate a query haven't failed", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"tsdb":  &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		store["tsdb"].WhenQueriedReturn(nil, qlutils.ErrUnsupported)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "tiers",
+				Influxes: config.InfluxList{
+					{
+						HostAndPort: "alpha",
+						Database:    "a",
+						Duration:    24 * time.Hour,
+					},
+				},
+				OpenTSDBs: config.OpenTSDBList{
+					{HostAndPort: "tsdb", Duration: time.Hour},
+				},
+				PartialFailures: config.PartialFailuresStrict,
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		response, err := db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, newResponse(1000, 10))
+
+		Convey("And streamed results should succeed too", func() {
+			var recorder rowRecorderType
+			err := db.QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				newResponse(1000, 10).Results[0].Series,
+			})
+			So(recorder.messages, ShouldBeEmpty)
+		})
+
+		Convey("But a query no tier can translate should fail", func() {
+			store["alpha"].WhenQueriedReturn(nil, qlutils.ErrUnsupported)
+			_, err := db.Query(
+				context.Background(), query, "ms", now, nil)
+			So(err, ShouldEqual, qlutils.ErrUnsupported)
+		})
+	})
+
+	Convey("Unknown partial failures modes should be rejected", t, func() {
+		_, _, err := newDb("bogus")
+		So(err, ShouldNotBeNil)
+	})
+}
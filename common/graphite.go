@@ -0,0 +1,443 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kGraphiteDefaultTemplate = "{measurement}.{field}"
+)
+
+// graphiteTemplateType maps measurements, fields, and tags onto graphite
+// paths. A template is a graphite path where nodes of the form {name} stand
+// for the tag called name. The special nodes {measurement} and {field}
+// stand for the measurement and the field.
+type graphiteTemplateType struct {
+	nodes []string
+}
+
+func newGraphiteTemplate(template string) (*graphiteTemplateType, error) {
+	if template == "" {
+		template = kGraphiteDefaultTemplate
+	}
+	result := &graphiteTemplateType{nodes: strings.Split(template, ".")}
+	hasMeasurement := false
+	for _, node := range result.nodes {
+		if node == "{measurement}" {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf(
+			"Graphite template %s must contain {measurement}", template)
+	}
+	return result, nil
+}
+
+// tagName returns the tag name if node is a tag placeholder.
+func tagName(node string) (string, bool) {
+	if !strings.HasPrefix(node, "{") || !strings.HasSuffix(node, "}") {
+		return "", false
+	}
+	name := node[1 : len(node)-1]
+	if name == "measurement" || name == "field" {
+		return "", false
+	}
+	return name, true
+}
+
+// HasTag returns true if this template has a node for the named tag.
+func (t *graphiteTemplateType) HasTag(name string) bool {
+	for _, node := range t.nodes {
+		if tag, ok := tagName(node); ok && tag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolved returns the nodes of this template with the measurement and
+// field filled in. The measurement and field may themselves contain dots.
+func (t *graphiteTemplateType) resolved(measurement, field string) []string {
+	var result []string
+	for _, node := range t.nodes {
+		switch node {
+		case "{measurement}":
+			result = append(result, strings.Split(measurement, ".")...)
+		case "{field}":
+			result = append(result, strings.Split(field, ".")...)
+		default:
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// Path returns the graphite path pattern for measurement and field.
+// patterns has the pattern for each tag; tags missing from patterns match
+// anything.
+func (t *graphiteTemplateType) Path(
+	measurement, field string, patterns map[string]string) string {
+	nodes := t.resolved(measurement, field)
+	for i, node := range nodes {
+		if tag, ok := tagName(node); ok {
+			if pattern, ok := patterns[tag]; ok {
+				nodes[i] = pattern
+			} else {
+				nodes[i] = "*"
+			}
+		}
+	}
+	return strings.Join(nodes, ".")
+}
+
+// Tags returns the tags in path, which graphite returned, for the given
+// measurement and field. Tags returns false if path does not match this
+// template.
+func (t *graphiteTemplateType) Tags(
+	measurement, field, path string) (map[string]string, bool) {
+	nodes := t.resolved(measurement, field)
+	pathNodes := strings.Split(path, ".")
+	if len(nodes) != len(pathNodes) {
+		return nil, false
+	}
+	result := make(map[string]string)
+	for i, node := range nodes {
+		if tag, ok := tagName(node); ok {
+			result[tag] = pathNodes[i]
+		} else if node != pathNodes[i] {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+// kGraphiteSpecialChars are the characters that graphite treats specially
+// in a path pattern. Graphite has no way to escape them.
+const kGraphiteSpecialChars = ".*?[]{},"
+
+// graphitePatterns returns the graphite pattern for each tag with an EQ
+// filter. If a value in an EQ filter has characters that graphite treats
+// specially, the tag gets no pattern so that it matches anything and
+// matchesFilters does the filtering instead.
+func graphitePatterns(
+	stmt *simpleSelectType,
+	template *graphiteTemplateType) (map[string]string, error) {
+	for _, key := range stmt.GroupByTags {
+		if !template.HasTag(key) {
+			return nil, qlutils.ErrUnsupported
+		}
+	}
+	result := make(map[string]string)
+	for _, filter := range stmt.Filters {
+		if !template.HasTag(filter.Key) {
+			return nil, qlutils.ErrUnsupported
+		}
+		if filter.Op != influxql.EQ || hasGraphiteSpecialChars(filter.Values) {
+			// We filter these ourselves
+			continue
+		}
+		if len(filter.Values) == 1 {
+			result[filter.Key] = filter.Values[0]
+		} else {
+			result[filter.Key] = "{" + strings.Join(filter.Values, ",") + "}"
+		}
+	}
+	return result, nil
+}
+
+// hasGraphiteSpecialChars returns true if any of values has characters
+// that graphite treats specially in a path pattern.
+func hasGraphiteSpecialChars(values []string) bool {
+	for _, value := range values {
+		if strings.ContainsAny(value, kGraphiteSpecialChars) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFilters returns true if tags match all the filters in stmt.
+func matchesFilters(stmt *simpleSelectType, tags map[string]string) bool {
+	for _, filter := range stmt.Filters {
+		value := tags[filter.Key]
+		switch filter.Op {
+		case influxql.EQ, influxql.NEQ:
+			found := false
+			for _, v := range filter.Values {
+				if v == value {
+					found = true
+					break
+				}
+			}
+			if found != (filter.Op == influxql.EQ) {
+				return false
+			}
+		case influxql.EQREGEX:
+			if !filter.Regex.MatchString(value) {
+				return false
+			}
+		case influxql.NEQREGEX:
+			if filter.Regex.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// graphiteBucketType aggregates the values within a single time bucket
+type graphiteBucketType struct {
+	count           int
+	sum, min, max   float64
+	first, last     float64
+	firstTs, lastTs int64
+}
+
+func (b *graphiteBucketType) Add(t int64, value float64) {
+	if b.count == 0 || value < b.min {
+		b.min = value
+	}
+	if b.count == 0 || value > b.max {
+		b.max = value
+	}
+	if b.count == 0 || t < b.firstTs {
+		b.first, b.firstTs = value, t
+	}
+	if b.count == 0 || t >= b.lastTs {
+		b.last, b.lastTs = value, t
+	}
+	b.count++
+	b.sum += value
+}
+
+func (b *graphiteBucketType) Value(aggregate string) interface{} {
+	var result float64
+	switch aggregate {
+	case "mean":
+		result = b.sum / float64(b.count)
+	case "sum":
+		result = b.sum
+	case "count":
+		return json.Number(strconv.Itoa(b.count))
+	case "min":
+		result = b.min
+	case "max":
+		result = b.max
+	case "first":
+		result = b.first
+	case "last":
+		result = b.last
+	}
+	return json.Number(strconv.FormatFloat(result, 'f', -1, 64))
+}
+
+var (
+	kGraphiteAggregates = map[string]bool{
+		"mean":  true,
+		"sum":   true,
+		"count": true,
+		"min":   true,
+		"max":   true,
+		"first": true,
+		"last":  true,
+	}
+)
+
+// graphiteSeriesType is a single series from /render?format=json.
+type graphiteSeriesType struct {
+	Target string `json:"target"`
+	// Each datapoint is [value, seconds since epoch]
+	Datapoints [][]interface{} `json:"datapoints"`
+}
+
+// graphiteQueryerType is a dbQueryerType that translates influxql into
+// graphite render API calls.
+type graphiteQueryerType struct {
+	*httpEndpointType
+	template *graphiteTemplateType
+}
+
+func graphiteCreateDbQueryer(conn config.Connection, templateStr string) (
+	dbQueryerType, error) {
+	template, err := newGraphiteTemplate(templateStr)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := newHTTPEndpoint(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &graphiteQueryerType{
+		httpEndpointType: endpoint,
+		template:         template,
+	}, nil
+}
+
+// Ping checks that graphite is up. graphite has no /ping so Ping asks for
+// its version.
+func (q *graphiteQueryerType) Ping(ctx context.Context) error {
+	return q.ping(ctx, "version")
+}
+
+func (q *graphiteQueryerType) render(
+	ctx context.Context, target string, min, max time.Time) (
+	[]graphiteSeriesType, error) {
+	params := url.Values{}
+	params.Set("target", target)
+	params.Set("format", "json")
+	params.Set("from", strconv.FormatInt(min.Unix(), 10))
+	params.Set("until", strconv.FormatInt(max.Unix(), 10))
+	resp, err := q.Do(ctx, "GET", "render", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusErrorf(
+			resp.StatusCode,
+			"received status code %d from server", resp.StatusCode)
+	}
+	var result []graphiteSeriesType
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+var (
+	errBadDatapoint = errors.New("Bad datapoint from graphite")
+)
+
+// datapoint returns the time in nanoseconds and the value of a graphite
+// datapoint. datapoint returns false for the value if it is null.
+func datapoint(point []interface{}) (
+	t int64, value float64, ok bool, err error) {
+	if len(point) != 2 {
+		return 0, 0, false, errBadDatapoint
+	}
+	ts, isNumber := point[1].(json.Number)
+	if !isNumber {
+		return 0, 0, false, errBadDatapoint
+	}
+	seconds, err := ts.Int64()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	t = seconds * int64(time.Second)
+	if point[0] == nil {
+		return t, 0, false, nil
+	}
+	number, isNumber := point[0].(json.Number)
+	if !isNumber {
+		return 0, 0, false, errBadDatapoint
+	}
+	if value, err = number.Float64(); err != nil {
+		return 0, 0, false, err
+	}
+	return t, value, true, nil
+}
+
+// Query runs queryStr, which must be a simple select statement, against
+// graphite. Graphite has no databases so database is ignored. Proxima
+// aggregates the raw graphite values itself.
+func (q *graphiteQueryerType) Query(
+	ctx context.Context, queryStr, database, epoch string) (
+	*client.Response, error) {
+	stmt, err := parseSimpleSelect(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.Min.IsZero() || stmt.Max.IsZero() {
+		return nil, qlutils.ErrUnsupported
+	}
+	patterns, err := graphitePatterns(stmt, q.template)
+	if err != nil {
+		return nil, err
+	}
+	min, max := stmt.Min.UnixNano(), stmt.Max.UnixNano()
+	interval := int64(stmt.Interval)
+	builder := newSeriesBuilder(stmt, epoch)
+	for i, field := range stmt.Fields {
+		if field.Aggregate != "" && !kGraphiteAggregates[field.Aggregate] {
+			return nil, qlutils.ErrUnsupported
+		}
+		seriesList, err := q.render(
+			ctx,
+			q.template.Path(stmt.Measurement, field.Name, patterns),
+			stmt.Min,
+			stmt.Max)
+		if err != nil {
+			return nil, err
+		}
+		// buckets[group key][bucket start]
+		buckets := make(map[string]map[int64]*graphiteBucketType)
+		groupTags := make(map[string]map[string]string)
+		for _, series := range seriesList {
+			tags, ok := q.template.Tags(
+				stmt.Measurement, field.Name, series.Target)
+			if !ok || !matchesFilters(stmt, tags) {
+				continue
+			}
+			for _, point := range series.Datapoints {
+				t, value, ok, err := datapoint(point)
+				if err != nil {
+					return nil, err
+				}
+				if !ok || t < min || t > max {
+					continue
+				}
+				if field.Aggregate == "" {
+					builder.Add(tags, i, t, json.Number(
+						strconv.FormatFloat(value, 'f', -1, 64)))
+					continue
+				}
+				// Without GROUP BY time, influx reports the start time
+				bucketTime := min
+				if interval > 0 {
+					bucketTime = t - t%interval
+				}
+				key := groupKey(stmt.GroupByTags, tags)
+				if buckets[key] == nil {
+					buckets[key] = make(map[int64]*graphiteBucketType)
+					groupTags[key] = tags
+				}
+				bucket := buckets[key][bucketTime]
+				if bucket == nil {
+					bucket = &graphiteBucketType{}
+					buckets[key][bucketTime] = bucket
+				}
+				bucket.Add(t, value)
+			}
+		}
+		for key, byTime := range buckets {
+			for t, bucket := range byTime {
+				builder.Add(groupTags[key], i, t, bucket.Value(field.Aggregate))
+			}
+		}
+	}
+	return builder.Response(), nil
+}
+
+// groupKey returns the key of the group that tags belong to.
+func groupKey(groupByTags []string, tags map[string]string) string {
+	parts := make([]string, len(groupByTags))
+	for i, key := range groupByTags {
+		parts[i] = tags[key]
+	}
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,196 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGraphite(t *testing.T) {
+	Convey("Given a fake graphite server", t, func() {
+		var lastPath string
+		var lastParams url.Values
+		responseBody := "[]"
+		statusCode := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				lastPath = r.URL.Path
+				lastParams = r.URL.Query()
+				w.WriteHeader(statusCode)
+				fmt.Fprintln(w, responseBody)
+			}))
+		defer server.Close()
+		queryer, err := graphiteCreateDbQueryer(
+			config.Connection{HostAndPort: server.URL},
+			"servers.{region}.{host}.{measurement}.{field}")
+		So(err, ShouldBeNil)
+		defer queryer.Close()
+
+		Convey("Aggregate queries should aggregate in proxima", func() {
+			responseBody = `[
+{"target":"servers.us.a.cpu.idle","datapoints":[[1,1490000040],[3,1490000070],[null,1490000100],[5,1490000110]]},
+{"target":"servers.us.b.cpu.idle","datapoints":[[2,1490000040]]},
+{"target":"servers.us.c.cpu.idle","datapoints":[[100,1490000040]]}
+]`
+			response, err := queryer.Query(
+				context.Background(),
+				"select mean(idle), count(idle) from cpu where region = 'us' and host !~ /c/ and time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m) fill(none)",
+				"",
+				"s")
+			So(err, ShouldBeNil)
+			So(lastPath, ShouldEqual, "/render")
+			So(lastParams.Get("target"), ShouldEqual, "servers.us.*.cpu.idle")
+			So(lastParams.Get("format"), ShouldEqual, "json")
+			So(lastParams.Get("from"), ShouldEqual, "1490000040")
+			So(lastParams.Get("until"), ShouldEqual, "1490000159")
+			So(response, ShouldResemble, &client.Response{
+				Results: []client.Result{
+					{
+						Series: []models.Row{
+							{
+								Name:    "cpu",
+								Columns: []string{"time", "mean", "count"},
+								Values: [][]interface{}{
+									{json.Number("1490000040"), json.Number("2"), json.Number("3")},
+									{json.Number("1490000100"), json.Number("5"), json.Number("1")},
+								},
+							},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("Raw queries should return tags from paths", func() {
+			responseBody = `[
+{"target":"servers.eu.a.cpu.value","datapoints":[[1.5,1490000040]]},
+{"target":"servers.us.b.cpu.value","datapoints":[[2.5,1490000050]]}
+]`
+			response, err := queryer.Query(
+				context.Background(),
+				"select value from cpu where (host = 'a' or host = 'b') and time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by region",
+				"",
+				"ms")
+			So(err, ShouldBeNil)
+			So(lastParams.Get("target"), ShouldEqual, "servers.*.{a,b}.cpu.value")
+			So(response, ShouldResemble, &client.Response{
+				Results: []client.Result{
+					{
+						Series: []models.Row{
+							{
+								Name:    "cpu",
+								Tags:    map[string]string{"region": "eu"},
+								Columns: []string{"time", "value"},
+								Values: [][]interface{}{
+									{json.Number("1490000040000"), json.Number("1.5")},
+								},
+							},
+							{
+								Name:    "cpu",
+								Tags:    map[string]string{"region": "us"},
+								Columns: []string{"time", "value"},
+								Values: [][]interface{}{
+									{json.Number("1490000050000"), json.Number("2.5")},
+								},
+							},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("Tag values with graphite special characters should match literally", func() {
+			responseBody = `[
+{"target":"servers.us.a.cpu.value","datapoints":[[1.5,1490000040]]},
+{"target":"servers.us.b.cpu.value","datapoints":[[2.5,1490000050]]}
+]`
+			response, err := queryer.Query(
+				context.Background(),
+				"select value from cpu where (host = '*' or host = 'a.b') and region = 'us' and time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z'",
+				"",
+				"ms")
+			So(err, ShouldBeNil)
+			So(lastParams.Get("target"), ShouldEqual, "servers.us.*.cpu.value")
+			So(response, ShouldResemble, &client.Response{
+				Results: []client.Result{{}},
+			})
+		})
+
+		Convey("Errors should be reported", func() {
+			statusCode = http.StatusInternalServerError
+			_, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m)",
+				"",
+				"s")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tags missing from the template should be unsupported", func() {
+			_, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where dc = 'x' and time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z'",
+				"",
+				"s")
+			So(err, ShouldEqual, qlutils.ErrUnsupported)
+			_, err = queryer.Query(
+				context.Background(),
+				"select median(value) from cpu where time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z'",
+				"",
+				"s")
+			So(err, ShouldEqual, qlutils.ErrUnsupported)
+		})
+	})
+
+	Convey("Templates must have a measurement", t, func() {
+		_, err := graphiteCreateDbQueryer(
+			config.Connection{HostAndPort: "http://graphite"}, "a.{host}")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given influx and graphite backends", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha":    &fakeDbQueryerType{},
+			"graphite": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10, 1200, 11), nil)
+		store["graphite"].WhenQueriedReturn(newResponse(1200, 12, 1400, 13), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "tiers",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a", Duration: 100 * time.Hour},
+				},
+				Graphites: config.GraphiteList{
+					{HostAndPort: "graphite", Duration: 10 * time.Hour},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+
+		Convey("Graphite should take part in splitting by time", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from alpha where time >= now() - 50h group by time(1m)",
+				now)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(
+				1000, 10, 1200, 12, 1400, 13))
+			queryStr, _, _ := store["graphite"].NextQuery()
+			So(queryStr, ShouldEqual, "SELECT mean(value) FROM alpha WHERE time >= '2016-11-30T14:01:00Z' AND time < '2016-12-01T00:01:00Z' GROUP BY time(1m)")
+		})
+	})
+}
@@ -0,0 +1,292 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/proxima/config"
+	"github.com/influxdata/influxdb/client/v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How many failures in a row open a backend's circuit breaker
+	kBreakerFailures = 3
+	// How long an open circuit breaker waits before letting a probe
+	// query through
+	kBreakerCooldown = 30 * time.Second
+	// How often proxima pings each backend
+	kHealthCheckInterval = 10 * time.Second
+	// How long proxima waits for a ping
+	kPingTimeout = 5 * time.Second
+)
+
+// pingerType is implemented by dbQueryerType instances that can check
+// whether their backend is up without running a query.
+type pingerType interface {
+	Ping(ctx context.Context) error
+}
+
+// ping checks that this endpoint is up by sending a GET to path.
+func (e *httpEndpointType) ping(ctx context.Context, path string) error {
+	resp, err := e.Do(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf(
+			"received status code %d from %s", resp.StatusCode, path)
+	}
+	return nil
+}
+
+func (q *influxQueryerType) Ping(ctx context.Context) error {
+	return q.ping(ctx, "ping")
+}
+
+// backendDownError is the error for queries that proxima skips because
+// the circuit breaker of their backend is open.
+type backendDownError struct {
+	hostAndPort string
+	// Why the circuit breaker opened
+	err error
+}
+
+func (e *backendDownError) Error() string {
+	return fmt.Sprintf("%s is down: %v", e.hostAndPort, e.err)
+}
+
+// logError logs err unless it is from skipping a backend that is down.
+// Errors from such backends were logged when their circuit breakers
+// opened.
+func logError(logger log.Logger, err error) {
+	if logger == nil {
+		return
+	}
+	if _, ok := err.(*backendDownError); ok {
+		return
+	}
+	logger.Println(err)
+}
+
+// backendType wraps a dbQueryerType with a circuit breaker and a health
+// checker. After kBreakerFailures failures in a row, the circuit breaker
+// opens and queries fail without reaching the backend. Once the backend
+// answers a ping or kBreakerCooldown passes, the circuit breaker goes
+// half open and lets a single probe query through. If the probe succeeds,
+// the circuit breaker closes; otherwise it opens again.
+type backendType struct {
+	dbQueryerType
+	kind        string
+	hostAndPort string
+	done        chan struct{}
+	closeOnce   sync.Once
+	lock        sync.Mutex
+	state       string
+	since       time.Time
+	failures    int
+	lastErr     error
+	// true if a probe query is outstanding
+	probing bool
+}
+
+// newBackend returns dbQueryer wrapped with a circuit breaker. If
+// dbQueryer can be pinged, newBackend also starts a goroutine that
+// pings it every kHealthCheckInterval until Close is called.
+func newBackend(
+	kind string, conn config.Connection, dbQueryer dbQueryerType) *backendType {
+	result := &backendType{
+		dbQueryerType: dbQueryer,
+		kind:          kind,
+		hostAndPort:   conn.HostAndPort,
+		done:          make(chan struct{}),
+		state:         BreakerClosed,
+		since:         time.Now(),
+	}
+	if pinger, ok := dbQueryer.(pingerType); ok {
+		go result.healthCheckLoop(pinger)
+	}
+	return result
+}
+
+// withHealthChecks returns a creater that works like creater except that
+// it wraps each dbQueryerType with a circuit breaker and adds it to
+// backends.
+func withHealthChecks(
+	creater dbQueryerCreaterType,
+	backends *[]*backendType) dbQueryerCreaterType {
+	return func(kind string, conn config.Connection, template string) (
+		dbQueryerType, error) {
+		dbQueryer, err := creater(kind, conn, template)
+		if err != nil {
+			return nil, err
+		}
+		backend := newBackend(kind, conn, dbQueryer)
+		*backends = append(*backends, backend)
+		return backend, nil
+	}
+}
+
+func (b *backendType) healthCheckLoop(pinger pingerType) {
+	ticker := time.NewTicker(kHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.check(pinger)
+		}
+	}
+}
+
+// check pings the backend once. A failed ping counts as a failure. A
+// successful ping lets a probe query through an open circuit breaker.
+func (b *backendType) check(pinger pingerType) {
+	ctx, cancel := context.WithTimeout(context.Background(), kPingTimeout)
+	defer cancel()
+	err := pinger.Ping(ctx)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err != nil {
+		b.fail(err, time.Now())
+	} else if b.state == BreakerOpen {
+		b.setState(BreakerHalfOpen, time.Now())
+	}
+}
+
+// allow returns nil if a query may go to the backend now. Caller must
+// call record with the outcome of the query.
+func (b *backendType) allow(now time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen {
+		if now.Sub(b.since) < kBreakerCooldown {
+			return &backendDownError{hostAndPort: b.hostAndPort, err: b.lastErr}
+		}
+		b.setState(BreakerHalfOpen, now)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probing {
+			return &backendDownError{hostAndPort: b.hostAndPort, err: b.lastErr}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// isBackendFailure returns true if err means that the backend is down or
+// broken: it couldn't be reached, it timed out, or it answered with a 5xx
+// status code. Errors about the query itself such as
+// qlutils.ErrUnsupported or a 4xx status code return false.
+func isBackendFailure(err error) bool {
+	switch e := err.(type) {
+	case *statusError:
+		return e.statusCode >= 500
+	case net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded || err == io.ErrUnexpectedEOF
+}
+
+// record records the outcome of a query that allow let through. Only
+// errors for which isBackendFailure returns true count as failures.
+// Queries that fail because their caller gave up don't count.
+func (b *backendType) record(ctx context.Context, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+	if err != nil && ctx.Err() == context.Canceled {
+		return
+	}
+	if err != nil {
+		if isBackendFailure(err) {
+			b.fail(err, time.Now())
+		}
+		return
+	}
+	b.failures = 0
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed, time.Now())
+	}
+}
+
+func (b *backendType) fail(err error, now time.Time) {
+	b.failures++
+	b.lastErr = err
+	if b.state == BreakerOpen {
+		return
+	}
+	if b.state == BreakerHalfOpen || b.failures >= kBreakerFailures {
+		b.setState(BreakerOpen, now)
+	}
+}
+
+func (b *backendType) setState(state string, now time.Time) {
+	b.state = state
+	b.since = now
+}
+
+func (b *backendType) Query(
+	ctx context.Context, queryStr, database, epoch string) (
+	*client.Response, error) {
+	if err := b.allow(time.Now()); err != nil {
+		return nil, err
+	}
+	response, err := b.dbQueryerType.Query(ctx, queryStr, database, epoch)
+	b.record(ctx, err)
+	return response, err
+}
+
+func (b *backendType) QueryStream(
+	ctx context.Context,
+	queryStr, database, epoch string,
+	chunkSize int) (rowStreamType, error) {
+	if err := b.allow(time.Now()); err != nil {
+		return nil, err
+	}
+	stream, err := dbQueryStream(
+		ctx, b.dbQueryerType, queryStr, database, epoch, chunkSize)
+	b.record(ctx, err)
+	return stream, err
+}
+
+// Close stops health checks and closes the backend. Only the first call
+// does anything.
+func (b *backendType) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		err = b.dbQueryerType.Close()
+	})
+	return err
+}
+
+// closeBackends closes each backend in backends.
+func closeBackends(backends []*backendType) {
+	for _, b := range backends {
+		b.Close()
+	}
+}
+
+func (b *backendType) health() BackendHealth {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result := BackendHealth{
+		Kind:                b.kind,
+		HostAndPort:         b.hostAndPort,
+		State:               b.state,
+		Since:               b.since,
+		ConsecutiveFailures: b.failures,
+	}
+	if b.lastErr != nil {
+		result.LastError = b.lastErr.Error()
+	}
+	return result
+}
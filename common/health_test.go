@@ -0,0 +1,204 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	kErrConnRefused = &net.OpError{
+		Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+)
+
+// fakePingerType is a pingerType that returns err.
+type fakePingerType struct {
+	err error
+}
+
+func (f *fakePingerType) Ping(ctx context.Context) error {
+	return f.err
+}
+
+func TestHealth(t *testing.T) {
+	Convey("Given a backend that fails", t, func() {
+		fake := &fakeDbQueryerType{}
+		fake.WhenQueriedReturn(nil, kErrConnRefused)
+		backend := newBackend(
+			kInflux, config.Connection{HostAndPort: "alpha"}, fake)
+		defer backend.Close()
+		for i := 0; i < kBreakerFailures; i++ {
+			_, err := backend.Query(
+				context.Background(), "select * from dual", "db", "ms")
+			So(err, ShouldEqual, kErrConnRefused)
+			fake.NextQuery()
+		}
+
+		Convey("Consecutive failures should open the breaker", func() {
+			health := backend.health()
+			So(health.State, ShouldEqual, BreakerOpen)
+			So(health.ConsecutiveFailures, ShouldEqual, kBreakerFailures)
+			So(health.LastError, ShouldEqual, kErrConnRefused.Error())
+			_, err := backend.Query(
+				context.Background(), "select * from dual", "db", "ms")
+			So(err, ShouldHaveSameTypeAs, &backendDownError{})
+			So(fake.NoMoreQueries(), ShouldBeTrue)
+		})
+
+		Convey("After cooldown a successful probe should close the breaker", func() {
+			backend.since = time.Now().Add(-kBreakerCooldown)
+			fake.WhenQueriedReturn(newResponse(1000, 10), nil)
+			response, err := backend.Query(
+				context.Background(), "select * from dual", "db", "ms")
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1000, 10))
+			health := backend.health()
+			So(health.State, ShouldEqual, BreakerClosed)
+			So(health.ConsecutiveFailures, ShouldEqual, 0)
+		})
+
+		Convey("After cooldown a failed probe should reopen the breaker", func() {
+			backend.since = time.Now().Add(-kBreakerCooldown)
+			_, err := backend.Query(
+				context.Background(), "select * from dual", "db", "ms")
+			So(err, ShouldEqual, kErrConnRefused)
+			health := backend.health()
+			So(health.State, ShouldEqual, BreakerOpen)
+			So(time.Since(health.Since), ShouldBeLessThan, kBreakerCooldown)
+		})
+
+		Convey("A successful ping should let only one probe through", func() {
+			backend.check(&fakePingerType{})
+			So(backend.health().State, ShouldEqual, BreakerHalfOpen)
+			So(backend.allow(time.Now()), ShouldBeNil)
+			So(backend.allow(time.Now()), ShouldHaveSameTypeAs, &backendDownError{})
+		})
+	})
+
+	Convey("Failed pings should open the breaker", t, func() {
+		backend := newBackend(
+			kInflux, config.Connection{HostAndPort: "alpha"},
+			&fakeDbQueryerType{})
+		defer backend.Close()
+		for i := 0; i < kBreakerFailures; i++ {
+			backend.check(&fakePingerType{err: kErrSomeError})
+		}
+		So(backend.health().State, ShouldEqual, BreakerOpen)
+	})
+
+	Convey("Only transport errors and 5xx responses should count", t, func() {
+		fake := &fakeDbQueryerType{}
+		backend := newBackend(
+			kInflux, config.Connection{HostAndPort: "alpha"}, fake)
+		defer backend.Close()
+		for _, err := range []error{
+			qlutils.ErrUnsupported,
+			statusErrorf(http.StatusBadRequest, "bad query"),
+			kErrSomeError,
+		} {
+			fake.WhenQueriedReturn(nil, err)
+			for i := 0; i < kBreakerFailures; i++ {
+				backend.Query(
+					context.Background(), "select * from dual", "db", "ms")
+				fake.NextQuery()
+			}
+		}
+		So(backend.health().State, ShouldEqual, BreakerClosed)
+		So(backend.health().ConsecutiveFailures, ShouldEqual, 0)
+		fake.WhenQueriedReturn(
+			nil, statusErrorf(http.StatusServiceUnavailable, "unavailable"))
+		for i := 0; i < kBreakerFailures; i++ {
+			backend.Query(
+				context.Background(), "select * from dual", "db", "ms")
+			fake.NextQuery()
+		}
+		So(backend.health().State, ShouldEqual, BreakerOpen)
+	})
+
+	Convey("Influx status codes should reach the breaker", t, func() {
+		var status int
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+		defer server.Close()
+		queryer, err := influxCreateDbQueryer(
+			config.Connection{HostAndPort: server.URL})
+		So(err, ShouldBeNil)
+		defer queryer.Close()
+		status = http.StatusBadRequest
+		_, err = queryer.Query(
+			context.Background(), "select * from dual", "db", "ms")
+		So(isBackendFailure(err), ShouldBeFalse)
+		status = http.StatusInternalServerError
+		_, err = queryer.Query(
+			context.Background(), "select * from dual", "db", "ms")
+		So(isBackendFailure(err), ShouldBeTrue)
+	})
+
+	Convey("Cancelled queries should not count as failures", t, func() {
+		fake := &fakeDbQueryerType{}
+		fake.WhenQueriedHang()
+		backend := newBackend(
+			kInflux, config.Connection{HostAndPort: "alpha"}, fake)
+		defer backend.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := backend.Query(ctx, "select * from dual", "db", "ms")
+		So(err, ShouldNotBeNil)
+		So(backend.health().ConsecutiveFailures, ShouldEqual, 0)
+	})
+
+	Convey("Database should report the health of every backend", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+		}
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "health",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a", Duration: time.Hour},
+				},
+				Scotties: config.ScottyList{
+					{HostAndPort: "bravo"},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		health := db.Health()
+		So(health, ShouldHaveLength, 2)
+		So(health[0].HostAndPort, ShouldEqual, "alpha")
+		So(health[0].State, ShouldEqual, BreakerClosed)
+		So(health[1].HostAndPort, ShouldEqual, "bravo")
+		So(health[1].Kind, ShouldEqual, kInflux)
+	})
+
+	Convey("Influx servers should be pinged with /ping", t, func() {
+		var status int
+		var path string
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.WriteHeader(status)
+			}))
+		defer server.Close()
+		queryer, err := influxCreateDbQueryer(
+			config.Connection{HostAndPort: server.URL})
+		So(err, ShouldBeNil)
+		defer queryer.Close()
+		status = http.StatusNoContent
+		So(queryer.(pingerType).Ping(context.Background()), ShouldBeNil)
+		So(path, ShouldEqual, "/ping")
+		status = http.StatusServiceUnavailable
+		So(queryer.(pingerType).Ping(context.Background()), ShouldNotBeNil)
+	})
+}
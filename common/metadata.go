@@ -0,0 +1,331 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataLimitsType represents the LIMIT, OFFSET, SLIMIT, and SOFFSET
+// clauses of a SHOW statement. proxima applies these after merging the
+// results from all the backends.
+type metadataLimitsType struct {
+	// Applies to the values within each row.
+	Limit  int
+	Offset int
+	// Applies to the rows.
+	SLimit  int
+	SOffset int
+}
+
+// isMetadataStatement returns true if stmt is a SHOW statement that proxima
+// sends to every backend.
+func isMetadataStatement(stmt influxql.Statement) bool {
+	switch stmt.(type) {
+	case *influxql.ShowMeasurementsStatement,
+		*influxql.ShowTagKeysStatement,
+		*influxql.ShowTagValuesStatement,
+		*influxql.ShowFieldKeysStatement,
+		*influxql.ShowSeriesStatement:
+		return true
+	}
+	return false
+}
+
+// isMetadataQuery returns true if query consists only of SHOW statements
+// that proxima sends to every backend.
+func isMetadataQuery(query *influxql.Query) bool {
+	if len(query.Statements) == 0 {
+		return false
+	}
+	for _, stmt := range query.Statements {
+		if !isMetadataStatement(stmt) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMetadataStatement returns true if query has at least one SHOW statement
+// that proxima sends to every backend.
+func hasMetadataStatement(query *influxql.Query) bool {
+	for _, stmt := range query.Statements {
+		if isMetadataStatement(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendMetadataStatement returns the statement to send to each backend
+// along with the limits that proxima must apply after merging. The returned
+// statement has no limits and no database as each backend has its own
+// database.
+func backendMetadataStatement(stmt influxql.Statement) (
+	influxql.Statement, metadataLimitsType) {
+	switch s := stmt.(type) {
+	case *influxql.ShowMeasurementsStatement:
+		result := *s
+		result.Database, result.Limit, result.Offset = "", 0, 0
+		return &result, metadataLimitsType{Limit: s.Limit, Offset: s.Offset}
+	case *influxql.ShowTagKeysStatement:
+		result := *s
+		result.Database = ""
+		result.Limit, result.Offset = 0, 0
+		result.SLimit, result.SOffset = 0, 0
+		return &result, metadataLimitsType{
+			Limit:   s.Limit,
+			Offset:  s.Offset,
+			SLimit:  s.SLimit,
+			SOffset: s.SOffset,
+		}
+	case *influxql.ShowTagValuesStatement:
+		result := *s
+		result.Database, result.Limit, result.Offset = "", 0, 0
+		return &result, metadataLimitsType{Limit: s.Limit, Offset: s.Offset}
+	case *influxql.ShowFieldKeysStatement:
+		result := *s
+		result.Database, result.Limit, result.Offset = "", 0, 0
+		return &result, metadataLimitsType{Limit: s.Limit, Offset: s.Offset}
+	case *influxql.ShowSeriesStatement:
+		result := *s
+		result.Database, result.Limit, result.Offset = "", 0, 0
+		return &result, metadataLimitsType{Limit: s.Limit, Offset: s.Offset}
+	}
+	panic("Not a metadata statement")
+}
+
+// rowKey returns a key identifying the series a row belongs to.
+func rowKey(row *models.Row) string {
+	tagNames := make([]string, 0, len(row.Tags))
+	for name := range row.Tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+	parts := []string{row.Name}
+	for _, name := range tagNames {
+		parts = append(parts, name+"="+row.Tags[name])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// valuesKey returns a key identifying a row of metadata values.
+func valuesKey(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i := range values {
+		parts[i] = fmt.Sprint(values[i])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+type metadataRowType struct {
+	row    models.Row
+	values map[string][]interface{}
+}
+
+// unionMetadataResults returns the union of the series in results
+// with duplicate values removed. Series are sorted by name and tags.
+// Values within each series are sorted.
+func unionMetadataResults(results []client.Result) client.Result {
+	byKey := make(map[string]*metadataRowType)
+	for _, result := range results {
+		for i := range result.Series {
+			row := &result.Series[i]
+			key := rowKey(row)
+			merged, ok := byKey[key]
+			if !ok {
+				merged = &metadataRowType{
+					row: models.Row{
+						Name:    row.Name,
+						Tags:    row.Tags,
+						Columns: row.Columns,
+					},
+					values: make(map[string][]interface{}),
+				}
+				byKey[key] = merged
+			}
+			for _, values := range row.Values {
+				merged.values[valuesKey(values)] = values
+			}
+		}
+	}
+	rowKeys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		rowKeys = append(rowKeys, key)
+	}
+	sort.Strings(rowKeys)
+	var result client.Result
+	for _, key := range rowKeys {
+		merged := byKey[key]
+		valueKeys := make([]string, 0, len(merged.values))
+		for valueKey := range merged.values {
+			valueKeys = append(valueKeys, valueKey)
+		}
+		sort.Strings(valueKeys)
+		row := merged.row
+		for _, valueKey := range valueKeys {
+			row.Values = append(row.Values, merged.values[valueKey])
+		}
+		result.Series = append(result.Series, row)
+	}
+	return result
+}
+
+// unionMetadataResponses returns the union of responses which must all be
+// responses to the same SHOW statements.
+func unionMetadataResponses(responseList ...*client.Response) *client.Response {
+	resultCount := 0
+	for _, response := range responseList {
+		if len(response.Results) > resultCount {
+			resultCount = len(response.Results)
+		}
+	}
+	result := &client.Response{Results: make([]client.Result, resultCount)}
+	for i := range result.Results {
+		var results []client.Result
+		for _, response := range responseList {
+			if i < len(response.Results) {
+				results = append(results, response.Results[i])
+			}
+		}
+		result.Results[i] = unionMetadataResults(results)
+	}
+	return result
+}
+
+// window returns the part of a slice of given length that remains after
+// applying limit and offset.
+func window(length, limit, offset int) (start, end int) {
+	start, end = offset, length
+	if start > length {
+		start = length
+	}
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return
+}
+
+// applyMetadataLimits applies limits to result in place.
+func applyMetadataLimits(result *client.Result, limits metadataLimitsType) {
+	start, end := window(len(result.Series), limits.SLimit, limits.SOffset)
+	series := result.Series[start:end]
+	result.Series = nil
+	for _, row := range series {
+		start, end := window(len(row.Values), limits.Limit, limits.Offset)
+		if start == end {
+			continue
+		}
+		row.Values = row.Values[start:end]
+		result.Series = append(result.Series, row)
+	}
+}
+
+// getConcurrentMetadataResponses sends query, which must consist only
+// of SHOW statements, to all endpoints concurrently and returns the
+// union of the results. Like getConcurrentResponses, it returns an error
+// only if no endpoint responds successfully.
+func getConcurrentMetadataResponses(
+	ctx context.Context,
+	endpoints []queryerType,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	queries := make([]*influxql.Query, len(endpoints))
+	for i := range queries {
+		queries[i] = query
+	}
+	responseList, errs := getRawConcurrentResponses(
+		ctx, endpoints, queries, epoch, logger)
+	var responsesToUnion []*client.Response
+	var lastErrorEncountered error
+	var failures []error
+	for i := range responseList {
+		err := errs[i]
+		if err == nil && responseList[i].Error() != nil {
+			err = responseList[i].Error()
+		}
+		if err == nil {
+			responsesToUnion = append(responsesToUnion, responseList[i])
+		} else {
+			logError(logger, err)
+			lastErrorEncountered = err
+			failures = append(failures, &backendError{
+				backend: backendName(endpoints[i]),
+				err:     err,
+			})
+		}
+	}
+	if len(responsesToUnion) == 0 && lastErrorEncountered != nil {
+		return nil, lastErrorEncountered
+	}
+	for _, failure := range failures {
+		recordFailure(ctx, failure)
+	}
+	return unionMetadataResponses(responsesToUnion...), nil
+}
+
+// queryMetadata runs a single SHOW statement against all the influx
+// backends and all the scotty servers in this database.
+func (d *Database) queryMetadata(
+	ctx context.Context,
+	stmt influxql.Statement,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	backendStmt, limits := backendMetadataStatement(stmt)
+	query := qlutils.SingleQuery(backendStmt)
+	var wg sync.WaitGroup
+	var influxResponse, scottyResponse *client.Response
+	var influxError, scottyError error
+	wg.Add(2)
+	go func() {
+		influxResponse, influxError = d.influxes.Query(
+			ctx, query, epoch, time.Time{}, logger)
+		wg.Done()
+	}()
+	go func() {
+		scottyResponse, scottyError = d.scotties.Query(
+			ctx, query, epoch, time.Time{}, logger)
+		wg.Done()
+	}()
+	wg.Wait()
+	if influxError == nil {
+		influxError = influxResponse.Error()
+	}
+	if scottyError == nil {
+		scottyError = scottyResponse.Error()
+	}
+	var responseList []*client.Response
+	if influxError == nil {
+		responseList = append(responseList, influxResponse)
+	}
+	if scottyError == nil {
+		responseList = append(responseList, scottyResponse)
+	}
+	if len(responseList) == 0 {
+		var lastError lastErrorType
+		lastError.Add(influxError)
+		lastError.Add(scottyError)
+		return nil, lastError.Error()
+	}
+	if influxError != nil {
+		recordFailure(ctx, &backendError{backend: kInfluxBackends, err: influxError})
+	}
+	if scottyError != nil {
+		recordFailure(ctx, &backendError{backend: kScotties, err: scottyError})
+	}
+	result := unionMetadataResponses(responseList...)
+	if len(result.Results) == 0 {
+		result.Results = []client.Result{{}}
+	}
+	applyMetadataLimits(&result.Results[0], limits)
+	return result, nil
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"context"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func newTagValuesResponse(measurement string, values ...string) *client.Response {
+	rowValues := make([][]interface{}, len(values))
+	for i := range values {
+		rowValues[i] = []interface{}{"host", values[i]}
+	}
+	return &client.Response{
+		Results: []client.Result{
+			{
+				Series: []models.Row{
+					{
+						Name:    measurement,
+						Columns: []string{"key", "value"},
+						Values:  rowValues,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	Convey("Given fake sources", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha":   &fakeDbQueryerType{},
+			"bravo":   &fakeDbQueryerType{},
+			"charlie": &fakeDbQueryerType{},
+			"delta":   &fakeDbQueryerType{},
+			"error":   &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(
+			newTagValuesResponse("cpu", "host3", "host1"), nil)
+		store["bravo"].WhenQueriedReturn(
+			newTagValuesResponse("cpu", "host2", "host1"), nil)
+		store["charlie"].WhenQueriedReturn(
+			newTagValuesResponse("cpu", "host5"), nil)
+		store["delta"].WhenQueriedReturn(
+			newTagValuesResponse("cpu", "host4"), nil)
+		store["error"].WhenQueriedReturn(nil, kErrSomeError)
+		proximaConfig := config.Proxima{
+			Dbs: []config.Database{
+				{
+					Name: "both",
+					Influxes: config.InfluxList{
+						{
+							HostAndPort: "alpha",
+							Database:    "a",
+							Duration:    100 * time.Hour,
+						},
+						{
+							HostAndPort: "error",
+							Database:    "e",
+							Duration:    10 * time.Hour,
+						},
+					},
+					Scotties: config.ScottyList{
+						{HostAndPort: "bravo"},
+						{
+							Partials: config.ScottyList{
+								{HostAndPort: "charlie"},
+								{HostAndPort: "delta"},
+							},
+						},
+					},
+				},
+			},
+		}
+		proxima, err := newProximaForTesting(proximaConfig, store.Create)
+		So(err, ShouldBeNil)
+		db := proxima.ByName("both")
+
+		Convey("SHOW TAG VALUES should union all backends", func() {
+			query, err := qlutils.NewQuery(
+				"show tag values on both from cpu with key = host limit 3 offset 1", now)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newTagValuesResponse(
+				"cpu", "host2", "host3", "host4"))
+			// Backends get the query without the limit and database
+			queryStr, database, _ := store["alpha"].NextQuery()
+			So(queryStr, ShouldEqual, "SHOW TAG VALUES FROM cpu WITH KEY = host")
+			So(database, ShouldEqual, "a")
+			queryStr, database, _ = store["charlie"].NextQuery()
+			So(queryStr, ShouldEqual, "SHOW TAG VALUES FROM cpu WITH KEY = host")
+			So(database, ShouldEqual, "scotty")
+		})
+
+		Convey("SHOW and SELECT statements may be mixed", func() {
+			store["alpha"].WhenQueryIsReturn(
+				"SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T19:01:00Z' AND time < '2016-12-01T00:01:00Z'",
+				newResponse(1000, 10), nil)
+			store["bravo"].WhenQueryIsReturn(
+				"SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T19:01:00Z'",
+				newResponse(1200, 12), nil)
+			store["charlie"].WhenQueryIsReturn(
+				"SELECT sum(value) FROM cpu WHERE time >= '2016-11-30T19:01:00Z'",
+				newResponse(1200, 5), nil)
+			store["charlie"].WhenQueryIsReturn(
+				"SELECT count(value) FROM cpu WHERE time >= '2016-11-30T19:01:00Z'",
+				newResponse(1200, 1), nil)
+			store["delta"].WhenQueryIsReturn(
+				"SELECT sum(value) FROM cpu WHERE time >= '2016-11-30T19:01:00Z'",
+				newResponse(1200, 15), nil)
+			store["delta"].WhenQueryIsReturn(
+				"SELECT count(value) FROM cpu WHERE time >= '2016-11-30T19:01:00Z'",
+				newResponse(1200, 3), nil)
+			query, err := qlutils.NewQuery(
+				"show tag values from cpu with key = host limit 1; select mean(value) from cpu where time >= now() - 5h", now)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "ns", now, nil)
+			So(err, ShouldBeNil)
+			So(response.Results, ShouldHaveLength, 2)
+			So(response.Results[0], ShouldResemble, newTagValuesResponse(
+				"cpu", "host1").Results[0])
+			So(response.Results[1].Series, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Limits should be applied after merging", t, func() {
+		result := client.Result{
+			Series: []models.Row{
+				{Name: "a", Values: [][]interface{}{{"x"}, {"y"}, {"z"}}},
+				{Name: "b", Values: [][]interface{}{{"x"}}},
+				{Name: "c", Values: [][]interface{}{{"x"}, {"y"}}},
+			},
+		}
+		applyMetadataLimits(
+			&result,
+			metadataLimitsType{Limit: 1, Offset: 1, SOffset: 1})
+		So(result, ShouldResemble, client.Result{
+			Series: []models.Row{
+				{Name: "c", Values: [][]interface{}{{"y"}}},
+			},
+		})
+	})
+}
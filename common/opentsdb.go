@@ -0,0 +1,337 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openTSDBAggregatorType tells how to translate an influx aggregation
+// to OpenTSDB.
+type openTSDBAggregatorType struct {
+	// Aggregates the values within each time bucket of a series
+	Downsample string
+	// Aggregates the downsampled values across series
+	Aggregator string
+}
+
+var (
+	// median and stddev are missing because OpenTSDB would compute them
+	// from the medians or stddevs of each series rather than from all the
+	// values. mean is computed from sums and counts for the same reason.
+	// Across series, sum, min, and max interpolate series that have no
+	// value at a time, so we use zimsum, mimmin, and mimmax instead which
+	// like influx use only the values that are there.
+	kOpenTSDBAggregators = map[string]openTSDBAggregatorType{
+		"sum":   {Downsample: "sum", Aggregator: "zimsum"},
+		"count": {Downsample: "count", Aggregator: "zimsum"},
+		"min":   {Downsample: "min", Aggregator: "mimmin"},
+		"max":   {Downsample: "max", Aggregator: "mimmax"},
+		"first": {Downsample: "first", Aggregator: "first"},
+		"last":  {Downsample: "last", Aggregator: "last"},
+	}
+)
+
+// openTSDBPartType tells what a sub query of an OpenTSDB query computes.
+type openTSDBPartType struct {
+	// The index of the field in the statement
+	Field int
+	// For mean, the sub queries get the sum and count separately.
+	MeanSum   bool
+	MeanCount bool
+}
+
+// openTSDBMeanType accumulates the sum and count of a mean for a single
+// series and time.
+type openTSDBMeanType struct {
+	tags     map[string]string
+	field    int
+	t        int64
+	sum      float64
+	count    float64
+	hasSum   bool
+	hasCount bool
+}
+
+type openTSDBFilterType struct {
+	Type    string `json:"type"`
+	Tagk    string `json:"tagk"`
+	Filter  string `json:"filter"`
+	GroupBy bool   `json:"groupBy"`
+}
+
+type openTSDBSubQueryType struct {
+	Aggregator string               `json:"aggregator"`
+	Metric     string               `json:"metric"`
+	Downsample string               `json:"downsample,omitempty"`
+	Filters    []openTSDBFilterType `json:"filters,omitempty"`
+}
+
+// openTSDBQueryType is the body of a request to /api/query
+type openTSDBQueryType struct {
+	Start        int64                  `json:"start"`
+	End          int64                  `json:"end,omitempty"`
+	MsResolution bool                   `json:"msResolution"`
+	ShowQuery    bool                   `json:"showQuery"`
+	Queries      []openTSDBSubQueryType `json:"queries"`
+}
+
+// openTSDBResultType is a single series in the response from /api/query
+type openTSDBResultType struct {
+	Tags  map[string]string `json:"tags"`
+	Query struct {
+		Index int `json:"index"`
+	} `json:"query"`
+	// Keys are milliseconds since the epoch
+	Dps map[string]interface{} `json:"dps"`
+}
+
+type openTSDBErrorType struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// openTSDBMetric returns the OpenTSDB metric for a measurement and field.
+// The field "value" maps to the measurement itself; any other field maps
+// to measurement.field.
+func openTSDBMetric(measurement, field string) string {
+	if field == "value" {
+		return measurement
+	}
+	return measurement + "." + field
+}
+
+// openTSDBDuration returns d in OpenTSDB format.
+func openTSDBDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// openTSDBFilters returns the OpenTSDB filters for stmt.
+func openTSDBFilters(stmt *simpleSelectType) (
+	[]openTSDBFilterType, error) {
+	groupBy := make(map[string]bool)
+	for _, key := range stmt.GroupByTags {
+		groupBy[key] = true
+	}
+	var result []openTSDBFilterType
+	for _, filter := range stmt.Filters {
+		tsdbFilter := openTSDBFilterType{
+			Tagk:    filter.Key,
+			GroupBy: groupBy[filter.Key],
+		}
+		switch filter.Op {
+		case influxql.EQ:
+			tsdbFilter.Type = "literal_or"
+			tsdbFilter.Filter = strings.Join(filter.Values, "|")
+		case influxql.NEQ:
+			tsdbFilter.Type = "not_literal_or"
+			tsdbFilter.Filter = strings.Join(filter.Values, "|")
+		case influxql.EQREGEX:
+			tsdbFilter.Type = "regexp"
+			tsdbFilter.Filter = filter.Regex.String()
+		default:
+			return nil, qlutils.ErrUnsupported
+		}
+		result = append(result, tsdbFilter)
+		delete(groupBy, filter.Key)
+	}
+	// Remaining GROUP BY tags have no filter of their own
+	for _, key := range stmt.GroupByTags {
+		if groupBy[key] {
+			result = append(result, openTSDBFilterType{
+				Type:    "wildcard",
+				Tagk:    key,
+				Filter:  "*",
+				GroupBy: true,
+			})
+		}
+	}
+	return result, nil
+}
+
+// newOpenTSDBQuery translates stmt into an OpenTSDB query. The returned
+// parts tell what each sub query of the OpenTSDB query computes.
+func newOpenTSDBQuery(stmt *simpleSelectType) (
+	*openTSDBQueryType, []openTSDBPartType, error) {
+	if stmt.Min.IsZero() {
+		// OpenTSDB requires a start time
+		return nil, nil, qlutils.ErrUnsupported
+	}
+	filters, err := openTSDBFilters(stmt)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := &openTSDBQueryType{
+		Start:        stmt.Min.UnixNano() / int64(time.Millisecond),
+		MsResolution: true,
+		ShowQuery:    true,
+	}
+	if !stmt.Max.IsZero() {
+		result.End = stmt.Max.UnixNano() / int64(time.Millisecond)
+	}
+	var parts []openTSDBPartType
+	addSubQuery := func(
+		metric string, aggregator *openTSDBAggregatorType,
+		part openTSDBPartType) {
+		subQuery := openTSDBSubQueryType{
+			Aggregator: "none",
+			Metric:     metric,
+			Filters:    filters,
+		}
+		if aggregator != nil {
+			subQuery.Aggregator = aggregator.Aggregator
+			if stmt.Interval > 0 {
+				subQuery.Downsample = openTSDBDuration(
+					stmt.Interval) + "-" + aggregator.Downsample
+			} else {
+				subQuery.Downsample = "0all-" + aggregator.Downsample
+			}
+		}
+		result.Queries = append(result.Queries, subQuery)
+		parts = append(parts, part)
+	}
+	for i, field := range stmt.Fields {
+		metric := openTSDBMetric(stmt.Measurement, field.Name)
+		switch field.Aggregate {
+		case "":
+			addSubQuery(metric, nil, openTSDBPartType{Field: i})
+		case "mean":
+			sum := kOpenTSDBAggregators["sum"]
+			count := kOpenTSDBAggregators["count"]
+			addSubQuery(
+				metric, &sum, openTSDBPartType{Field: i, MeanSum: true})
+			addSubQuery(
+				metric, &count, openTSDBPartType{Field: i, MeanCount: true})
+		default:
+			aggregator, ok := kOpenTSDBAggregators[field.Aggregate]
+			if !ok {
+				return nil, nil, qlutils.ErrUnsupported
+			}
+			addSubQuery(metric, &aggregator, openTSDBPartType{Field: i})
+		}
+	}
+	return result, parts, nil
+}
+
+// openTSDBQueryerType is a dbQueryerType that translates influxql into
+// OpenTSDB queries.
+type openTSDBQueryerType struct {
+	*httpEndpointType
+}
+
+func openTSDBCreateDbQueryer(conn config.Connection) (dbQueryerType, error) {
+	endpoint, err := newHTTPEndpoint(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &openTSDBQueryerType{httpEndpointType: endpoint}, nil
+}
+
+// Ping checks that OpenTSDB is up. OpenTSDB has no /ping so Ping asks for
+// its version.
+func (q *openTSDBQueryerType) Ping(ctx context.Context) error {
+	return q.ping(ctx, "api/version")
+}
+
+// Query runs queryStr, which must be a simple select statement, against
+// OpenTSDB. OpenTSDB has no databases so database is ignored.
+func (q *openTSDBQueryerType) Query(
+	ctx context.Context, queryStr, database, epoch string) (
+	*client.Response, error) {
+	stmt, err := parseSimpleSelect(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	tsdbQuery, parts, err := newOpenTSDBQuery(stmt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := q.Do(ctx, "POST", "api/query", url.Values{}, tsdbQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if resp.StatusCode != http.StatusOK {
+		var tsdbError openTSDBErrorType
+		if err := decoder.Decode(&tsdbError); err != nil || tsdbError.Error.Message == "" {
+			return nil, statusErrorf(
+				resp.StatusCode,
+				"received status code %d from server", resp.StatusCode)
+		}
+		// Like influx, a missing measurement is not an error
+		if strings.HasPrefix(tsdbError.Error.Message, "No such name") {
+			return newSeriesBuilder(stmt, epoch).Response(), nil
+		}
+		return nil, statusErrorf(
+			resp.StatusCode, "%s", tsdbError.Error.Message)
+	}
+	var results []openTSDBResultType
+	if err := decoder.Decode(&results); err != nil {
+		return nil, err
+	}
+	builder := newSeriesBuilder(stmt, epoch)
+	means := make(map[string]*openTSDBMeanType)
+	for _, result := range results {
+		if result.Query.Index < 0 || result.Query.Index >= len(parts) {
+			return nil, fmt.Errorf(
+				"Bad query index from OpenTSDB: %d", result.Query.Index)
+		}
+		part := parts[result.Query.Index]
+		for tsStr, value := range result.Dps {
+			ts, err := strconv.ParseInt(tsStr, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			t := ts * int64(time.Millisecond)
+			// Without GROUP BY time, influx reports the start time
+			if stmt.Interval == 0 && stmt.Fields[0].Aggregate != "" {
+				t = stmt.Min.UnixNano()
+			}
+			if !part.MeanSum && !part.MeanCount {
+				builder.Add(result.Tags, part.Field, t, value)
+				continue
+			}
+			number, ok := numberValue(value)
+			if !ok {
+				continue
+			}
+			key := fmt.Sprintf(
+				"%d\x00%d\x00%s",
+				part.Field, t, rowKey(&models.Row{Tags: result.Tags}))
+			mean, ok := means[key]
+			if !ok {
+				mean = &openTSDBMeanType{
+					tags: result.Tags, field: part.Field, t: t}
+				means[key] = mean
+			}
+			if part.MeanSum {
+				mean.sum, mean.hasSum = number, true
+			} else {
+				mean.count, mean.hasCount = number, true
+			}
+		}
+	}
+	for _, mean := range means {
+		if mean.hasSum && mean.hasCount && mean.count > 0 {
+			builder.Add(
+				mean.tags, mean.field, mean.t, floatValue(mean.sum/mean.count))
+		}
+	}
+	return builder.Response(), nil
+}
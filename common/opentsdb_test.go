@@ -0,0 +1,247 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenTSDB(t *testing.T) {
+	Convey("Given a fake OpenTSDB server", t, func() {
+		var lastQuery openTSDBQueryType
+		var lastPath string
+		responseBody := "[]"
+		statusCode := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				lastPath = r.URL.Path
+				json.NewDecoder(r.Body).Decode(&lastQuery)
+				w.WriteHeader(statusCode)
+				fmt.Fprintln(w, responseBody)
+			}))
+		defer server.Close()
+		queryer, err := openTSDBCreateDbQueryer(
+			config.Connection{HostAndPort: server.URL})
+		So(err, ShouldBeNil)
+		defer queryer.Close()
+
+		Convey("Aggregate queries should translate", func() {
+			responseBody = `[
+{"metric":"cpu.idle","tags":{"host":"a","region":"us"},"query":{"index":2},"dps":{"1490000040000":5,"1490000100000":6}},
+{"metric":"cpu","tags":{"host":"b","region":"us"},"query":{"index":0},"dps":{"1490000040000":6}},
+{"metric":"cpu","tags":{"host":"b","region":"us"},"query":{"index":1},"dps":{"1490000040000":2}},
+{"metric":"cpu","tags":{"host":"a","region":"us"},"query":{"index":0},"dps":{"1490000040000":3,"1490000100000":2}},
+{"metric":"cpu","tags":{"host":"a","region":"us"},"query":{"index":1},"dps":{"1490000040000":3,"1490000100000":1}}
+]`
+			response, err := queryer.Query(
+				context.Background(),
+				"select mean(value), max(idle) from cpu where region = 'us' and time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m), host fill(none)",
+				"",
+				"s")
+			So(err, ShouldBeNil)
+			So(lastPath, ShouldEqual, "/api/query")
+			So(lastQuery, ShouldResemble, openTSDBQueryType{
+				Start:        1490000040000,
+				End:          1490000159999,
+				MsResolution: true,
+				ShowQuery:    true,
+				Queries: []openTSDBSubQueryType{
+					// mean is the sum over the count
+					{
+						Aggregator: "zimsum",
+						Metric:     "cpu",
+						Downsample: "60s-sum",
+						Filters: []openTSDBFilterType{
+							{Type: "literal_or", Tagk: "region", Filter: "us"},
+							{Type: "wildcard", Tagk: "host", Filter: "*", GroupBy: true},
+						},
+					},
+					{
+						Aggregator: "zimsum",
+						Metric:     "cpu",
+						Downsample: "60s-count",
+						Filters: []openTSDBFilterType{
+							{Type: "literal_or", Tagk: "region", Filter: "us"},
+							{Type: "wildcard", Tagk: "host", Filter: "*", GroupBy: true},
+						},
+					},
+					{
+						Aggregator: "mimmax",
+						Metric:     "cpu.idle",
+						Downsample: "60s-max",
+						Filters: []openTSDBFilterType{
+							{Type: "literal_or", Tagk: "region", Filter: "us"},
+							{Type: "wildcard", Tagk: "host", Filter: "*", GroupBy: true},
+						},
+					},
+				},
+			})
+			So(response, ShouldResemble, &client.Response{
+				Results: []client.Result{
+					{
+						Series: []models.Row{
+							{
+								Name:    "cpu",
+								Tags:    map[string]string{"host": "a"},
+								Columns: []string{"time", "mean", "max"},
+								Values: [][]interface{}{
+									{json.Number("1490000040"), json.Number("1"), json.Number("5")},
+									{json.Number("1490000100"), json.Number("2"), json.Number("6")},
+								},
+							},
+							{
+								Name:    "cpu",
+								Tags:    map[string]string{"host": "b"},
+								Columns: []string{"time", "mean", "max"},
+								Values: [][]interface{}{
+									{json.Number("1490000040"), json.Number("3"), nil},
+								},
+							},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("Aggregating across series should not interpolate", func() {
+			_, err := queryer.Query(
+				context.Background(),
+				"select sum(value), count(value), min(value), max(value) from cpu where time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m)",
+				"",
+				"s")
+			So(err, ShouldBeNil)
+			var aggregators []string
+			for _, subQuery := range lastQuery.Queries {
+				aggregators = append(aggregators, subQuery.Aggregator)
+			}
+			So(aggregators, ShouldResemble, []string{
+				"zimsum", "zimsum", "mimmin", "mimmax"})
+		})
+
+		Convey("Null fill should add empty buckets", func() {
+			responseBody = `[{"metric":"cpu","tags":{},"query":{"index":0},"dps":{"1490000040000":1}}]`
+			response, err := queryer.Query(
+				context.Background(),
+				"select sum(value) from cpu where time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m)",
+				"",
+				"s")
+			So(err, ShouldBeNil)
+			So(response.Results[0].Series[0].Values, ShouldResemble, [][]interface{}{
+				{json.Number("1490000040"), json.Number("1")},
+				{json.Number("1490000100"), nil},
+			})
+		})
+
+		Convey("Missing metrics should yield no data", func() {
+			statusCode = http.StatusBadRequest
+			responseBody = `{"error":{"code":400,"message":"No such name for 'metrics': 'cpu'"}}`
+			response, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where time >= '2017-03-20T08:54:00Z' group by time(1m)",
+				"",
+				"s")
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, &client.Response{
+				Results: []client.Result{{}},
+			})
+		})
+
+		Convey("Other errors should be reported", func() {
+			statusCode = http.StatusBadRequest
+			responseBody = `{"error":{"code":400,"message":"bad things"}}`
+			_, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where time >= '2017-03-20T08:54:00Z' group by time(1m)",
+				"",
+				"s")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unsupported queries should fail", func() {
+			_, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where host = 'a' or region = 'us' and time >= '2017-03-20T08:54:00Z'",
+				"",
+				"s")
+			So(err, ShouldEqual, qlutils.ErrUnsupported)
+			_, err = queryer.Query(
+				context.Background(), "show measurements", "", "s")
+			So(err, ShouldEqual, qlutils.ErrUnsupported)
+		})
+
+		Convey("Offset time buckets should fail", func() {
+			_, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where time >= '2017-03-20T08:54:00Z' group by time(1m, 15s)",
+				"",
+				"s")
+			So(err, ShouldEqual, qlutils.ErrUnsupported)
+		})
+
+		Convey("Aggregations that don't combine across series should fail", func() {
+			for _, aggregation := range []string{"median", "stddev"} {
+				_, err := queryer.Query(
+					context.Background(),
+					"select "+aggregation+"(value) from cpu where time >= '2017-03-20T08:54:00Z' group by time(1m)",
+					"",
+					"s")
+				So(err, ShouldEqual, qlutils.ErrUnsupported)
+			}
+		})
+	})
+
+	Convey("Given influx, OpenTSDB, and prometheus backends", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"tsdb":  &fakeDbQueryerType{},
+			"prom":  &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10, 1200, 11), nil)
+		store["tsdb"].WhenQueriedReturn(newResponse(1200, 12, 1400, 13), nil)
+		store["prom"].WhenQueriedReturn(newResponse(1400, 15, 1600, 16), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1400, 14), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "tiers",
+				Influxes: config.InfluxList{
+					{HostAndPort: "bravo", Database: "b", Duration: time.Hour},
+					{HostAndPort: "alpha", Database: "a", Duration: 100 * time.Hour},
+				},
+				OpenTSDBs: config.OpenTSDBList{
+					{HostAndPort: "tsdb", Duration: 10 * time.Hour},
+				},
+				Prometheuses: config.PrometheusList{
+					{HostAndPort: "prom", Duration: 5 * time.Hour},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+
+		Convey("All should take part in splitting by time", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from alpha where time >= now() - 50h group by time(1m)",
+				now)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(
+				1000, 10, 1200, 12, 1400, 14, 1600, 16))
+			queryStr, _, _ := store["tsdb"].NextQuery()
+			So(queryStr, ShouldEqual, "SELECT mean(value) FROM alpha WHERE time >= '2016-11-30T14:01:00Z' AND time < '2016-12-01T00:01:00Z' GROUP BY time(1m)")
+			queryStr, _, _ = store["prom"].NextQuery()
+			So(queryStr, ShouldEqual, "SELECT mean(value) FROM alpha WHERE time >= '2016-11-30T19:01:00Z' AND time < '2016-12-01T00:01:00Z' GROUP BY time(1m)")
+		})
+	})
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"encoding/json"
+	"github.com/influxdata/influxdb/influxql"
+	"strings"
+)
+
+// paramValue returns value, which comes from JSON decoded with UseNumber,
+// as a type that the influxql parser can bind. Numbers become int64 or
+// float64; all other values stay the same for the parser to accept or
+// reject.
+func paramValue(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	if f, err := number.Float64(); err == nil {
+		return f
+	}
+	return value
+}
+
+func bindParameters(
+	queryStr string, params map[string]interface{}) (string, error) {
+	values := make(map[string]interface{}, len(params))
+	for name, value := range params {
+		values[name] = paramValue(value)
+	}
+	parser := influxql.NewParser(strings.NewReader(queryStr))
+	parser.SetParams(values)
+	query, err := parser.ParseQuery()
+	if err != nil {
+		return "", err
+	}
+	return query.String(), nil
+}
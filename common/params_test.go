@@ -0,0 +1,49 @@
+package common
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestBindParameters(t *testing.T) {
+	Convey("Given parameters", t, func() {
+		params := map[string]interface{}{
+			"host":      "it's",
+			"count":     json.Number("10"),
+			"ratio":     json.Number("0.5"),
+			"on":        true,
+			"odd name":  "x",
+			"unsupport": []interface{}{"a"},
+		}
+		Convey("Parameters should be substituted", func() {
+			query, err := BindParameters(
+				`select value from cpu where host = $host and x > $ratio and n = $count and b = $on and y = $"odd name"`,
+				params)
+			So(err, ShouldBeNil)
+			So(query, ShouldEqual, `SELECT value FROM cpu WHERE host = 'it\'s' AND x > 0.500 AND n = 10 AND b = true AND y = 'x'`)
+		})
+		Convey("Quoted strings, identifiers, and regexes are left alone", func() {
+			query, err := BindParameters(
+				`select "$host" from cpu where a = '$host' and b =~ /^\$host$/ and c = $host`,
+				params)
+			So(err, ShouldBeNil)
+			So(query, ShouldEqual, `SELECT "$host" FROM cpu WHERE a = '$host' AND b =~ /^\$host$/ AND c = 'it\'s'`)
+		})
+		Convey("Missing parameters should produce an error", func() {
+			_, err := BindParameters(
+				`select value from cpu where host = $missing`, params)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Unsupported values should produce an error", func() {
+			_, err := BindParameters(
+				`select value from cpu where host = $unsupport`, params)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Unterminated strings should produce an error", func() {
+			_, err := BindParameters(
+				`select value from cpu where host = 'abc`, params)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,1173 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/Symantec/scotty/influx/responses"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"hash/fnv"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// numberValue returns value as a float64. numberValue returns false if
+// value is nil or not a number.
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// floatValue returns f the way influx would in a response.
+func floatValue(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+// groupedSeriesType holds the values of a single series from several row
+// lists grouped by time.
+type groupedSeriesType struct {
+	// Name and tags of the series
+	row models.Row
+	// slots[t][i] is the value row from the ith row list or nil.
+	slots map[int64][][]interface{}
+}
+
+// groupRowValues groups the value rows in rowLists by series and then by
+// time. If byTime is false, all value rows of a series share the same slot.
+// groupRowValues returns the series keys in sorted order.
+func groupRowValues(rowLists [][]models.Row, byTime bool) (
+	keys []string, series map[string]*groupedSeriesType) {
+	series = make(map[string]*groupedSeriesType)
+	for i, rows := range rowLists {
+		for j := range rows {
+			key := rowKey(&rows[j])
+			grouped, ok := series[key]
+			if !ok {
+				grouped = &groupedSeriesType{
+					row: models.Row{
+						Name: rows[j].Name,
+						Tags: rows[j].Tags,
+					},
+					slots: make(map[int64][][]interface{}),
+				}
+				series[key] = grouped
+				keys = append(keys, key)
+			}
+			for _, values := range rows[j].Values {
+				var t int64
+				if byTime {
+					t, _ = timeOf(values)
+				}
+				slot, ok := grouped.slots[t]
+				if !ok {
+					slot = make([][]interface{}, len(rowLists))
+					grouped.slots[t] = slot
+				}
+				// Only the first row for a time counts.
+				if slot[i] == nil {
+					slot[i] = values
+				}
+			}
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+// combineRowValues combines the value rows of the same series and time
+// across rowLists into a single value row using combine. combine receives
+// one value row from each list or nil where a list has no value row.
+// The returned rows have the given columns.
+func combineRowValues(
+	rowLists [][]models.Row,
+	byTime bool,
+	columns []string,
+	combine func(slot [][]interface{}) []interface{}) []models.Row {
+	keys, series := groupRowValues(rowLists, byTime)
+	result := make([]models.Row, 0, len(keys))
+	for _, key := range keys {
+		grouped := series[key]
+		times := make([]int64, 0, len(grouped.slots))
+		for t := range grouped.slots {
+			times = append(times, t)
+		}
+		sort.Sort(int64Slice(times))
+		row := grouped.row
+		row.Columns = columns
+		for _, t := range times {
+			row.Values = append(row.Values, combine(grouped.slots[t]))
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// slotTime returns the time of the first value row in slot.
+func slotTime(slot [][]interface{}) interface{} {
+	for _, values := range slot {
+		if values != nil {
+			return values[0]
+		}
+	}
+	return nil
+}
+
+// joinRowValues joins rowLists, each having a single value column, into
+// rows having one value column for each list.
+func joinRowValues(
+	rowLists [][]models.Row, byTime bool, columns []string) []models.Row {
+	return combineRowValues(
+		rowLists,
+		byTime,
+		columns,
+		func(slot [][]interface{}) []interface{} {
+			result := make([]interface{}, len(slot)+1)
+			result[0] = slotTime(slot)
+			for i, values := range slot {
+				if len(values) > 1 {
+					result[i+1] = values[1]
+				}
+			}
+			return result
+		})
+}
+
+// selectExtreme returns a combine function that picks the smallest value
+// or the largest value if largest is true. Like influx, the time of the
+// value picked is the time of the result.
+func selectExtreme(largest bool) func(slot [][]interface{}) []interface{} {
+	return func(slot [][]interface{}) []interface{} {
+		var best []interface{}
+		var bestValue float64
+		for _, values := range slot {
+			if len(values) < 2 {
+				continue
+			}
+			value, ok := numberValue(values[1])
+			if !ok {
+				continue
+			}
+			if best == nil || (largest && value > bestValue) ||
+				(!largest && value < bestValue) {
+				best, bestValue = values, value
+			}
+		}
+		if best == nil {
+			return []interface{}{slotTime(slot), nil}
+		}
+		return []interface{}{best[0], best[1]}
+	}
+}
+
+// selectByTime returns a combine function that picks the earliest value
+// or the latest value if latest is true. Ties go to the earlier partial.
+func selectByTime(latest bool) func(slot [][]interface{}) []interface{} {
+	return func(slot [][]interface{}) []interface{} {
+		var best []interface{}
+		var bestTime int64
+		for _, values := range slot {
+			if len(values) < 2 || values[1] == nil {
+				continue
+			}
+			t, ok := timeOf(values)
+			if !ok {
+				continue
+			}
+			if best == nil || (latest && t > bestTime) ||
+				(!latest && t < bestTime) {
+				best, bestTime = values, t
+			}
+		}
+		if best == nil {
+			return []interface{}{slotTime(slot), nil}
+		}
+		return []interface{}{best[0], best[1]}
+	}
+}
+
+// combineSum adds together the values from each partial. The result is
+// nil if no partial has a value.
+func combineSum(slot [][]interface{}) []interface{} {
+	var sum float64
+	found := false
+	for _, values := range slot {
+		if len(values) < 2 {
+			continue
+		}
+		if value, ok := numberValue(values[1]); ok {
+			sum += value
+			found = true
+		}
+	}
+	if !found {
+		return []interface{}{slotTime(slot), nil}
+	}
+	return []interface{}{slotTime(slot), floatValue(sum)}
+}
+
+// combineMean combines [time, sum, count] value rows from each partial
+// into a [time, mean] value row.
+func combineMean(slot [][]interface{}) []interface{} {
+	var sum, count float64
+	for _, values := range slot {
+		if len(values) < 3 {
+			continue
+		}
+		partialSum, sumOk := numberValue(values[1])
+		partialCount, countOk := numberValue(values[2])
+		if sumOk && countOk {
+			sum += partialSum
+			count += partialCount
+		}
+	}
+	if count == 0 {
+		return []interface{}{slotTime(slot), nil}
+	}
+	return []interface{}{slotTime(slot), floatValue(sum / count)}
+}
+
+// combineSpread combines [time, min, max] value rows from each partial
+// into a [time, spread] value row.
+func combineSpread(slot [][]interface{}) []interface{} {
+	var min, max float64
+	found := false
+	for _, values := range slot {
+		if len(values) < 3 {
+			continue
+		}
+		partialMin, minOk := numberValue(values[1])
+		partialMax, maxOk := numberValue(values[2])
+		if !minOk || !maxOk {
+			continue
+		}
+		if !found || partialMin < min {
+			min = partialMin
+		}
+		if !found || partialMax > max {
+			max = partialMax
+		}
+		found = true
+	}
+	if !found {
+		return []interface{}{slotTime(slot), nil}
+	}
+	return []interface{}{slotTime(slot), floatValue(max - min)}
+}
+
+// combineStddev combines [time, mean, count, stddev] value rows from each
+// partial into a [time, stddev] value row. combineStddev recovers the sum
+// and the sum of squares of each partial from its mean, count, and
+// sample standard deviation.
+func combineStddev(slot [][]interface{}) []interface{} {
+	var count, sum, sumOfSquares float64
+	for _, values := range slot {
+		if len(values) < 4 {
+			continue
+		}
+		partialMean, meanOk := numberValue(values[1])
+		partialCount, countOk := numberValue(values[2])
+		if !meanOk || !countOk || partialCount == 0 {
+			continue
+		}
+		// Influx reports no stddev for a single value
+		partialStddev, _ := numberValue(values[3])
+		count += partialCount
+		sum += partialCount * partialMean
+		sumOfSquares += (partialCount-1)*partialStddev*partialStddev +
+			partialCount*partialMean*partialMean
+	}
+	if count < 2 {
+		return []interface{}{slotTime(slot), nil}
+	}
+	variance := (sumOfSquares - sum*sum/count) / (count - 1)
+	if variance < 0 {
+		// Rounding error
+		variance = 0
+	}
+	return []interface{}{slotTime(slot), floatValue(math.Sqrt(variance))}
+}
+
+// scottyRowsFromEach issues stmt to each scotty in endpoints and returns
+// the rows from each scotty. If any scotty fails, scottyRowsFromEach
+// fails as a partial answer would be wrong.
+func scottyRowsFromEach(
+	ctx context.Context,
+	endpoints []queryerType,
+	stmt influxql.Statement,
+	epoch string,
+	logger log.Logger) ([][]models.Row, error) {
+	queries := make([]*influxql.Query, len(endpoints))
+	query := qlutils.SingleQuery(stmt)
+	for i := range queries {
+		queries[i] = query
+	}
+	responseList, errs := getRawConcurrentResponses(
+		ctx, endpoints, queries, epoch, logger)
+	for i := range errs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if err := responseList[i].Error(); err != nil {
+			return nil, err
+		}
+	}
+	result := make([][]models.Row, len(responseList))
+	for i := range result {
+		var err error
+		result[i], err = responses.ExtractRows(responseList[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// queryerStreams returns the streams for a single statement query against
+// endpoint. If endpoint cannot stream, the stream is over the results in
+// memory.
+func queryerStreams(
+	ctx context.Context,
+	endpoint queryerType,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) ([]rowStreamType, error) {
+	if streamer, ok := endpoint.(streamingQueryerType); ok {
+		return streamer.QueryStreams(ctx, query, epoch, 0, logger)
+	}
+	response, err := endpoint.Query(ctx, query, epoch, logger)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := newResponseRowStream(response)
+	if err != nil {
+		return nil, err
+	}
+	return []rowStreamType{stream}, nil
+}
+
+// rawPointBudgetType is the number of raw points that the scotties may
+// still return for a single statement. It is safe to use from multiple
+// goroutines.
+type rawPointBudgetType struct {
+	max       int
+	remaining int64
+}
+
+func newRawPointBudget(max int) *rawPointBudgetType {
+	return &rawPointBudgetType{max: max, remaining: int64(max)}
+}
+
+// Spend spends the non null values in row. Spend fails once the scotties
+// return more than the budget. A budget of 0 or less never fails.
+func (b *rawPointBudgetType) Spend(row *models.Row) error {
+	if b.max <= 0 {
+		return nil
+	}
+	count := 0
+	for _, values := range row.Values {
+		if len(values) >= 2 && values[1] != nil {
+			count++
+		}
+	}
+	if atomic.AddInt64(&b.remaining, -int64(count)) < 0 {
+		return fmt.Errorf(
+			"Query needs more than %d raw points from scotty partials",
+			b.max)
+	}
+	return nil
+}
+
+// scottyRowsWithinBudget works like scottyRowsFromEach except that it
+// reads the rows from each scotty as a stream and stops all the scotties
+// as soon as they return more than budget allows. This way proxima never
+// holds much more than the budget in memory.
+func scottyRowsWithinBudget(
+	ctx context.Context,
+	endpoints []queryerType,
+	stmt influxql.Statement,
+	budget *rawPointBudgetType,
+	epoch string,
+	logger log.Logger) ([][]models.Row, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	query := qlutils.SingleQuery(stmt)
+	result := make([][]models.Row, len(endpoints))
+	var firstErr error
+	var once sync.Once
+	var wg sync.WaitGroup
+	for i := range endpoints {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			result[i], err = readRowsWithinBudget(
+				ctx, endpoints[i], query, budget, epoch, logger)
+			if err != nil {
+				// Errors from the other scotties after cancel are just
+				// fallout.
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// readRowsWithinBudget reads all the rows that endpoint returns for query
+// spending budget as it goes.
+func readRowsWithinBudget(
+	ctx context.Context,
+	endpoint queryerType,
+	query *influxql.Query,
+	budget *rawPointBudgetType,
+	epoch string,
+	logger log.Logger) ([]models.Row, error) {
+	streams, err := queryerStreams(ctx, endpoint, query, epoch, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}()
+	var result []models.Row
+	for _, stream := range streams {
+		for {
+			row, err := stream.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := budget.Spend(&row); err != nil {
+				return nil, err
+			}
+			result = append(result, row)
+		}
+	}
+	return result, nil
+}
+
+// joinedScottyRows issues stmt to each scotty in endpoints once for each
+// of the given aggregations and joins the results. Each returned row list
+// comes from one scotty and has a value column for each aggregation.
+func joinedScottyRows(
+	ctx context.Context,
+	endpoints []queryerType,
+	stmt influxql.Statement,
+	aggregations []string,
+	epoch string,
+	logger log.Logger) ([][]models.Row, error) {
+	byTime, err := groupsByTime(stmt)
+	if err != nil {
+		return nil, err
+	}
+	// byAggregation[i][j] is the rows for the ith aggregation from the
+	// jth scotty.
+	byAggregation := make([][][]models.Row, len(aggregations))
+	for i, aggregation := range aggregations {
+		aggStmt, err := qlutils.WithAggregationType(stmt, aggregation)
+		if err != nil {
+			return nil, err
+		}
+		byAggregation[i], err = scottyRowsFromEach(
+			ctx, endpoints, aggStmt, epoch, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	columns := append([]string{"time"}, aggregations...)
+	result := make([][]models.Row, len(endpoints))
+	for j := range result {
+		rowLists := make([][]models.Row, len(aggregations))
+		for i := range rowLists {
+			rowLists[i] = byAggregation[i][j]
+		}
+		result[j] = joinRowValues(rowLists, byTime, columns)
+	}
+	return result, nil
+}
+
+// groupsByTime returns true if stmt has a GROUP BY time clause.
+func groupsByTime(stmt influxql.Statement) (bool, error) {
+	selectStmt, ok := stmt.(*influxql.SelectStatement)
+	if !ok {
+		return false, qlutils.ErrUnsupported
+	}
+	interval, err := selectStmt.GroupByInterval()
+	if err != nil {
+		return false, err
+	}
+	return interval > 0, nil
+}
+
+// pointType is a single raw value.
+type pointType struct {
+	// In nanoseconds since the epoch
+	Time  int64
+	Value interface{}
+}
+
+// rawAggregatorType computes an aggregate from the raw points in a single
+// bucket. Points are in no particular order. bucket is the start time
+// of the bucket. The returned point has the time that influx would report
+// when there is no GROUP BY time. rawAggregatorType returns false if
+// there is no value.
+type rawAggregatorType func(bucket int64, points []pointType) (
+	pointType, bool)
+
+// rawFirst is a rawAggregatorType for first()
+func rawFirst(bucket int64, points []pointType) (pointType, bool) {
+	if len(points) == 0 {
+		return pointType{}, false
+	}
+	result := points[0]
+	for _, point := range points[1:] {
+		if point.Time < result.Time {
+			result = point
+		}
+	}
+	return result, true
+}
+
+// rawLast is a rawAggregatorType for last()
+func rawLast(bucket int64, points []pointType) (pointType, bool) {
+	if len(points) == 0 {
+		return pointType{}, false
+	}
+	result := points[0]
+	for _, point := range points[1:] {
+		if point.Time > result.Time {
+			result = point
+		}
+	}
+	return result, true
+}
+
+// sortedNumbers returns the points that have numeric values sorted by value
+// along with the values.
+func sortedNumbers(points []pointType) ([]pointType, []float64) {
+	type numberPointType struct {
+		point pointType
+		value float64
+	}
+	numbers := make([]numberPointType, 0, len(points))
+	for _, point := range points {
+		if value, ok := numberValue(point.Value); ok {
+			numbers = append(numbers, numberPointType{point, value})
+		}
+	}
+	sort.SliceStable(numbers, func(i, j int) bool {
+		return numbers[i].value < numbers[j].value
+	})
+	sortedPoints := make([]pointType, len(numbers))
+	values := make([]float64, len(numbers))
+	for i := range numbers {
+		sortedPoints[i], values[i] = numbers[i].point, numbers[i].value
+	}
+	return sortedPoints, values
+}
+
+// rawPercentile returns a rawAggregatorType for percentile(field, n).
+// Like influx, rawPercentile selects the value at the nearest rank.
+func rawPercentile(n float64) rawAggregatorType {
+	return func(bucket int64, points []pointType) (pointType, bool) {
+		sortedPoints, _ := sortedNumbers(points)
+		i := int(math.Floor(float64(len(sortedPoints))*n/100.0+0.5)) - 1
+		if i < 0 || i >= len(sortedPoints) {
+			return pointType{}, false
+		}
+		return sortedPoints[i], true
+	}
+}
+
+// rawMedian is a rawAggregatorType for median(). Like influx, rawMedian
+// averages the two middle values when there is an even number of values.
+func rawMedian(bucket int64, points []pointType) (pointType, bool) {
+	sortedPoints, values := sortedNumbers(points)
+	length := len(sortedPoints)
+	if length == 0 {
+		return pointType{}, false
+	}
+	if length%2 == 1 {
+		return pointType{Time: bucket, Value: sortedPoints[length/2].Value}, true
+	}
+	median := (values[length/2-1] + values[length/2]) / 2
+	return pointType{Time: bucket, Value: floatValue(median)}, true
+}
+
+// rawStatement returns the raw select statement that fetches the points
+// that stmt, a statement with a single aggregation, aggregates.
+func rawStatement(stmt *influxql.SelectStatement) (
+	*influxql.SelectStatement, error) {
+	if len(stmt.Fields) != 1 {
+		return nil, qlutils.ErrUnsupported
+	}
+	call, ok := stmt.Fields[0].Expr.(*influxql.Call)
+	if !ok || len(call.Args) == 0 {
+		return nil, qlutils.ErrUnsupported
+	}
+	ref, ok := call.Args[0].(*influxql.VarRef)
+	if !ok {
+		return nil, qlutils.ErrUnsupported
+	}
+	result := stmt.Clone()
+	result.Fields = influxql.Fields{{Expr: &influxql.VarRef{Val: ref.Val}}}
+	var dimensions influxql.Dimensions
+	for _, dimension := range result.Dimensions {
+		if _, ok := dimension.Expr.(*influxql.Call); !ok {
+			dimensions = append(dimensions, dimension)
+		}
+	}
+	result.Dimensions = dimensions
+	result.Fill = influxql.NullFill
+	result.FillValue = nil
+	return result, nil
+}
+
+// aggregateRawScottyRows computes stmt, a statement with a single
+// aggregation, from the raw points in each scotty in endpoints using
+// aggregator. If maxRawPoints is positive, aggregateRawScottyRows fails
+// as soon as the scotties return more than maxRawPoints raw points in
+// total.
+func aggregateRawScottyRows(
+	ctx context.Context,
+	endpoints []queryerType,
+	stmt influxql.Statement,
+	aggregator rawAggregatorType,
+	maxRawPoints int,
+	epoch string,
+	logger log.Logger) ([]models.Row, error) {
+	selectStmt, ok := stmt.(*influxql.SelectStatement)
+	if !ok {
+		return nil, qlutils.ErrUnsupported
+	}
+	simple, err := newSimpleSelect(selectStmt)
+	if err != nil {
+		return nil, err
+	}
+	rawStmt, err := rawStatement(selectStmt)
+	if err != nil {
+		return nil, err
+	}
+	if maxRawPoints > 0 {
+		// Keep any one series from blowing the budget by itself
+		rawStmt.Limit = maxRawPoints + 1
+	}
+	rowLists, err := scottyRowsWithinBudget(
+		ctx, endpoints, rawStmt, newRawPointBudget(maxRawPoints), "ns", logger)
+	if err != nil {
+		return nil, err
+	}
+	interval := int64(simple.Interval)
+	var start int64
+	if !simple.Min.IsZero() {
+		start = simple.Min.UnixNano()
+	}
+	// buckets[series key][bucket start]
+	buckets := make(map[string]map[int64][]pointType)
+	tags := make(map[string]map[string]string)
+	for _, rows := range rowLists {
+		for i := range rows {
+			key := rowKey(&rows[i])
+			if buckets[key] == nil {
+				buckets[key] = make(map[int64][]pointType)
+				tags[key] = rows[i].Tags
+			}
+			for _, values := range rows[i].Values {
+				t, ok := timeOf(values)
+				if !ok || len(values) < 2 || values[1] == nil {
+					continue
+				}
+				bucket := start
+				if interval > 0 {
+					bucket = t - t%interval
+				}
+				buckets[key][bucket] = append(
+					buckets[key][bucket], pointType{Time: t, Value: values[1]})
+			}
+		}
+	}
+	builder := newSeriesBuilder(simple, epoch)
+	for key, byBucket := range buckets {
+		for bucket, points := range byBucket {
+			point, ok := aggregator(bucket, points)
+			if !ok {
+				continue
+			}
+			if interval > 0 {
+				point.Time = bucket
+			}
+			builder.Add(tags[key], 0, point.Time, point.Value)
+		}
+	}
+	return responses.ExtractRows(builder.Response())
+}
+
+// withoutFill returns stmt asking for nulls in empty GROUP BY time buckets
+// instead of fill values. If stmt already does that, or drops empty
+// buckets, withoutFill returns stmt unchanged.
+func withoutFill(stmt *influxql.SelectStatement) *influxql.SelectStatement {
+	if stmt.Fill == influxql.NullFill || stmt.Fill == influxql.NoFill {
+		return stmt
+	}
+	result := stmt.Clone()
+	result.Fill = influxql.NullFill
+	result.FillValue = nil
+	return result
+}
+
+// fillRows applies the fill option of stmt to rows which have times in
+// nanoseconds and then converts the times according to epoch. When stmt
+// has no upper time bound, fillRows fills up to the latest time in rows.
+// fillRows adds no buckets if stmt has no GROUP BY time.
+func fillRows(
+	rows []models.Row,
+	stmt *influxql.SelectStatement,
+	epoch string) ([]models.Row, error) {
+	interval, err := stmt.GroupByInterval()
+	if err != nil {
+		return nil, err
+	}
+	min, max, err := influxql.TimeRange(stmt.Condition)
+	if err != nil {
+		return nil, err
+	}
+	// The buckets that must appear in every series
+	var start, end int64
+	first, last, found := timeBounds(rows)
+	hasBuckets := found && interval > 0 && stmt.Fill != influxql.NoFill
+	if hasBuckets {
+		if !min.IsZero() {
+			start = min.UnixNano()
+		} else {
+			start = first
+		}
+		start -= start % int64(interval)
+		if !max.IsZero() {
+			end = max.UnixNano()
+		} else {
+			end = last
+		}
+	}
+	result := make([]models.Row, 0, len(rows))
+	for _, row := range rows {
+		byTime := make(map[int64][]interface{}, len(row.Values))
+		var times []int64
+		for _, values := range row.Values {
+			t, ok := timeOf(values)
+			if !ok {
+				continue
+			}
+			if _, ok := byTime[t]; !ok {
+				times = append(times, t)
+			}
+			byTime[t] = values
+		}
+		if hasBuckets {
+			for t := start; t <= end; t += int64(interval) {
+				if _, ok := byTime[t]; !ok {
+					byTime[t] = make([]interface{}, len(row.Columns))
+					times = append(times, t)
+				}
+			}
+		}
+		sort.Sort(int64Slice(times))
+		filled := row
+		filled.Values = make([][]interface{}, 0, len(times))
+		for _, t := range times {
+			values := append([]interface{}(nil), byTime[t]...)
+			values[0] = t
+			if stmt.Fill == influxql.NoFill && isEmpty(values) {
+				continue
+			}
+			filled.Values = append(filled.Values, values)
+		}
+		fillValues(filled.Values, stmt.Fill, stmt.FillValue)
+		for _, values := range filled.Values {
+			values[0] = formatTime(values[0].(int64), epoch)
+		}
+		if len(filled.Values) != 0 {
+			result = append(result, filled)
+		}
+	}
+	return result, nil
+}
+
+// timeBounds returns the earliest and latest times in rows. found is false
+// if rows has no values.
+func timeBounds(rows []models.Row) (first, last int64, found bool) {
+	for _, row := range rows {
+		for _, values := range row.Values {
+			t, ok := timeOf(values)
+			if !ok {
+				continue
+			}
+			if !found || t < first {
+				first = t
+			}
+			if !found || t > last {
+				last = t
+			}
+			found = true
+		}
+	}
+	return
+}
+
+// fillValues replaces the nil values in valueRows, which are in time
+// order with int64 times first, according to fill.
+func fillValues(
+	valueRows [][]interface{},
+	fill influxql.FillOption,
+	fillValue interface{}) {
+	if len(valueRows) == 0 {
+		return
+	}
+	for col := 1; col < len(valueRows[0]); col++ {
+		switch fill {
+		case influxql.NumberFill:
+			for _, values := range valueRows {
+				if values[col] == nil {
+					values[col] = fillValue
+				}
+			}
+		case influxql.PreviousFill:
+			var previous interface{}
+			for _, values := range valueRows {
+				if values[col] == nil {
+					values[col] = previous
+				} else {
+					previous = values[col]
+				}
+			}
+		case influxql.LinearFill:
+			fillLinear(valueRows, col)
+		}
+	}
+}
+
+// fillLinear interpolates the nil values in column col of valueRows that
+// lie between two numbers. Nil values before the first number or after the
+// last number stay nil.
+func fillLinear(valueRows [][]interface{}, col int) {
+	previous := -1
+	for i, values := range valueRows {
+		value, ok := numberValue(values[col])
+		if !ok {
+			continue
+		}
+		if previous >= 0 && i-previous > 1 {
+			previousValue, _ := numberValue(valueRows[previous][col])
+			previousTime := valueRows[previous][0].(int64)
+			span := float64(values[0].(int64) - previousTime)
+			for j := previous + 1; j < i; j++ {
+				fraction := float64(valueRows[j][0].(int64)-previousTime) / span
+				valueRows[j][col] = floatValue(
+					previousValue + (value-previousValue)*fraction)
+			}
+		}
+		previous = i
+	}
+}
+
+// isRawSelect returns true if stmt is a select statement with no
+// aggregations.
+func isRawSelect(stmt influxql.Statement) bool {
+	selectStmt, ok := stmt.(*influxql.SelectStatement)
+	return ok && len(selectStmt.FunctionCalls()) == 0
+}
+
+// unionScottyStmtResponses issues stmt, a raw select statement, to each
+// scotty in endpoints and unions the series. Each scotty has different
+// series, so nothing needs aggregating.
+func unionScottyStmtResponses(
+	ctx context.Context,
+	endpoints []queryerType,
+	stmt influxql.Statement,
+	epoch string,
+	logger log.Logger) (client.Result, error) {
+	queries := make([]*influxql.Query, len(endpoints))
+	query := qlutils.SingleQuery(stmt)
+	for i := range queries {
+		queries[i] = query
+	}
+	responseList, errs := getRawConcurrentResponses(
+		ctx, endpoints, queries, epoch, logger)
+	for i := range errs {
+		if errs[i] != nil {
+			return client.Result{}, errs[i]
+		}
+	}
+	merged, err := responses.Merge(responseList...)
+	if err != nil {
+		return client.Result{}, err
+	}
+	if len(merged.Results) == 0 {
+		return client.Result{}, nil
+	}
+	return merged.Results[0], nil
+}
+
+// aggregatePartialStmt computes stmt, which has a single aggregation of the
+// given type, across the scotties in endpoints. The returned rows are keyed
+// by their full tag set and time. ok is false if aggregationType is not
+// supported. percentile and median are computed from raw points and are
+// supported only if maxRawPoints is positive. So are first and last with
+// GROUP BY time.
+func aggregatePartialStmt(
+	ctx context.Context,
+	endpoints []queryerType,
+	stmt influxql.Statement,
+	aggregationType string,
+	maxRawPoints int,
+	epoch string,
+	logger log.Logger) (rows []models.Row, ok bool, err error) {
+	byTime, err := groupsByTime(stmt)
+	if err != nil {
+		return
+	}
+	columns := stmt.(*influxql.SelectStatement).ColumnNames()
+	switch aggregationType {
+	case "sum", "count":
+		var rowLists [][]models.Row
+		rowLists, err = scottyRowsFromEach(ctx, endpoints, stmt, epoch, logger)
+		if err != nil {
+			return
+		}
+		rows = combineRowValues(rowLists, byTime, columns, combineSum)
+	case "mean":
+		var rowLists [][]models.Row
+		rowLists, err = joinedScottyRows(
+			ctx, endpoints, stmt, []string{"sum", "count"}, epoch, logger)
+		if err != nil {
+			return
+		}
+		rows = combineRowValues(rowLists, byTime, columns, combineMean)
+	case "min", "max":
+		var rowLists [][]models.Row
+		rowLists, err = scottyRowsFromEach(ctx, endpoints, stmt, epoch, logger)
+		if err != nil {
+			return
+		}
+		rows = combineRowValues(
+			rowLists, byTime, columns, selectExtreme(aggregationType == "max"))
+	case "spread":
+		var rowLists [][]models.Row
+		rowLists, err = joinedScottyRows(
+			ctx, endpoints, stmt, []string{"min", "max"}, epoch, logger)
+		if err != nil {
+			return
+		}
+		rows = combineRowValues(rowLists, byTime, columns, combineSpread)
+	case "stddev":
+		var rowLists [][]models.Row
+		rowLists, err = joinedScottyRows(
+			ctx,
+			endpoints,
+			stmt,
+			[]string{"mean", "count", "stddev"},
+			epoch,
+			logger)
+		if err != nil {
+			return
+		}
+		rows = combineRowValues(rowLists, byTime, columns, combineStddev)
+	case "first", "last":
+		if !byTime {
+			// Each partial reports the time of its first or last value.
+			var rowLists [][]models.Row
+			rowLists, err = scottyRowsFromEach(
+				ctx, endpoints, stmt, epoch, logger)
+			if err != nil {
+				return
+			}
+			rows = combineRowValues(
+				rowLists, byTime, columns,
+				selectByTime(aggregationType == "last"))
+			break
+		}
+		// With GROUP BY time, partials report the start of each bucket
+		// rather than the time of the value.
+		if maxRawPoints <= 0 {
+			return
+		}
+		aggregator := rawFirst
+		if aggregationType == "last" {
+			aggregator = rawLast
+		}
+		rows, err = aggregateRawScottyRows(
+			ctx, endpoints, stmt, aggregator, maxRawPoints, epoch, logger)
+		if err != nil {
+			return
+		}
+	case "percentile", "median":
+		if maxRawPoints <= 0 {
+			return
+		}
+		aggregator := rawMedian
+		if aggregationType == "percentile" {
+			var simple *simpleSelectType
+			simple, err = newSimpleSelect(stmt.(*influxql.SelectStatement))
+			if err != nil {
+				return
+			}
+			aggregator = rawPercentile(simple.Fields[0].Arg)
+		}
+		rows, err = aggregateRawScottyRows(
+			ctx, endpoints, stmt, aggregator, maxRawPoints, epoch, logger)
+		if err != nil {
+			return
+		}
+	default:
+		return
+	}
+	return rows, true, nil
+}
+
+// shardMatcherType tells which shard tag values a single partial has.
+type shardMatcherType struct {
+	prefixes []string
+	regex    *regexp.Regexp
+}
+
+// Matches returns true if the partial may have series with the given
+// shard tag value.
+func (m *shardMatcherType) Matches(value string) bool {
+	if len(m.prefixes) == 0 && m.regex == nil {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return m.regex != nil && m.regex.MatchString(value)
+}
+
+// shardRouterType decides which partials a statement goes to.
+type shardRouterType struct {
+	tag  string
+	hash bool
+	// One for each partial. Only used without hash.
+	matchers []shardMatcherType
+}
+
+func newShardRouter(
+	sharding *config.Sharding, partials config.ScottyList) (
+	*shardRouterType, error) {
+	if sharding == nil {
+		return nil, nil
+	}
+	if sharding.Tag == "" {
+		return nil, errors.New("Sharding must have a tag")
+	}
+	result := &shardRouterType{
+		tag:      sharding.Tag,
+		hash:     sharding.Hash,
+		matchers: make([]shardMatcherType, len(partials)),
+	}
+	for i, partial := range partials {
+		if sharding.Hash {
+			if len(partial.ShardPrefixes) != 0 || partial.ShardRegex != "" {
+				return nil, errors.New(
+					"shardPrefixes and shardRegex do not apply with hash sharding")
+			}
+			continue
+		}
+		result.matchers[i].prefixes = partial.ShardPrefixes
+		if partial.ShardRegex != "" {
+			regex, err := regexp.Compile(partial.ShardRegex)
+			if err != nil {
+				return nil, err
+			}
+			result.matchers[i].regex = regex
+		}
+	}
+	return result, nil
+}
+
+// owners returns the indexes of the partials that may have series with
+// the given shard tag value.
+func (r *shardRouterType) owners(value string) []int {
+	if r.hash {
+		h := fnv.New32a()
+		h.Write([]byte(value))
+		return []int{int(h.Sum32() % uint32(len(r.matchers)))}
+	}
+	var result []int
+	for i := range r.matchers {
+		if r.matchers[i].Matches(value) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// Route returns the indexes of the partials that stmt must go to in
+// ascending order. If stmt has no condition of the form tag = 'value' on
+// the shard tag, stmt goes to every partial.
+func (r *shardRouterType) Route(stmt influxql.Statement) []int {
+	all := make([]int, len(r.matchers))
+	for i := range all {
+		all[i] = i
+	}
+	selectStmt, ok := stmt.(*influxql.SelectStatement)
+	if !ok {
+		return all
+	}
+	filters, err := tagFilters(selectStmt.Condition)
+	if err != nil {
+		return all
+	}
+	for _, filter := range filters {
+		if filter.Key != r.tag || filter.Op != influxql.EQ {
+			continue
+		}
+		owned := make([]bool, len(r.matchers))
+		for _, value := range filter.Values {
+			for _, i := range r.owners(value) {
+				owned[i] = true
+			}
+		}
+		var result []int
+		for i := range owned {
+			if owned[i] {
+				result = append(result, i)
+			}
+		}
+		return result
+	}
+	return all
+}
@@ -0,0 +1,257 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	kPartialStart = time.Date(2017, 5, 13, 18, 0, 0, 0, time.UTC)
+)
+
+// newMinuteRow returns a cpu row with the given tags and column. values
+// alternate between minutes after kPartialStart and values. Integer and
+// string values become json.Numbers; other values are used as is. Times are
+// formatted according to epoch.
+func newMinuteRow(
+	epoch string,
+	tags map[string]string,
+	column string,
+	values ...interface{}) models.Row {
+	row := models.Row{
+		Name:    "cpu",
+		Tags:    tags,
+		Columns: []string{"time", column},
+	}
+	for i := 0; i < len(values); i += 2 {
+		t := kPartialStart.Add(time.Duration(values[i].(int)) * time.Minute)
+		value := values[i+1]
+		switch v := value.(type) {
+		case int:
+			value = json.Number(strconv.Itoa(v))
+		case string:
+			value = json.Number(v)
+		}
+		row.Values = append(
+			row.Values, []interface{}{formatTime(t.UnixNano(), epoch), value})
+	}
+	return row
+}
+
+func newRowsResponse(rows ...models.Row) *client.Response {
+	return &client.Response{Results: []client.Result{{Series: rows}}}
+}
+
+func TestPartialAggregation(t *testing.T) {
+	aUS := map[string]string{"host": "a", "region": "us"}
+	aEU := map[string]string{"host": "a", "region": "eu"}
+	bUS := map[string]string{"host": "b", "region": "us"}
+	const timeRange = "time >= '2017-05-13T18:00:00Z' AND time < '2017-05-13T18:04:00Z'"
+	testCases := []struct {
+		name  string
+		query string
+		// What partials get asked
+		partialQuery string
+		alpha, bravo []models.Row
+		expected     []models.Row
+	}{
+		{
+			name:         "sum by two tags should fill with null",
+			query:        "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region",
+			partialQuery: "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region",
+			alpha: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 0, 1, 1, 2),
+				newMinuteRow("ns", bUS, "sum", 0, 5),
+			},
+			bravo: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 1, 3, 3, 4),
+				newMinuteRow("ns", aEU, "sum", 2, 7),
+			},
+			expected: []models.Row{
+				newMinuteRow("s", aEU, "sum", 0, nil, 1, nil, 2, "7", 3, nil),
+				newMinuteRow("s", aUS, "sum", 0, "1", 1, "5", 2, nil, 3, "4"),
+				newMinuteRow("s", bUS, "sum", 0, "5", 1, nil, 2, nil, 3, nil),
+			},
+		},
+		{
+			name:         "fill(none) should leave out empty buckets",
+			query:        "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region fill(none)",
+			partialQuery: "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region fill(none)",
+			alpha: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 0, 1, 1, 2),
+				newMinuteRow("ns", bUS, "sum", 0, 5),
+			},
+			bravo: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 1, 3, 3, 4),
+				newMinuteRow("ns", aEU, "sum", 2, 7),
+			},
+			expected: []models.Row{
+				newMinuteRow("s", aEU, "sum", 2, "7"),
+				newMinuteRow("s", aUS, "sum", 0, "1", 1, "5", 3, "4"),
+				newMinuteRow("s", bUS, "sum", 0, "5"),
+			},
+		},
+		{
+			name:         "fill(0) should happen after combining",
+			query:        "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region fill(0)",
+			partialQuery: "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region",
+			alpha: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 0, 1),
+			},
+			bravo: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 0, 2, 2, 6),
+			},
+			expected: []models.Row{
+				newMinuteRow("s", aUS, "sum", 0, "3", 1, int64(0), 2, "6", 3, int64(0)),
+			},
+		},
+		{
+			name:         "fill(previous) should use the combined previous value",
+			query:        "SELECT max(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region fill(previous)",
+			partialQuery: "SELECT max(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region",
+			alpha: []models.Row{
+				newMinuteRow("ns", aUS, "max", 0, 1, 2, 9),
+			},
+			bravo: []models.Row{
+				newMinuteRow("ns", aUS, "max", 0, 3),
+			},
+			expected: []models.Row{
+				newMinuteRow("s", aUS, "max", 0, "3", 1, "3", 2, "9", 3, "9"),
+			},
+		},
+		{
+			name:         "fill(linear) should interpolate across partials",
+			query:        "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region fill(linear)",
+			partialQuery: "SELECT sum(value) FROM cpu WHERE " + timeRange + " GROUP BY time(1m), host, region",
+			alpha: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 0, 1),
+			},
+			bravo: []models.Row{
+				newMinuteRow("ns", aUS, "sum", 3, 4),
+			},
+			expected: []models.Row{
+				newMinuteRow("s", aUS, "sum", 0, "1", 1, "2", 2, "3", 3, "4"),
+			},
+		},
+		{
+			name:         "count by two tags without GROUP BY time",
+			query:        "SELECT count(value) FROM cpu WHERE " + timeRange + " GROUP BY host, region",
+			partialQuery: "SELECT count(value) FROM cpu WHERE " + timeRange + " GROUP BY host, region",
+			alpha: []models.Row{
+				newMinuteRow("ns", aUS, "count", 0, 2),
+			},
+			bravo: []models.Row{
+				newMinuteRow("ns", aUS, "count", 0, 3),
+				newMinuteRow("ns", bUS, "count", 0, 1),
+			},
+			expected: []models.Row{
+				newMinuteRow("s", aUS, "count", 0, "5"),
+				newMinuteRow("s", bUS, "count", 0, "1"),
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		Convey(testCase.name, t, func() {
+			store := dbQueryerStoreType{
+				"alpha": &fakeDbQueryerType{},
+				"bravo": &fakeDbQueryerType{},
+			}
+			store["alpha"].WhenQueriedReturn(
+				newRowsResponse(testCase.alpha...), nil)
+			store["bravo"].WhenQueriedReturn(
+				newRowsResponse(testCase.bravo...), nil)
+			db, err := newDatabaseForTesting(
+				config.Database{
+					Name: "partials",
+					Scotties: config.ScottyList{
+						{
+							Partials: config.ScottyList{
+								{HostAndPort: "alpha"},
+								{HostAndPort: "bravo"},
+							},
+						},
+					},
+				},
+				store.Create)
+			So(err, ShouldBeNil)
+			query, err := qlutils.NewQuery(testCase.query, kPartialStart)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "s", kPartialStart, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newRowsResponse(testCase.expected...))
+			partialQuery, _, epoch := store["alpha"].NextQuery()
+			So(partialQuery, ShouldEqual, testCase.partialQuery)
+			So(epoch, ShouldEqual, "ns")
+		})
+	}
+}
+
+// endlessStreamType is a rowStreamType that returns single point rows
+// forever counting how many it returned.
+type endlessStreamType struct {
+	served *int64
+}
+
+func (s endlessStreamType) Next() (models.Row, error) {
+	n := atomic.AddInt64(s.served, 1)
+	return newRow("cpu", nil, n*1000, 1), nil
+}
+
+func (s endlessStreamType) Close() error {
+	return nil
+}
+
+// endlessQueryerType is a streamingQueryerType with endless data.
+type endlessQueryerType struct {
+	served int64
+}
+
+func (q *endlessQueryerType) Query(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	logger log.Logger) (*client.Response, error) {
+	panic("endlessQueryerType cannot fit its data in a response")
+}
+
+func (q *endlessQueryerType) QueryStreams(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	chunkSize int,
+	logger log.Logger) ([]rowStreamType, error) {
+	return []rowStreamType{endlessStreamType{served: &q.served}}, nil
+}
+
+func TestRawPointBudget(t *testing.T) {
+	Convey("Going over the budget should stop reading right away", t, func() {
+		alpha, bravo := &endlessQueryerType{}, &endlessQueryerType{}
+		query, err := qlutils.NewQuery(
+			"select median(value) from cpu where time > now() - 1h", kPartialStart)
+		So(err, ShouldBeNil)
+		_, err = aggregateRawScottyRows(
+			context.Background(),
+			[]queryerType{alpha, bravo},
+			query.Statements[0],
+			rawMedian,
+			100,
+			"ns",
+			nil)
+		So(err, ShouldNotBeNil)
+		// Each scotty reads at most one row past the budget.
+		So(atomic.LoadInt64(&alpha.served)+atomic.LoadInt64(&bravo.served),
+			ShouldBeLessThanOrEqualTo, 102)
+	})
+}
@@ -0,0 +1,305 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prometheusAggregatorType tells how to translate an influx aggregation
+// to PromQL.
+type prometheusAggregatorType struct {
+	// Aggregates the values within each time bucket of a series
+	OverTime string
+	// Aggregates across series
+	Aggregator string
+}
+
+var (
+	// mean is missing because averaging the averages of each series is
+	// wrong when series have different numbers of samples.
+	// prometheusExpression divides the sum by the count instead.
+	kPrometheusAggregators = map[string]prometheusAggregatorType{
+		"sum":   {OverTime: "sum_over_time", Aggregator: "sum"},
+		"count": {OverTime: "count_over_time", Aggregator: "sum"},
+		"min":   {OverTime: "min_over_time", Aggregator: "min"},
+		"max":   {OverTime: "max_over_time", Aggregator: "max"},
+	}
+)
+
+// prometheusResponseType is the response from /api/v1/query and
+// /api/v1/query_range
+type prometheusResponseType struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			// Each value is [seconds since epoch, "value"]
+			Values [][]interface{} `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// prometheusMetric returns the prometheus metric for a measurement and
+// field. The field "value" maps to the measurement itself; any other field
+// maps to measurement_field.
+func prometheusMetric(measurement, field string) string {
+	if field == "value" {
+		return measurement
+	}
+	return measurement + "_" + field
+}
+
+// prometheusDuration returns d in PromQL format.
+func prometheusDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// prometheusRegex returns an influx regular expression as a PromQL regular
+// expression. PromQL anchors regular expressions; influx does not.
+func prometheusRegex(regex *regexp.Regexp) string {
+	return ".*(?:" + regex.String() + ").*"
+}
+
+// prometheusSelector returns the PromQL selector for a field in stmt.
+func prometheusSelector(stmt *simpleSelectType, field string) (
+	string, error) {
+	var matchers []string
+	for _, filter := range stmt.Filters {
+		var op, value string
+		switch filter.Op {
+		case influxql.EQ, influxql.NEQ:
+			if len(filter.Values) == 1 {
+				op, value = filter.Op.String(), filter.Values[0]
+			} else {
+				quoted := make([]string, len(filter.Values))
+				for i := range quoted {
+					quoted[i] = regexp.QuoteMeta(filter.Values[i])
+				}
+				op, value = "=~", strings.Join(quoted, "|")
+				if filter.Op == influxql.NEQ {
+					op = "!~"
+				}
+			}
+		case influxql.EQREGEX, influxql.NEQREGEX:
+			op, value = filter.Op.String(), prometheusRegex(filter.Regex)
+		default:
+			return "", qlutils.ErrUnsupported
+		}
+		matchers = append(
+			matchers, filter.Key+op+strconv.Quote(value))
+	}
+	return prometheusMetric(stmt.Measurement, field) +
+		"{" + strings.Join(matchers, ",") + "}", nil
+}
+
+// prometheusExpression returns the PromQL expression for field whose
+// values are aggregated over window.
+func prometheusExpression(
+	stmt *simpleSelectType,
+	field fieldType,
+	window time.Duration) (string, error) {
+	selector, err := prometheusSelector(stmt, field.Name)
+	if err != nil {
+		return "", err
+	}
+	rangeSelector := selector + "[" + prometheusDuration(window) + "]"
+	if field.Aggregate == "" {
+		return rangeSelector, nil
+	}
+	aggregate := func(aggregator prometheusAggregatorType) string {
+		return fmt.Sprintf(
+			"%s by (%s) (%s(%s))",
+			aggregator.Aggregator,
+			strings.Join(stmt.GroupByTags, ","),
+			aggregator.OverTime,
+			rangeSelector)
+	}
+	if field.Aggregate == "mean" {
+		return aggregate(kPrometheusAggregators["sum"]) + " / " +
+			aggregate(kPrometheusAggregators["count"]), nil
+	}
+	aggregator, ok := kPrometheusAggregators[field.Aggregate]
+	if !ok {
+		return "", qlutils.ErrUnsupported
+	}
+	return aggregate(aggregator), nil
+}
+
+// prometheusTime returns t, in nanoseconds since the epoch, as seconds
+// since the epoch. Like prometheus, prometheusTime uses millisecond
+// precision.
+func prometheusTime(t int64) string {
+	millis := t / int64(time.Millisecond)
+	return fmt.Sprintf("%d.%03d", millis/1000, millis%1000)
+}
+
+// prometheusValue returns a prometheus sample value as a json.Number or
+// nil if the value is not a finite number.
+func prometheusValue(value interface{}) interface{} {
+	str, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return json.Number(str)
+}
+
+// prometheusQueryerType is a dbQueryerType that translates influxql into
+// PromQL and runs it using the prometheus HTTP API.
+type prometheusQueryerType struct {
+	*httpEndpointType
+}
+
+func prometheusCreateDbQueryer(conn config.Connection) (
+	dbQueryerType, error) {
+	endpoint, err := newHTTPEndpoint(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &prometheusQueryerType{httpEndpointType: endpoint}, nil
+}
+
+// Ping checks that prometheus is up using its health endpoint.
+func (q *prometheusQueryerType) Ping(ctx context.Context) error {
+	return q.ping(ctx, "-/healthy")
+}
+
+// fetch runs a PromQL query against path with params and adds the results
+// for the field at fieldIdx to builder. offset is added to each timestamp
+// returned. If fixedTime is non-zero, it is used for every timestamp.
+func (q *prometheusQueryerType) fetch(
+	ctx context.Context,
+	path string,
+	params url.Values,
+	fieldIdx int,
+	offset time.Duration,
+	fixedTime int64,
+	builder *seriesBuilderType) error {
+	resp, err := q.Do(ctx, "POST", path, params, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var response prometheusResponseType
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return statusErrorf(
+			resp.StatusCode,
+			"unable to decode json: received status code %d err: %s",
+			resp.StatusCode, err)
+	}
+	if response.Status != "success" {
+		if response.Error != "" {
+			return statusErrorf(resp.StatusCode, "%s", response.Error)
+		}
+		return statusErrorf(
+			resp.StatusCode,
+			"received status code %d from server", resp.StatusCode)
+	}
+	if response.Data.ResultType != "matrix" {
+		return fmt.Errorf(
+			"Expected matrix from prometheus, got %s",
+			response.Data.ResultType)
+	}
+	for _, series := range response.Data.Result {
+		for _, sample := range series.Values {
+			if len(sample) != 2 {
+				return fmt.Errorf("Bad sample from prometheus: %v", sample)
+			}
+			ts, ok := sample[0].(json.Number)
+			if !ok {
+				return fmt.Errorf("Bad sample from prometheus: %v", sample)
+			}
+			seconds, err := ts.Float64()
+			if err != nil {
+				return err
+			}
+			t := fixedTime
+			if t == 0 {
+				millis := int64(math.Floor(seconds*1000 + 0.5))
+				t = millis*int64(time.Millisecond) + int64(offset)
+			}
+			builder.Add(series.Metric, fieldIdx, t, prometheusValue(sample[1]))
+		}
+	}
+	return nil
+}
+
+// Query runs queryStr, which must be a simple select statement, against
+// prometheus. Prometheus has no databases so database is ignored.
+func (q *prometheusQueryerType) Query(
+	ctx context.Context, queryStr, database, epoch string) (
+	*client.Response, error) {
+	stmt, err := parseSimpleSelect(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.Min.IsZero() || stmt.Max.IsZero() {
+		return nil, qlutils.ErrUnsupported
+	}
+	min, max := stmt.Min.UnixNano(), stmt.Max.UnixNano()
+	builder := newSeriesBuilder(stmt, epoch)
+	for i, field := range stmt.Fields {
+		params := url.Values{}
+		if field.Aggregate != "" && stmt.Interval > 0 {
+			// Prometheus evaluates each step over the window that ends at
+			// the step while influx labels each bucket with its start.
+			interval := int64(stmt.Interval)
+			start := min - min%interval
+			end := max - max%interval
+			expr, err := prometheusExpression(stmt, field, stmt.Interval)
+			if err != nil {
+				return nil, err
+			}
+			params.Set("query", expr)
+			params.Set("start", prometheusTime(start+interval))
+			params.Set("end", prometheusTime(end+interval))
+			params.Set("step", prometheusDuration(stmt.Interval))
+			if err := q.fetch(
+				ctx, "api/v1/query_range", params, i,
+				-stmt.Interval, 0, builder); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Window includes both min and max.
+		millis := int64(time.Millisecond)
+		window := time.Duration((max/millis - min/millis + 1) * millis)
+		expr, err := prometheusExpression(stmt, field, window)
+		if err != nil {
+			return nil, err
+		}
+		params.Set("query", expr)
+		params.Set("time", prometheusTime(max))
+		var fixedTime int64
+		if field.Aggregate != "" {
+			// Without GROUP BY time, influx reports the start time
+			fixedTime = min
+		}
+		if err := q.fetch(
+			ctx, "api/v1/query", params, i, 0, fixedTime, builder); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Response(), nil
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPrometheus(t *testing.T) {
+	Convey("Given a fake prometheus server", t, func() {
+		var lastPath string
+		var lastParams url.Values
+		responseBody := `{"status":"success","data":{"resultType":"matrix","result":[]}}`
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				lastPath = r.URL.Path
+				lastParams = r.Form
+				fmt.Fprintln(w, responseBody)
+			}))
+		defer server.Close()
+		queryer, err := prometheusCreateDbQueryer(
+			config.Connection{HostAndPort: server.URL})
+		So(err, ShouldBeNil)
+		defer queryer.Close()
+
+		Convey("Aggregate queries should use query_range", func() {
+			responseBody = `{"status":"success","data":{"resultType":"matrix","result":[
+{"metric":{"host":"b"},"values":[[1490000100,"NaN"]]},
+{"metric":{"host":"a"},"values":[[1490000100,"1"],[1490000160,"2.5"]]}
+]}}`
+			response, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where region = 'us' and time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m), host fill(none)",
+				"",
+				"s")
+			So(err, ShouldBeNil)
+			So(lastPath, ShouldEqual, "/api/v1/query_range")
+			So(lastParams.Get("query"), ShouldEqual, `sum by (host) (sum_over_time(cpu{region="us"}[60s])) / sum by (host) (count_over_time(cpu{region="us"}[60s]))`)
+			So(lastParams.Get("start"), ShouldEqual, "1490000100.000")
+			So(lastParams.Get("end"), ShouldEqual, "1490000160.000")
+			So(lastParams.Get("step"), ShouldEqual, "60s")
+			So(response, ShouldResemble, &client.Response{
+				Results: []client.Result{
+					{
+						Series: []models.Row{
+							{
+								Name:    "cpu",
+								Tags:    map[string]string{"host": "a"},
+								Columns: []string{"time", "mean"},
+								Values: [][]interface{}{
+									{json.Number("1490000040"), json.Number("1")},
+									{json.Number("1490000100"), json.Number("2.5")},
+								},
+							},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("Raw queries should use a range vector", func() {
+			responseBody = `{"status":"success","data":{"resultType":"matrix","result":[
+{"metric":{"__name__":"cpu_idle","host":"a"},"values":[[1490000050.5,"3"]]}
+]}}`
+			response, err := queryer.Query(
+				context.Background(),
+				"select idle from cpu where host =~ /^a/ and host != 'c' and time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z'",
+				"",
+				"ms")
+			So(err, ShouldBeNil)
+			So(lastPath, ShouldEqual, "/api/v1/query")
+			So(lastParams.Get("query"), ShouldEqual, `cpu_idle{host=~".*(?:^a).*",host!="c"}[120s]`)
+			So(lastParams.Get("time"), ShouldEqual, "1490000159.999")
+			So(response, ShouldResemble, &client.Response{
+				Results: []client.Result{
+					{
+						Series: []models.Row{
+							{
+								Name:    "cpu",
+								Columns: []string{"time", "idle"},
+								Values: [][]interface{}{
+									{json.Number("1490000050500"), json.Number("3")},
+								},
+							},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("Errors should be reported", func() {
+			responseBody = `{"status":"error","errorType":"bad_data","error":"parse error"}`
+			_, err := queryer.Query(
+				context.Background(),
+				"select mean(value) from cpu where time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m)",
+				"",
+				"s")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unsupported aggregations should fail", func() {
+			_, err := queryer.Query(
+				context.Background(),
+				"select median(value) from cpu where time >= '2017-03-20T08:54:00Z' and time < '2017-03-20T08:56:00Z' group by time(1m)",
+				"",
+				"s")
+			So(err, ShouldEqual, qlutils.ErrUnsupported)
+		})
+	})
+}
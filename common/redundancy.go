@@ -0,0 +1,249 @@
+package common
+
+import (
+	"context"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/responses"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How long a failed query counts as taking when choosing the scotty
+	// with the least latency.
+	kFailedScottyLatency = time.Minute
+)
+
+// scottyAttemptType runs a query against a single scotty.
+type scottyAttemptType func(
+	ctx context.Context, s *Scotty) (interface{}, error)
+
+// mergesAll returns true if queries go to every scotty in this list.
+func (l *ScottyList) mergesAll() bool {
+	return l.strategy == config.StrategyMergeAll
+}
+
+// order returns the indexes of the scotties in this list in the order
+// to try them.
+func (l *ScottyList) order() []int {
+	result := make([]int, len(l.instances))
+	for i := range result {
+		result[i] = i
+	}
+	switch l.strategy {
+	case config.StrategyRoundRobin:
+		start := int((atomic.AddUint32(&l.next, 1) - 1) % uint32(len(result)))
+		for i := range result {
+			result[i] = (start + i) % len(result)
+		}
+	case config.StrategyLeastLatency:
+		l.lock.Lock()
+		latencies := make([]time.Duration, len(l.latencies))
+		copy(latencies, l.latencies)
+		l.lock.Unlock()
+		sort.SliceStable(result, func(i, j int) bool {
+			return latencies[result[i]] < latencies[result[j]]
+		})
+	}
+	return result
+}
+
+func (l *ScottyList) recordLatency(i int, latency time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.latencies[i] == 0 {
+		l.latencies[i] = latency
+	} else {
+		l.latencies[i] = (3*l.latencies[i] + latency) / 4
+	}
+}
+
+// timedAttempt runs attempt against the ith scotty recording how long it
+// took. Attempts abandoned by cancelling ctx don't count.
+func (l *ScottyList) timedAttempt(
+	ctx context.Context, i int, attempt scottyAttemptType) (
+	interface{}, error) {
+	start := time.Now()
+	result, err := attempt(ctx, l.instances[i])
+	if ctx.Err() == nil {
+		latency := time.Since(start)
+		if err != nil {
+			latency = kFailedScottyLatency
+		}
+		l.recordLatency(i, latency)
+	}
+	return result, err
+}
+
+// pick runs attempt against the scotties in this list according to the
+// strategy of this list and returns the first successful result along
+// with the function that cancels the context of that result. Callers call
+// that function once done with the result. discard, if non-nil, frees
+// successful results that lose a hedged race.
+func (l *ScottyList) pick(
+	ctx context.Context,
+	attempt scottyAttemptType,
+	discard func(interface{}),
+	logger log.Logger) (interface{}, context.CancelFunc, error) {
+	order := l.order()
+	if l.strategy == config.StrategyHedged {
+		return l.hedge(ctx, order, attempt, discard, logger)
+	}
+	var lastErr error
+	for j, i := range order {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		result, err := l.timedAttempt(attemptCtx, i, attempt)
+		if err == nil {
+			return result, cancel, nil
+		}
+		cancel()
+		if j < len(order)-1 {
+			logError(logger, err)
+		}
+		lastErr = err
+	}
+	return nil, nil, lastErr
+}
+
+// hedge works like pick for config.StrategyHedged. hedge tries the next
+// scotty in order whenever the scotties tried so far have all failed or
+// hedgeDelay passes without a response.
+func (l *ScottyList) hedge(
+	ctx context.Context,
+	order []int,
+	attempt scottyAttemptType,
+	discard func(interface{}),
+	logger log.Logger) (interface{}, context.CancelFunc, error) {
+	type resultType struct {
+		index int
+		value interface{}
+		err   error
+	}
+	results := make(chan resultType, len(order))
+	cancels := make([]context.CancelFunc, len(order))
+	launched, outstanding := 0, 0
+	timer := time.NewTimer(l.hedgeDelay)
+	defer timer.Stop()
+	launch := func() {
+		j := launched
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[j] = cancel
+		go func() {
+			value, err := l.timedAttempt(attemptCtx, order[j], attempt)
+			results <- resultType{index: j, value: value, err: err}
+		}()
+		launched++
+		outstanding++
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(l.hedgeDelay)
+	}
+	launch()
+	var lastErr error
+	for outstanding > 0 {
+		select {
+		case <-timer.C:
+			if launched < len(order) {
+				launch()
+			}
+		case result := <-results:
+			outstanding--
+			if result.err == nil {
+				for j := 0; j < launched; j++ {
+					if j != result.index {
+						cancels[j]()
+					}
+				}
+				// Free the results of the losers as they come in.
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						late := <-results
+						if late.err == nil && discard != nil {
+							discard(late.value)
+						}
+					}
+				}(outstanding)
+				return result.value, cancels[result.index], nil
+			}
+			cancels[result.index]()
+			logError(logger, result.err)
+			lastErr = result.err
+			if outstanding == 0 && launched < len(order) {
+				launch()
+			}
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// queryOne runs query against one of the scotties in this list according
+// to the strategy of this list.
+func (l *ScottyList) queryOne(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	logger log.Logger) (*client.Response, error) {
+	metadata := isMetadataQuery(query)
+	result, cancel, err := l.pick(
+		ctx,
+		func(ctx context.Context, s *Scotty) (interface{}, error) {
+			response, err := s.Query(ctx, query, epoch, now, logger)
+			if err == nil && response.Error() != nil {
+				err = response.Error()
+			}
+			if err != nil {
+				return nil, err
+			}
+			if metadata {
+				return unionMetadataResponses(response), nil
+			}
+			return responses.Merge(response)
+		},
+		nil,
+		logger)
+	if err != nil {
+		return nil, err
+	}
+	cancel()
+	return result.(*client.Response), nil
+}
+
+// queryOneStreams works like queryStreams for strategies other than
+// config.StrategyMergeAll.
+func (l *ScottyList) queryOneStreams(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	chunkSize int,
+	logger log.Logger) ([]rowStreamType, error) {
+	result, cancel, err := l.pick(
+		ctx,
+		func(ctx context.Context, s *Scotty) (interface{}, error) {
+			streams, err := s.queryStreams(
+				ctx, query, epoch, now, chunkSize, logger)
+			if err != nil {
+				return nil, err
+			}
+			return streams, nil
+		},
+		func(result interface{}) {
+			for _, stream := range result.([]rowStreamType) {
+				stream.Close()
+			}
+		},
+		logger)
+	if err != nil {
+		return nil, err
+	}
+	return withCancelOnClose(result.([]rowStreamType), cancel), nil
+}
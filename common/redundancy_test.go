@@ -0,0 +1,136 @@
+package common
+
+import (
+	"context"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestScottyStrategies(t *testing.T) {
+	now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+	query, err := qlutils.NewQuery(
+		"select mean(value) from dual where time >= now() - 1h", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newStore := func() dbQueryerStoreType {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1200, 12), nil)
+		return store
+	}
+
+	newDb := func(
+		store dbQueryerStoreType,
+		redundancy *config.Redundancy) (*Database, error) {
+		return newDatabaseForTesting(
+			config.Database{
+				Name: "redundant",
+				Scotties: config.ScottyList{
+					{HostAndPort: "alpha"},
+					{HostAndPort: "bravo"},
+				},
+				Redundancy: redundancy,
+			},
+			store.Create)
+	}
+
+	Convey("First healthy should use the first scotty that works", t, func() {
+		store := newStore()
+		db, err := newDb(
+			store, &config.Redundancy{Strategy: config.StrategyFirstHealthy})
+		So(err, ShouldBeNil)
+		response, err := db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, newResponse(1000, 10))
+		So(store["bravo"].NoMoreQueries(), ShouldBeTrue)
+
+		store["alpha"].WhenQueriedReturn(nil, kErrSomeError)
+		response, err = db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, newResponse(1200, 12))
+
+		store["bravo"].WhenQueriedReturn(nil, kErrSomeError)
+		_, err = db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldEqual, kErrSomeError)
+	})
+
+	Convey("Round robin should take turns", t, func() {
+		store := newStore()
+		db, err := newDb(
+			store, &config.Redundancy{Strategy: config.StrategyRoundRobin})
+		So(err, ShouldBeNil)
+		for _, expected := range [][]int64{
+			{1000, 10}, {1200, 12}, {1000, 10},
+		} {
+			response, err := db.Query(
+				context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(expected...))
+		}
+	})
+
+	Convey("Least latency should use the fastest scotty", t, func() {
+		store := newStore()
+		db, err := newDb(
+			store, &config.Redundancy{Strategy: config.StrategyLeastLatency})
+		So(err, ShouldBeNil)
+		db.scotties.latencies[0] = time.Second
+		db.scotties.latencies[1] = time.Millisecond
+		response, err := db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, newResponse(1200, 12))
+		So(store["alpha"].NoMoreQueries(), ShouldBeTrue)
+
+		// A failure should send later queries elsewhere
+		store["bravo"].WhenQueriedReturn(nil, kErrSomeError)
+		response, err = db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, newResponse(1000, 10))
+		So(db.scotties.latencies[1], ShouldBeGreaterThan, time.Second)
+	})
+
+	Convey("Given hedged scotties where the first hangs", t, func() {
+		store := newStore()
+		store["alpha"].WhenQueriedHang()
+		db, err := newDb(
+			store,
+			&config.Redundancy{
+				Strategy:   config.StrategyHedged,
+				HedgeDelay: 10 * time.Millisecond,
+			})
+		So(err, ShouldBeNil)
+
+		Convey("The second should answer", func() {
+			response, err := db.Query(
+				context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1200, 12))
+			queryStr, _, _ := store["alpha"].NextQuery()
+			So(queryStr, ShouldEqual, "SELECT mean(value) FROM dual WHERE time >= '2016-11-30T23:01:00Z'")
+		})
+
+		Convey("The second should answer streams too", func() {
+			var recorder rowRecorderType
+			err := db.QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				{newRow("alpha", nil, 1200, 12)},
+			})
+		})
+	})
+
+	Convey("Unknown strategies should fail", t, func() {
+		_, err := newDb(newStore(), &config.Redundancy{Strategy: "random"})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,509 @@
+package common
+
+import (
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"strings"
+	"time"
+)
+
+// withResolution returns query rewritten for a backend whose data is
+// downsampled to resolution. GROUP BY time intervals finer than resolution
+// become resolution. Raw selects become mean selects grouped by resolution
+// that keep the original column names. withResolution fails on raw selects
+// it cannot rewrite such as SELECT *. If resolution is 0, withResolution
+// returns query unchanged.
+func withResolution(query *influxql.Query, resolution time.Duration) (
+	*influxql.Query, error) {
+	if resolution == 0 {
+		return query, nil
+	}
+	result := &influxql.Query{
+		Statements: make(influxql.Statements, len(query.Statements)),
+	}
+	for i, stmt := range query.Statements {
+		selectStmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			result.Statements[i] = stmt
+			continue
+		}
+		var err error
+		result.Statements[i], err = selectWithResolution(
+			selectStmt, resolution)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func selectWithResolution(
+	stmt *influxql.SelectStatement, resolution time.Duration) (
+	*influxql.SelectStatement, error) {
+	interval, err := stmt.GroupByInterval()
+	if err != nil {
+		return nil, err
+	}
+	if len(stmt.FunctionCalls()) != 0 {
+		if interval == 0 || interval >= resolution {
+			return stmt, nil
+		}
+		result := stmt.Clone()
+		setGroupByInterval(result, resolution)
+		return result, nil
+	}
+	result := stmt.Clone()
+	for _, field := range result.Fields {
+		ref, ok := field.Expr.(*influxql.VarRef)
+		if !ok {
+			return nil, fmt.Errorf(
+				"Raw select %s needs data finer than %v", stmt, resolution)
+		}
+		field.Alias = field.Name()
+		field.Expr = &influxql.Call{Name: "mean", Args: []influxql.Expr{ref}}
+	}
+	setGroupByInterval(result, resolution)
+	// Raw selects have no empty buckets.
+	result.Fill = influxql.NoFill
+	result.FillValue = nil
+	return result, nil
+}
+
+// setGroupByInterval changes the GROUP BY time interval of stmt to
+// interval adding GROUP BY time if needed.
+func setGroupByInterval(
+	stmt *influxql.SelectStatement, interval time.Duration) {
+	for _, dimension := range stmt.Dimensions {
+		call, ok := dimension.Expr.(*influxql.Call)
+		if ok && call.Name == "time" && len(call.Args) != 0 {
+			call.Args[0] = &influxql.DurationLiteral{Val: interval}
+			return
+		}
+	}
+	stmt.Dimensions = append(stmt.Dimensions, &influxql.Dimension{
+		Expr: &influxql.Call{
+			Name: "time",
+			Args: []influxql.Expr{&influxql.DurationLiteral{Val: interval}},
+		},
+	})
+}
+
+// alignTimeRanges returns query with the time range of each select
+// statement with GROUP BY time snapped to boundaries of its interval so
+// that queries made at slightly different times are the same. now stands
+// in for missing end times. Statements without GROUP BY time stay the
+// same.
+func alignTimeRanges(query *influxql.Query, now time.Time) (
+	*influxql.Query, error) {
+	result := &influxql.Query{
+		Statements: make(influxql.Statements, len(query.Statements)),
+	}
+	for i, stmt := range query.Statements {
+		selectStmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			result.Statements[i] = stmt
+			continue
+		}
+		var err error
+		result.Statements[i], err = alignSelect(selectStmt, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// queryEnd returns the time that the time ranges of the select statements
+// in query end, exclusive, or now if that is later. Since there is no data
+// after now, querying up to queryEnd rather than now gives the same
+// results while keeping aligned end times the same from query to query.
+func queryEnd(query *influxql.Query, now time.Time) time.Time {
+	result := now
+	for _, stmt := range query.Statements {
+		selectStmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			continue
+		}
+		_, max, err := influxql.TimeRange(selectStmt.Condition)
+		if err != nil || max.IsZero() {
+			return now
+		}
+		// TimeRange makes max inclusive.
+		if max = max.Add(time.Nanosecond); max.After(result) {
+			result = max
+		}
+	}
+	return result
+}
+
+// alignSelect works like alignTimeRanges for a single statement. The
+// start of the time range snaps up to the start of the first whole
+// interval, so the results leave out the interval that the original start
+// cuts short, and every interval left has the same value as it would
+// without aligning. If the time range lies within one interval,
+// alignSelect returns stmt unchanged.
+func alignSelect(stmt *influxql.SelectStatement, now time.Time) (
+	*influxql.SelectStatement, error) {
+	interval, err := stmt.GroupByInterval()
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		return stmt, nil
+	}
+	offset, err := stmt.GroupByOffset()
+	if err != nil {
+		return nil, err
+	}
+	rest, ok := withoutTimeRange(stmt.Condition)
+	if !ok {
+		return stmt, nil
+	}
+	min, max, err := influxql.TimeRange(stmt.Condition)
+	if err != nil {
+		return nil, err
+	}
+	if max.IsZero() {
+		max = now
+	} else {
+		// TimeRange makes max inclusive.
+		max = max.Add(time.Nanosecond)
+	}
+	// Like influx, intervals start at multiples of interval plus offset.
+	max = ceilTime(max.Add(-offset), interval).Add(offset)
+	var timeExpr influxql.Expr = &influxql.BinaryExpr{
+		Op:  influxql.LT,
+		LHS: &influxql.VarRef{Val: "time"},
+		RHS: &influxql.TimeLiteral{Val: max.UTC()},
+	}
+	if !min.IsZero() {
+		min = ceilTime(min.Add(-offset), interval).Add(offset)
+		if !min.Before(max) {
+			return stmt, nil
+		}
+		timeExpr = &influxql.BinaryExpr{
+			Op: influxql.AND,
+			LHS: &influxql.BinaryExpr{
+				Op:  influxql.GTE,
+				LHS: &influxql.VarRef{Val: "time"},
+				RHS: &influxql.TimeLiteral{Val: min.UTC()},
+			},
+			RHS: timeExpr,
+		}
+	}
+	result := stmt.Clone()
+	result.Condition = timeExpr
+	if rest != nil {
+		result.Condition = &influxql.BinaryExpr{
+			Op:  influxql.AND,
+			LHS: rest,
+			RHS: timeExpr,
+		}
+	}
+	return result, nil
+}
+
+// withoutTimeRange returns expr without the comparisons of time in its
+// top level AND terms. ok is false if time appears anywhere else in expr.
+func withoutTimeRange(expr influxql.Expr) (result influxql.Expr, ok bool) {
+	switch e := expr.(type) {
+	case nil:
+		return nil, true
+	case *influxql.ParenExpr:
+		inner, ok := withoutTimeRange(e.Expr)
+		if !ok || inner == nil {
+			return nil, ok
+		}
+		return &influxql.ParenExpr{Expr: inner}, true
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.AND:
+			lhs, ok := withoutTimeRange(e.LHS)
+			if !ok {
+				return nil, false
+			}
+			rhs, ok := withoutTimeRange(e.RHS)
+			if !ok {
+				return nil, false
+			}
+			if lhs == nil {
+				return rhs, true
+			}
+			if rhs == nil {
+				return lhs, true
+			}
+			return &influxql.BinaryExpr{
+				Op: influxql.AND, LHS: lhs, RHS: rhs}, true
+		case influxql.LT, influxql.LTE, influxql.GT, influxql.GTE:
+			if isTimeRef(e.LHS) || isTimeRef(e.RHS) {
+				return nil, true
+			}
+		}
+	}
+	found := false
+	influxql.WalkFunc(expr, func(node influxql.Node) {
+		if ref, ok := node.(influxql.Expr); ok && isTimeRef(ref) {
+			found = true
+		}
+	})
+	return expr, !found
+}
+
+func isTimeRef(expr influxql.Expr) bool {
+	ref, ok := expr.(*influxql.VarRef)
+	return ok && strings.ToLower(ref.Val) == "time"
+}
+
+// namesType maps the retention policy, measurement names, and field names
+// in queries to the ones a backend uses.
+type namesType struct {
+	retentionPolicy string
+	// {measurement} stands for the measurement name in the query.
+	measurement string
+	// {field} stands for the field name in the query; {aggregate} stands
+	// for the aggregation applied to the field.
+	field string
+}
+
+// newNames returns the names that influx uses or nil if influx uses the
+// same names as queries.
+func newNames(influx config.Influx) *namesType {
+	if influx.RetentionPolicy == "" &&
+		influx.Measurement == "" &&
+		influx.Field == "" {
+		return nil
+	}
+	return &namesType{
+		retentionPolicy: influx.RetentionPolicy,
+		measurement:     influx.Measurement,
+		field:           influx.Field,
+	}
+}
+
+// Query returns query using the names of this instance. Query also
+// returns the original name of each renamed measurement for each
+// statement in query. If n is nil, Query returns query unchanged.
+func (n *namesType) Query(query *influxql.Query) (
+	*influxql.Query, []map[string]string, error) {
+	if n == nil {
+		return query, nil, nil
+	}
+	result := &influxql.Query{
+		Statements: make(influxql.Statements, len(query.Statements)),
+	}
+	originals := make([]map[string]string, len(query.Statements))
+	for i, stmt := range query.Statements {
+		selectStmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			result.Statements[i] = stmt
+			continue
+		}
+		var err error
+		result.Statements[i], originals[i], err = n.selectStmt(selectStmt)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return result, originals, nil
+}
+
+func (n *namesType) selectStmt(stmt *influxql.SelectStatement) (
+	*influxql.SelectStatement, map[string]string, error) {
+	result := stmt.Clone()
+	var originals map[string]string
+	for _, source := range result.Sources {
+		measurement, ok := source.(*influxql.Measurement)
+		if !ok {
+			continue
+		}
+		if measurement.RetentionPolicy == "" {
+			measurement.RetentionPolicy = n.retentionPolicy
+		}
+		if n.measurement == "" || measurement.Regex != nil {
+			continue
+		}
+		name := strings.Replace(
+			n.measurement, "{measurement}", measurement.Name, -1)
+		if name == measurement.Name {
+			continue
+		}
+		if originals == nil {
+			originals = make(map[string]string)
+		}
+		originals[name] = measurement.Name
+		measurement.Name = name
+	}
+	if n.field != "" {
+		for _, field := range result.Fields {
+			column := field.Name()
+			expr, err := n.fieldExpr(field.Expr, "")
+			if err != nil {
+				return nil, nil, err
+			}
+			field.Expr = expr
+			if field.Name() != column {
+				field.Alias = column
+			}
+		}
+		if result.Condition != nil {
+			condition, err := n.condition(result.Condition)
+			if err != nil {
+				return nil, nil, err
+			}
+			result.Condition = condition
+		}
+	}
+	return result, originals, nil
+}
+
+// fieldName returns the renamed field. aggregate is the aggregation
+// applied to the field if any. Raw values have no aggregation, so
+// fieldName fails for them if the field template uses {aggregate}.
+func (n *namesType) fieldName(field, aggregate string) (string, error) {
+	if aggregate == "" && strings.Contains(n.field, "{aggregate}") {
+		return "", fmt.Errorf(
+			"Raw values of %s can't be renamed with %s", field, n.field)
+	}
+	name := strings.Replace(n.field, "{field}", field, -1)
+	return strings.Replace(name, "{aggregate}", aggregate, -1), nil
+}
+
+// fieldExpr returns expr with its fields renamed. aggregate is the
+// aggregation applied to expr if any.
+func (n *namesType) fieldExpr(
+	expr influxql.Expr, aggregate string) (influxql.Expr, error) {
+	switch e := expr.(type) {
+	case *influxql.VarRef:
+		name, err := n.fieldName(e.Val, aggregate)
+		if err != nil {
+			return nil, err
+		}
+		return &influxql.VarRef{Val: name, Type: e.Type}, nil
+	case *influxql.Call:
+		args := make([]influxql.Expr, len(e.Args))
+		for i := range e.Args {
+			var err error
+			if args[i], err = n.fieldExpr(e.Args[i], e.Name); err != nil {
+				return nil, err
+			}
+		}
+		return &influxql.Call{Name: e.Name, Args: args}, nil
+	case *influxql.BinaryExpr:
+		lhs, err := n.fieldExpr(e.LHS, aggregate)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := n.fieldExpr(e.RHS, aggregate)
+		if err != nil {
+			return nil, err
+		}
+		return &influxql.BinaryExpr{Op: e.Op, LHS: lhs, RHS: rhs}, nil
+	case *influxql.ParenExpr:
+		inner, err := n.fieldExpr(e.Expr, aggregate)
+		if err != nil {
+			return nil, err
+		}
+		return &influxql.ParenExpr{Expr: inner}, nil
+	}
+	return expr, nil
+}
+
+// condition returns the WHERE clause expr with its fields renamed. Like
+// influx, condition takes a name compared to a string or regular
+// expression to be a tag unless it is marked ::field.
+func (n *namesType) condition(expr influxql.Expr) (influxql.Expr, error) {
+	switch e := expr.(type) {
+	case *influxql.ParenExpr:
+		inner, err := n.condition(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &influxql.ParenExpr{Expr: inner}, nil
+	case *influxql.BinaryExpr:
+		if e.Op == influxql.AND || e.Op == influxql.OR {
+			lhs, err := n.condition(e.LHS)
+			if err != nil {
+				return nil, err
+			}
+			rhs, err := n.condition(e.RHS)
+			if err != nil {
+				return nil, err
+			}
+			return &influxql.BinaryExpr{Op: e.Op, LHS: lhs, RHS: rhs}, nil
+		}
+		if isTimeRef(e.LHS) || isTimeRef(e.RHS) {
+			return e, nil
+		}
+		lhs, err := n.conditionOperand(e.LHS, e.RHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := n.conditionOperand(e.RHS, e.LHS)
+		if err != nil {
+			return nil, err
+		}
+		return &influxql.BinaryExpr{Op: e.Op, LHS: lhs, RHS: rhs}, nil
+	}
+	return expr, nil
+}
+
+// conditionOperand returns expr, one side of a comparison, with its
+// fields renamed. other is the other side of the comparison.
+func (n *namesType) conditionOperand(expr, other influxql.Expr) (
+	influxql.Expr, error) {
+	ref, ok := expr.(*influxql.VarRef)
+	if !ok {
+		return n.fieldExpr(expr, "")
+	}
+	if ref.Type == influxql.Tag {
+		return expr, nil
+	}
+	if ref.Type == influxql.Unknown {
+		switch other.(type) {
+		case *influxql.StringLiteral, *influxql.RegexLiteral:
+			return expr, nil
+		}
+	}
+	return n.fieldExpr(expr, "")
+}
+
+// restoreNames changes the names of the series in response back to their
+// original measurement names. originals comes from namesType.Query.
+func restoreNames(response *client.Response, originals []map[string]string) {
+	if response == nil {
+		return
+	}
+	for i := range response.Results {
+		if i >= len(originals) {
+			return
+		}
+		for j := range response.Results[i].Series {
+			restoreName(&response.Results[i].Series[j], originals[i])
+		}
+	}
+}
+
+func restoreName(row *models.Row, originals map[string]string) {
+	if original, ok := originals[row.Name]; ok {
+		row.Name = original
+	}
+}
+
+// restoreNamesStreamType changes the names of the series from a stream
+// back to their original measurement names.
+type restoreNamesStreamType struct {
+	rowStreamType
+	originals map[string]string
+}
+
+func (s *restoreNamesStreamType) Next() (models.Row, error) {
+	row, err := s.rowStreamType.Next()
+	if err != nil {
+		return row, err
+	}
+	restoreName(&row, s.originals)
+	return row, nil
+}
@@ -0,0 +1,379 @@
+package common
+
+import (
+	"context"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestWithResolution(t *testing.T) {
+	now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "Finer GROUP BY time should become the resolution",
+			query:    "select mean(value) from cpu where time >= now() - 1h group by time(1m), host fill(0)",
+			expected: "SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T23:01:00Z' GROUP BY time(5m), host fill(0)",
+		},
+		{
+			name:     "Coarser GROUP BY time should stay",
+			query:    "select max(value) from cpu where time >= now() - 1h group by time(1h)",
+			expected: "SELECT max(value) FROM cpu WHERE time >= '2016-11-30T23:01:00Z' GROUP BY time(1h)",
+		},
+		{
+			name:     "Aggregations without GROUP BY time should stay",
+			query:    "select count(value) from cpu where time >= now() - 1h group by host",
+			expected: "SELECT count(value) FROM cpu WHERE time >= '2016-11-30T23:01:00Z' GROUP BY host",
+		},
+		{
+			name:     "Raw selects should become means",
+			query:    "select value, idle as i from cpu where time >= now() - 1h group by host",
+			expected: "SELECT mean(value) AS value, mean(idle) AS i FROM cpu WHERE time >= '2016-11-30T23:01:00Z' GROUP BY host, time(5m) fill(none)",
+		},
+		{
+			name:     "Show statements should stay",
+			query:    "show measurements",
+			expected: "SHOW MEASUREMENTS",
+		},
+	}
+	for _, testCase := range testCases {
+		Convey(testCase.name, t, func() {
+			query, err := qlutils.NewQuery(testCase.query, now)
+			So(err, ShouldBeNil)
+			rewritten, err := withResolution(query, 5*time.Minute)
+			So(err, ShouldBeNil)
+			So(rewritten.String(), ShouldEqual, testCase.expected)
+		})
+	}
+
+	Convey("Raw selects of expressions should fail", t, func() {
+		query, err := qlutils.NewQuery(
+			"select * from cpu where time >= now() - 1h", now)
+		So(err, ShouldBeNil)
+		_, err = withResolution(query, 5*time.Minute)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given influxes with resolutions", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1200, 12), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "resolution",
+				Influxes: config.InfluxList{
+					{
+						HostAndPort: "alpha",
+						Database:    "a",
+						Duration:    100 * time.Hour,
+						Resolution:  time.Hour,
+					},
+					{
+						HostAndPort: "bravo",
+						Database:    "b",
+						Duration:    10 * time.Hour,
+					},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+
+		Convey("Each influx should get its own GROUP BY time", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from cpu where time >= now() - 20h group by time(10m)",
+				now)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1000, 10, 1200, 12))
+			queryStr, _, _ := store["alpha"].NextQuery()
+			So(queryStr, ShouldEqual, "SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T04:01:00Z' AND time < '2016-12-01T00:01:00Z' GROUP BY time(1h)")
+			queryStr, _, _ = store["bravo"].NextQuery()
+			So(queryStr, ShouldEqual, "SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T14:01:00Z' AND time < '2016-12-01T00:01:00Z' GROUP BY time(10m)")
+		})
+	})
+}
+
+func TestNames(t *testing.T) {
+	now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+	names := newNames(config.Influx{
+		RetentionPolicy: "downsampled",
+		Measurement:     "{measurement}_1h",
+		Field:           "{aggregate}_{field}",
+	})
+	testCases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "Aggregations should use renamed fields",
+			query:    "select mean(value) from cpu where time >= now() - 1h group by time(1h)",
+			expected: "SELECT mean(mean_value) FROM downsampled.cpu_1h WHERE time >= '2016-11-30T23:01:00Z' GROUP BY time(1h)",
+		},
+		{
+			name:     "Expressions and arguments should work",
+			query:    "select max(idle) * 2, percentile(value, 95) from cpu where time >= now() - 1h",
+			expected: "SELECT max(max_idle) * 2, percentile(percentile_value, 95) FROM downsampled.cpu_1h WHERE time >= '2016-11-30T23:01:00Z'",
+		},
+		{
+			name:     "Renamed raw fields should keep their column names",
+			query:    "select mean(value) as value from cpu where time >= now() - 1h",
+			expected: "SELECT mean(mean_value) AS value FROM downsampled.cpu_1h WHERE time >= '2016-11-30T23:01:00Z'",
+		},
+		{
+			name:     "Tags in conditions should keep their names",
+			query:    "select max(value) from cpu where host = 'a' and region =~ /us/ and time >= now() - 1h",
+			expected: "SELECT max(max_value) FROM downsampled.cpu_1h WHERE host = 'a' AND region =~ /us/ AND time >= '2016-11-30T23:01:00Z'",
+		},
+		{
+			name:     "Regular expressions should get only the retention policy",
+			query:    "select max(value) from /cpu.*/ where time >= now() - 1h",
+			expected: "SELECT max(max_value) FROM downsampled./cpu.*/ WHERE time >= '2016-11-30T23:01:00Z'",
+		},
+	}
+	for _, testCase := range testCases {
+		Convey(testCase.name, t, func() {
+			query, err := qlutils.NewQuery(testCase.query, now)
+			So(err, ShouldBeNil)
+			renamed, _, err := names.Query(query)
+			So(err, ShouldBeNil)
+			So(renamed.String(), ShouldEqual, testCase.expected)
+		})
+	}
+
+	Convey("Raw values can't be renamed with {aggregate}", t, func() {
+		query, err := qlutils.NewQuery(
+			"select value from cpu where time >= now() - 1h", now)
+		So(err, ShouldBeNil)
+		_, _, err = names.Query(query)
+		So(err, ShouldNotBeNil)
+		query, err = qlutils.NewQuery(
+			"select max(value) from cpu where value > 5 and time >= now() - 1h",
+			now)
+		So(err, ShouldBeNil)
+		_, _, err = names.Query(query)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Fields in conditions should be renamed", t, func() {
+		query, err := qlutils.NewQuery(
+			"select value from cpu where (value > 5 or idle::field = 'x') and host = 'a' and dc::tag = 3 and time >= now() - 1h",
+			now)
+		So(err, ShouldBeNil)
+		renamed, _, err := newNames(config.Influx{Field: "{field}_raw"}).Query(
+			query)
+		So(err, ShouldBeNil)
+		So(renamed.String(), ShouldEqual, "SELECT value_raw AS value FROM cpu WHERE (value_raw > 5 OR idle_raw::field = 'x') AND host = 'a' AND dc::tag = 3 AND time >= '2016-11-30T23:01:00Z'")
+	})
+
+	Convey("No renaming should leave queries alone", t, func() {
+		query, err := qlutils.NewQuery("select mean(value) from cpu", now)
+		So(err, ShouldBeNil)
+		renamed, originals, err := newNames(config.Influx{}).Query(query)
+		So(err, ShouldBeNil)
+		So(renamed, ShouldEqual, query)
+		So(originals, ShouldBeNil)
+	})
+
+	Convey("Given an influx with renamed measurements and fields", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(
+			newResponseWithTags("cpu_1h", nil, 1000, 10), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "names",
+				Influxes: config.InfluxList{
+					{
+						HostAndPort:     "alpha",
+						Database:        "a",
+						Duration:        100 * time.Hour,
+						RetentionPolicy: "downsampled",
+						Measurement:     "{measurement}_1h",
+						Field:           "{aggregate}_{field}",
+					},
+				},
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		query, err := qlutils.NewQuery(
+			"select mean(value) from cpu where time >= now() - 2h group by time(1h)",
+			now)
+		So(err, ShouldBeNil)
+
+		Convey("Series should come back with the original names", func() {
+			response, err := db.Query(
+				context.Background(), query, "ms", now, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponseWithTags(
+				"cpu", nil, 1000, 10))
+			queryStr, database, _ := store["alpha"].NextQuery()
+			So(queryStr, ShouldEqual, "SELECT mean(mean_value) FROM downsampled.cpu_1h WHERE time >= '2016-11-30T22:01:00Z' AND time < '2016-12-01T00:01:00Z' GROUP BY time(1h)")
+			So(database, ShouldEqual, "a")
+		})
+
+		Convey("Streamed series should come back with the original names", func() {
+			var recorder rowRecorderType
+			err := db.QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				{newRow("cpu", nil, 1000, 10)},
+			})
+		})
+	})
+}
+
+func TestAlignTimeRanges(t *testing.T) {
+	now := time.Date(2016, 12, 1, 0, 3, 20, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "Start and end should snap up to GROUP BY time boundaries",
+			query:    "select mean(value) from cpu where time >= now() - 1h and host = 'a' group by time(10m)",
+			expected: "SELECT mean(value) FROM cpu WHERE host = 'a' AND time >= '2016-11-30T23:10:00Z' AND time < '2016-12-01T00:10:00Z' GROUP BY time(10m)",
+		},
+		{
+			name:     "Explicit end times should snap up",
+			query:    "select max(value) from cpu where time >= now() - 1h and time < now() - 2m group by time(5m)",
+			expected: "SELECT max(value) FROM cpu WHERE time >= '2016-11-30T23:05:00Z' AND time < '2016-12-01T00:05:00Z' GROUP BY time(5m)",
+		},
+		{
+			name:     "Boundaries should honour offsets",
+			query:    "select mean(value) from cpu where time >= now() - 1h group by time(10m, 1m)",
+			expected: "SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T23:11:00Z' AND time < '2016-12-01T00:11:00Z' GROUP BY time(10m, 1m)",
+		},
+		{
+			name:     "Time ranges within one interval should stay",
+			query:    "select mean(value) from cpu where time >= now() - 2m and time < now() - 1m group by time(1h)",
+			expected: "SELECT mean(value) FROM cpu WHERE time >= '2016-12-01T00:01:20Z' AND time < '2016-12-01T00:02:20Z' GROUP BY time(1h)",
+		},
+		{
+			name:     "Raw selects should stay",
+			query:    "select value from cpu where time >= now() - 1h",
+			expected: "SELECT value FROM cpu WHERE time >= '2016-11-30T23:03:20Z'",
+		},
+		{
+			name:     "Time in OR should stay",
+			query:    "select mean(value) from cpu where time >= now() - 1h or host = 'a' group by time(10m)",
+			expected: "SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T23:03:20Z' OR host = 'a' GROUP BY time(10m)",
+		},
+	}
+	for _, testCase := range testCases {
+		Convey(testCase.name, t, func() {
+			query, err := qlutils.NewQuery(testCase.query, now)
+			So(err, ShouldBeNil)
+			aligned, err := alignTimeRanges(query, now)
+			So(err, ShouldBeNil)
+			So(aligned.String(), ShouldEqual, testCase.expected)
+		})
+	}
+
+	Convey("Tiers should split at the real now", t, func() {
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"beta":  &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		store["beta"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "aligned",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a", Duration: time.Hour},
+					{HostAndPort: "beta", Database: "b", Duration: 100 * time.Hour},
+				},
+				AlignTimes: true,
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		query, err := qlutils.NewQuery(
+			"select mean(value) from cpu where time >= now() - 3h group by time(10m)",
+			now)
+		So(err, ShouldBeNil)
+		_, err = db.Query(context.Background(), query, "ms", now, nil)
+		So(err, ShouldBeNil)
+		alphaQuery, _, _ := store["alpha"].NextQuery()
+		So(alphaQuery, ShouldEqual, "SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T23:03:20Z' AND time < '2016-12-01T00:10:00Z' GROUP BY time(10m)")
+		betaQuery, _, _ := store["beta"].NextQuery()
+		So(betaQuery, ShouldEqual, "SELECT mean(value) FROM cpu WHERE time >= '2016-11-30T21:10:00Z' AND time < '2016-12-01T00:10:00Z' GROUP BY time(10m)")
+	})
+
+	Convey("The partial first interval should be left out", t, func() {
+		fake := &fakeSeriesQueryerType{}
+		for t := now.Add(-2 * time.Hour); t.Before(now); t = t.Add(time.Minute) {
+			fake.times = append(fake.times, t.UnixNano())
+		}
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "aligned",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a", Duration: 100 * time.Hour},
+				},
+				AlignTimes: true,
+			},
+			func(kind string, conn config.Connection, template string) (
+				dbQueryerType, error) {
+				return fake, nil
+			})
+		So(err, ShouldBeNil)
+		defer db.Close()
+		query, err := qlutils.NewQuery(
+			"select count(value) from dual where time >= now() - 1h group by time(10m)",
+			now)
+		So(err, ShouldBeNil)
+		response, err := db.Query(context.Background(), query, "ns", now, nil)
+		So(err, ShouldBeNil)
+		// The fake returns raw points, so the response shows that the backend
+		// counts the points from 23:10 on rather than from 23:03:20 or 23:00.
+		So(response, ShouldResemble, fake.between(
+			time.Date(2016, 11, 30, 23, 10, 0, 0, time.UTC), now))
+	})
+
+	Convey("Refreshes within an interval should send the same query", t, func() {
+		store := dbQueryerStoreType{"alpha": &fakeDbQueryerType{}}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10), nil)
+		db, err := newDatabaseForTesting(
+			config.Database{
+				Name: "aligned",
+				Influxes: config.InfluxList{
+					{HostAndPort: "alpha", Database: "a", Duration: 100 * time.Hour},
+				},
+				AlignTimes: true,
+			},
+			store.Create)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		var queryStrs []string
+		for _, when := range []time.Time{now, now.Add(time.Minute)} {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from cpu where time >= now() - 1h group by time(10m)",
+				when)
+			So(err, ShouldBeNil)
+			response, err := db.Query(
+				context.Background(), query, "ms", when, nil)
+			So(err, ShouldBeNil)
+			So(response, ShouldResemble, newResponse(1000, 10))
+			queryStr, _, _ := store["alpha"].NextQuery()
+			queryStrs = append(queryStrs, queryStr)
+		}
+		So(queryStrs[1], ShouldEqual, queryStrs[0])
+	})
+}
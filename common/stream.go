@@ -0,0 +1,765 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rowStreamType iterates over the rows that a backend returns for a single
+// statement. Like influx, a stream returns series sorted by name and tags.
+// A series may span multiple consecutive rows in which case each row except
+// the last has Partial set to true.
+type rowStreamType interface {
+	// Next returns the next row. Next returns io.EOF when there are no
+	// more rows.
+	Next() (models.Row, error)
+	// Close frees any resources associated with this stream.
+	Close() error
+}
+
+// streamingDbQueryerType is implemented by dbQueryerType instances that
+// can stream results.
+type streamingDbQueryerType interface {
+	// QueryStream works like Query except that it returns the results
+	// as a stream. queryStr must be a single statement. chunkSize is the
+	// maximum number of values the server should send in a row.
+	QueryStream(
+		ctx context.Context,
+		queryStr, database, epoch string,
+		chunkSize int) (rowStreamType, error)
+}
+
+// streamingQueryerType is implemented by queryerType instances that can
+// stream results.
+type streamingQueryerType interface {
+	// QueryStreams works like Query except that it returns the results
+	// of a single statement query as streams ordered from lowest to
+	// highest precedence.
+	QueryStreams(
+		ctx context.Context,
+		query *influxql.Query,
+		epoch string,
+		chunkSize int,
+		logger log.Logger) ([]rowStreamType, error)
+}
+
+// responseRowStreamType is a rowStreamType over a response already in
+// memory.
+type responseRowStreamType struct {
+	rows []models.Row
+}
+
+// newResponseRowStream returns a stream over the rows of the first result
+// in response.
+func newResponseRowStream(response *client.Response) (
+	*responseRowStreamType, error) {
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+	if len(response.Results) == 0 {
+		return &responseRowStreamType{}, nil
+	}
+	return &responseRowStreamType{rows: response.Results[0].Series}, nil
+}
+
+func (s *responseRowStreamType) Next() (models.Row, error) {
+	if len(s.rows) == 0 {
+		return models.Row{}, io.EOF
+	}
+	result := s.rows[0]
+	s.rows = s.rows[1:]
+	return result, nil
+}
+
+func (s *responseRowStreamType) Close() error {
+	s.rows = nil
+	return nil
+}
+
+// chunkType represents a single chunk of a chunked influx response.
+type chunkType struct {
+	Results []struct {
+		Series []models.Row `json:"series"`
+		Err    string       `json:"error"`
+	} `json:"results"`
+	Err string `json:"error"`
+}
+
+// httpRowStreamType is a rowStreamType that decodes a chunked response
+// from an influx server one chunk at a time.
+type httpRowStreamType struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+	rows    []models.Row
+}
+
+// nextChunk reads the next chunk into s.rows.
+func (s *httpRowStreamType) nextChunk() error {
+	var chunk chunkType
+	if err := s.decoder.Decode(&chunk); err != nil {
+		return err
+	}
+	if chunk.Err != "" {
+		return fmt.Errorf("%s", chunk.Err)
+	}
+	for _, result := range chunk.Results {
+		if result.Err != "" {
+			return fmt.Errorf("%s", result.Err)
+		}
+		s.rows = append(s.rows, result.Series...)
+	}
+	return nil
+}
+
+func (s *httpRowStreamType) Next() (models.Row, error) {
+	for len(s.rows) == 0 {
+		if err := s.nextChunk(); err != nil {
+			return models.Row{}, err
+		}
+	}
+	result := s.rows[0]
+	s.rows = s.rows[1:]
+	return result, nil
+}
+
+func (s *httpRowStreamType) Close() error {
+	return s.body.Close()
+}
+
+func (q *influxQueryerType) QueryStream(
+	ctx context.Context,
+	queryStr, database, epoch string,
+	chunkSize int) (rowStreamType, error) {
+	params := url.Values{}
+	params.Set("q", queryStr)
+	params.Set("db", database)
+	if epoch != "" {
+		params.Set("epoch", epoch)
+	}
+	params.Set("chunked", "true")
+	if chunkSize > 0 {
+		params.Set("chunk_size", strconv.Itoa(chunkSize))
+	}
+	resp, err := q.Do(ctx, "POST", "query", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var response client.Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err == nil && response.Error() != nil {
+			return nil, statusErrorf(
+				resp.StatusCode, "%s", response.Error())
+		}
+		return nil, statusErrorf(
+			resp.StatusCode,
+			"received status code %d from server", resp.StatusCode)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	result := &httpRowStreamType{body: resp.Body, decoder: decoder}
+	// Read the first chunk now so that we learn right away if the query
+	// failed.
+	if err := result.nextChunk(); err != nil && err != io.EOF {
+		result.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// cancelOnCloseStreamType cancels a context when closed.
+type cancelOnCloseStreamType struct {
+	rowStreamType
+	cancel func()
+}
+
+func (s *cancelOnCloseStreamType) Close() error {
+	err := s.rowStreamType.Close()
+	s.cancel()
+	return err
+}
+
+// withCancelOnClose returns streams such that cancel gets called once all
+// of them are closed. If streams is empty, withCancelOnClose calls cancel
+// right away.
+func withCancelOnClose(
+	streams []rowStreamType, cancel context.CancelFunc) []rowStreamType {
+	if len(streams) == 0 {
+		cancel()
+		return nil
+	}
+	var mu sync.Mutex
+	remaining := len(streams)
+	result := make([]rowStreamType, len(streams))
+	for i := range streams {
+		var once sync.Once
+		result[i] = &cancelOnCloseStreamType{
+			rowStreamType: streams[i],
+			cancel: func() {
+				once.Do(func() {
+					mu.Lock()
+					defer mu.Unlock()
+					remaining--
+					if remaining == 0 {
+						cancel()
+					}
+				})
+			},
+		}
+	}
+	return result
+}
+
+// dbQueryStream returns the results of a single statement query against
+// a concrete server as a stream. If dbQueryer cannot stream, the stream is
+// over the results in memory.
+func dbQueryStream(
+	ctx context.Context,
+	dbQueryer dbQueryerType,
+	queryStr, database, epoch string,
+	chunkSize int) (rowStreamType, error) {
+	if streamer, ok := dbQueryer.(streamingDbQueryerType); ok {
+		return streamer.QueryStream(
+			ctx, queryStr, database, epoch, chunkSize)
+	}
+	response, err := dbQueryer.Query(ctx, queryStr, database, epoch)
+	if err != nil {
+		return nil, err
+	}
+	return newResponseRowStream(response)
+}
+
+// streamOpenerType opens the streams of a backend.
+type streamOpenerType struct {
+	// Names the backend for messages
+	backend string
+	// What the backend gets asked
+	query *influxql.Query
+	open  func() ([]rowStreamType, error)
+}
+
+// openStreams opens a stream for each opener concurrently. openStreams
+// logs and skips any opener that fails recording the failure in ctx.
+// Openers whose backends can't translate the query are skipped without
+// counting as failures. If every opener fails, openStreams returns an
+// error. The returned streams
+// are in the same order as openers.
+func openStreams(
+	ctx context.Context,
+	openers []streamOpenerType,
+	logger log.Logger) ([]rowStreamType, error) {
+	streamLists := make([][]rowStreamType, len(openers))
+	errs := make([]error, len(openers))
+	var wg sync.WaitGroup
+	for i := range openers {
+		wg.Add(1)
+		go func(i int) {
+			streamLists[i], errs[i] = openers[i].open()
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	var result []rowStreamType
+	var lastErrorEncountered error
+	var failures []error
+	var unsupported bool
+	for i := range openers {
+		if isUnsupported(errs[i]) {
+			unsupported = true
+			continue
+		}
+		if errs[i] != nil {
+			logError(logger, errs[i])
+			lastErrorEncountered = errs[i]
+			failures = append(failures, &backendError{
+				backend: openers[i].backend,
+				query:   openers[i].query,
+				err:     errs[i],
+			})
+			continue
+		}
+		result = append(result, streamLists[i]...)
+	}
+	if len(result) == 0 && lastErrorEncountered != nil {
+		return nil, lastErrorEncountered
+	}
+	if len(result) == 0 && unsupported {
+		return nil, qlutils.ErrUnsupported
+	}
+	for _, failure := range failures {
+		recordFailure(ctx, failure)
+	}
+	return result, nil
+}
+
+func (d *Influx) queryStream(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	chunkSize int) (rowStreamType, error) {
+	query, err := withResolution(query, d.data.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	query, originals, err := d.names.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, d.data.Timeout)
+	stream, err := dbQueryStream(
+		ctx, d.dbQueryer, query.String(), d.data.Database, epoch, chunkSize)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if len(originals) != 0 && originals[0] != nil {
+		stream = &restoreNamesStreamType{
+			rowStreamType: stream, originals: originals[0]}
+	}
+	return &cancelOnCloseStreamType{rowStreamType: stream, cancel: cancel}, nil
+}
+
+// queryStreams returns the streams for a single statement query against
+// each influx backend ordered from lowest to highest precedence.
+func (l *InfluxList) queryStreams(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	chunkSize int,
+	logger log.Logger) ([]rowStreamType, error) {
+	if l == nil {
+		return nil, nil
+	}
+	querySplits, chains, err := l.splitQuery(query, now)
+	if err != nil {
+		return nil, err
+	}
+	var openers []streamOpenerType
+	for i := range querySplits {
+		if querySplits[i] == nil {
+			continue
+		}
+		chain, split := chains[i], querySplits[i]
+		open := func() ([]rowStreamType, error) {
+			var err error
+			for j, instance := range chain {
+				var stream rowStreamType
+				stream, err = instance.queryStream(
+					ctx, split, epoch, chunkSize)
+				if err == nil {
+					return []rowStreamType{stream}, nil
+				}
+				if j < len(chain)-1 {
+					logError(logger, err)
+				}
+			}
+			return nil, err
+		}
+		openers = append(openers, streamOpenerType{
+			backend: chain.String(),
+			query:   split,
+			open:    open,
+		})
+	}
+	return openStreams(ctx, openers, logger)
+}
+
+// queryStreams returns the streams for a single statement query against
+// this scotty ordered from lowest to highest precedence.
+func (s *Scotty) queryStreams(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	chunkSize int,
+	logger log.Logger) ([]rowStreamType, error) {
+	query, err := s.clip(query, now)
+	if err != nil || query == nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	var streams []rowStreamType
+	switch {
+	case s.dbQueryer != nil:
+		var stream rowStreamType
+		stream, err = dbQueryStream(
+			ctx, s.dbQueryer, query.String(), s.database, epoch, chunkSize)
+		if err == nil {
+			streams = []rowStreamType{stream}
+		}
+	case s.partials != nil:
+		// Partial aggregation needs all the data up front.
+		var response *client.Response
+		response, err = s.partials.Query(ctx, query, epoch, now, logger)
+		if err == nil {
+			var stream rowStreamType
+			stream, err = newResponseRowStream(response)
+			if err == nil {
+				streams = []rowStreamType{stream}
+			}
+		}
+	case s.scotties != nil:
+		streams, err = s.scotties.queryStreams(
+			ctx, query, epoch, now, chunkSize, logger)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return withCancelOnClose(streams, cancel), nil
+}
+
+// queryStreams returns the streams for a single statement query against
+// each scotty in this list ordered from lowest to highest precedence.
+func (l *ScottyList) queryStreams(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	chunkSize int,
+	logger log.Logger) ([]rowStreamType, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if !l.mergesAll() {
+		return l.queryOneStreams(ctx, query, epoch, now, chunkSize, logger)
+	}
+	openers := make([]streamOpenerType, len(l.instances))
+	for i := range openers {
+		instance := l.instances[i]
+		openers[i] = streamOpenerType{
+			backend: instance.String(),
+			query:   query,
+			open: func() ([]rowStreamType, error) {
+				return instance.queryStreams(
+					ctx, query, epoch, now, chunkSize, logger)
+			},
+		}
+	}
+	return openStreams(ctx, openers, logger)
+}
+
+// peekingStreamType lets us look at the next row of a stream without
+// consuming it.
+type peekingStreamType struct {
+	stream rowStreamType
+	row    models.Row
+	key    string
+	done   bool
+}
+
+// advance reads the next row. advance returns any error from the
+// underlying stream other than io.EOF. Either way, the stream is done.
+func (p *peekingStreamType) advance() error {
+	row, err := p.stream.Next()
+	if err != nil {
+		p.done = true
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	p.row, p.key = row, rowKey(&row)
+	return nil
+}
+
+// timeOf returns the time of a row of values as nanoseconds and true or
+// false if the time cannot be determined.
+func timeOf(values []interface{}) (int64, bool) {
+	if len(values) == 0 {
+		return 0, false
+	}
+	switch t := values[0].(type) {
+	case json.Number:
+		if result, err := t.Int64(); err == nil {
+			return result, true
+		}
+		if result, err := t.Float64(); err == nil {
+			return int64(result), true
+		}
+	case string:
+		if result, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return result.UnixNano(), true
+		}
+	case int64:
+		return t, true
+	case float64:
+		return int64(t), true
+	}
+	return 0, false
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// seriesCursorType walks the values of one series in a stream one row at
+// a time.
+type seriesCursorType struct {
+	peeker *peekingStreamType
+	// The values of the current row not yet merged
+	values [][]interface{}
+	// false once the stream moves past the series
+	live bool
+}
+
+// refill moves c to the next row of its series with values if c has no
+// values left. refill returns true if c moved to such a row.
+func (c *seriesCursorType) refill(key string) (bool, error) {
+	for c.live && len(c.values) == 0 {
+		if err := c.peeker.advance(); err != nil {
+			return false, err
+		}
+		c.live = !c.peeker.done && c.peeker.key == key
+		if c.live {
+			c.values = c.peeker.row.Values
+		}
+	}
+	return len(c.values) > 0, nil
+}
+
+// mergeSeries merges the series that all of peekers are on in time order
+// and writes it to w. When several peekers have values at the same time,
+// the value from the last one wins. Values with no discernable time are
+// written as they are reached. Because mergeSeries writes what it has
+// merged each time it moves to the next row of a stream, it holds at most
+// one row from each stream at a time.
+func mergeSeries(peekers []*peekingStreamType, w RowWriter) error {
+	key := peekers[0].key
+	merged := peekers[len(peekers)-1].row
+	cursors := make([]*seriesCursorType, len(peekers))
+	for i, p := range peekers {
+		cursors[i] = &seriesCursorType{
+			peeker: p, values: p.row.Values, live: true}
+	}
+	var values [][]interface{}
+	for {
+		refilled := false
+		for _, c := range cursors {
+			if c.live && len(c.values) == 0 {
+				moved, err := c.refill(key)
+				if err != nil {
+					return err
+				}
+				refilled = refilled || moved
+			}
+		}
+		next := -1
+		var nextTime int64
+		nextTimed := true
+		for i, c := range cursors {
+			if len(c.values) == 0 {
+				continue
+			}
+			ts, ok := timeOf(c.values[0])
+			if !ok {
+				next, nextTimed = i, false
+				break
+			}
+			if next == -1 || ts <= nextTime {
+				next, nextTime = i, ts
+			}
+		}
+		if next == -1 {
+			merged.Values = values
+			merged.Partial = false
+			return w.WriteRow(merged)
+		}
+		// Write what we have before holding another row. More values
+		// follow, so the series continues past it.
+		if refilled && len(values) > 0 {
+			merged.Values = values
+			merged.Partial = true
+			if err := w.WriteRow(merged); err != nil {
+				return err
+			}
+			values = nil
+		}
+		values = append(values, cursors[next].values[0])
+		for i, c := range cursors {
+			if len(c.values) == 0 {
+				continue
+			}
+			if i == next {
+				c.values = c.values[1:]
+			} else if ts, ok := timeOf(c.values[0]); ok && nextTimed &&
+				ts == nextTime {
+				c.values = c.values[1:]
+			}
+		}
+	}
+}
+
+// mergeRowStreams merges streams and writes the merged series to w.
+// Streams later in the list take precedence when they have values for the
+// same series at the same time. A series found in only one stream is
+// written as it arrives; a series found in several streams is merged in
+// time order as it arrives. If a stream fails midway, mergeRowStreams
+// stops and returns the error so that the client learns that the results
+// are incomplete. mergeRowStreams closes all the streams.
+func mergeRowStreams(streams []rowStreamType, w RowWriter) error {
+	peekers := make([]*peekingStreamType, len(streams))
+	for i := range streams {
+		defer streams[i].Close()
+	}
+	for i := range streams {
+		peekers[i] = &peekingStreamType{stream: streams[i]}
+		if err := peekers[i].advance(); err != nil {
+			return err
+		}
+	}
+	for {
+		// Find the streams with the smallest series
+		var smallest []*peekingStreamType
+		for _, p := range peekers {
+			if p.done {
+				continue
+			}
+			if len(smallest) == 0 || p.key < smallest[0].key {
+				smallest = []*peekingStreamType{p}
+			} else if p.key == smallest[0].key {
+				smallest = append(smallest, p)
+			}
+		}
+		if len(smallest) == 0 {
+			return nil
+		}
+		key := smallest[0].key
+		if len(smallest) == 1 {
+			p := smallest[0]
+			row := p.row
+			if err := p.advance(); err != nil {
+				return err
+			}
+			row.Partial = !p.done && p.key == key
+			if err := w.WriteRow(row); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := mergeSeries(smallest, w); err != nil {
+			return err
+		}
+	}
+}
+
+// writeResponseRows writes the rows of the first result in response to w.
+func writeResponseRows(response *client.Response, w RowWriter) error {
+	if err := response.Error(); err != nil {
+		return err
+	}
+	if len(response.Results) == 0 {
+		return nil
+	}
+	for _, row := range response.Results[0].Series {
+		if err := w.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) queryStatementStream(
+	ctx context.Context,
+	stmt influxql.Statement,
+	epoch string,
+	now time.Time,
+	chunkSize int,
+	logger log.Logger,
+	w RowWriter) error {
+	ctx, failures := withFailures(ctx)
+	if isMetadataStatement(stmt) {
+		response, err := d.queryMetadata(ctx, stmt, epoch, logger)
+		if err != nil {
+			return err
+		}
+		if err := failures.Err(d.partialFailures); err != nil {
+			return err
+		}
+		if err := writeResponseRows(response, w); err != nil {
+			return err
+		}
+		return failures.Write(w, d.partialFailures)
+	}
+	query := qlutils.SingleQuery(stmt)
+	// Scotty streams come last as scotty takes precedence.
+	streams, err := openStreams(
+		ctx,
+		[]streamOpenerType{
+			{
+				backend: kInfluxBackends,
+				query:   query,
+				open: func() ([]rowStreamType, error) {
+					return d.influxes.queryStreams(
+						ctx, query, epoch, now, chunkSize, logger)
+				},
+			},
+			{
+				backend: kScotties,
+				query:   query,
+				open: func() ([]rowStreamType, error) {
+					return d.scotties.queryStreams(
+						ctx, query, epoch, now, chunkSize, logger)
+				},
+			},
+		},
+		logger)
+	if err != nil {
+		return err
+	}
+	if err := failures.Err(d.partialFailures); err != nil {
+		for _, stream := range streams {
+			stream.Close()
+		}
+		return err
+	}
+	if err := mergeRowStreams(streams, w); err != nil {
+		return err
+	}
+	return failures.Write(w, d.partialFailures)
+}
+
+func (d *Database) queryStream(
+	ctx context.Context,
+	query *influxql.Query,
+	epoch string,
+	now time.Time,
+	chunkSize int,
+	logger log.Logger,
+	w RowWriter) error {
+	query, err := withoutDatabaseNames(query, d.name)
+	if err != nil {
+		return err
+	}
+	query, err = d.align(query, now)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, d.timeout)
+	defer cancel()
+	for _, stmt := range query.Statements {
+		if err := d.queryStatementStream(
+			ctx, stmt, epoch, now, chunkSize, logger, w); err != nil {
+			return err
+		}
+		if err := w.EndStatement(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
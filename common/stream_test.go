@@ -0,0 +1,311 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/proxima/config"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// rowRecorderType is a RowWriter that records what it receives.
+type rowRecorderType struct {
+	statements [][]models.Row
+	current    []models.Row
+	// Each message as "level: text"
+	messages []string
+}
+
+func (r *rowRecorderType) WriteRow(row models.Row) error {
+	r.current = append(r.current, row)
+	return nil
+}
+
+func (r *rowRecorderType) WriteMessage(level, text string) error {
+	r.messages = append(r.messages, level+": "+text)
+	return nil
+}
+
+func (r *rowRecorderType) EndStatement() error {
+	r.statements = append(r.statements, r.current)
+	r.current = nil
+	return nil
+}
+
+func newRow(name string, tags map[string]string, values ...int64) models.Row {
+	return newResponseWithTags(name, tags, values...).Results[0].Series[0]
+}
+
+func newResponseWithTags(
+	name string, tags map[string]string, values ...int64) *client.Response {
+	response := newResponse(values...)
+	response.Results[0].Series[0].Name = name
+	response.Results[0].Series[0].Tags = tags
+	return response
+}
+
+func newStream(rows ...models.Row) rowStreamType {
+	return &responseRowStreamType{rows: rows}
+}
+
+func withPartial(row models.Row) models.Row {
+	row.Partial = true
+	return row
+}
+
+func TestStream(t *testing.T) {
+	Convey("Merging streams", t, func() {
+		var recorder rowRecorderType
+		hostA := map[string]string{"host": "a"}
+		hostB := map[string]string{"host": "b"}
+
+		Convey("Series in one stream only should pass through", func() {
+			err := mergeRowStreams(
+				[]rowStreamType{
+					newStream(
+						withPartial(newRow("alpha", hostA, 1000, 1)),
+						newRow("alpha", hostA, 1200, 2),
+						newRow("bravo", nil, 1000, 3),
+					),
+					newStream(
+						newRow("alpha", hostB, 1000, 4),
+					),
+				},
+				&recorder)
+			So(err, ShouldBeNil)
+			So(recorder.current, ShouldResemble, []models.Row{
+				withPartial(newRow("alpha", hostA, 1000, 1)),
+				newRow("alpha", hostA, 1200, 2),
+				newRow("alpha", hostB, 1000, 4),
+				newRow("bravo", nil, 1000, 3),
+			})
+		})
+
+		Convey("Later streams should win for the same series", func() {
+			err := mergeRowStreams(
+				[]rowStreamType{
+					newStream(
+						withPartial(newRow("alpha", hostA, 1000, 1)),
+						newRow("alpha", hostA, 1200, 2, 1400, 3),
+					),
+					newStream(
+						newRow("alpha", hostA, 1200, 12, 1600, 14),
+					),
+				},
+				&recorder)
+			So(err, ShouldBeNil)
+			So(recorder.current, ShouldResemble, []models.Row{
+				withPartial(newRow("alpha", hostA, 1000, 1)),
+				newRow("alpha", hostA, 1200, 12, 1400, 3, 1600, 14),
+			})
+		})
+
+		Convey("Series spanning many chunks should merge a chunk at a time", func() {
+			// Each stream has the series in chunks of two values. The first
+			// stream has the even seconds; the second, the odd ones.
+			var even, odd []models.Row
+			for i := int64(0); i < 20; i += 4 {
+				even = append(even, withPartial(
+					newRow("alpha", hostA, i*1000, i, (i+2)*1000, i+2)))
+				odd = append(odd, withPartial(
+					newRow("alpha", hostA, (i+1)*1000, i+1, (i+3)*1000, i+3)))
+			}
+			even[len(even)-1].Partial = false
+			odd[len(odd)-1].Partial = false
+			err := mergeRowStreams(
+				[]rowStreamType{newStream(even...), newStream(odd...)},
+				&recorder)
+			So(err, ShouldBeNil)
+			var values []int64
+			for i, row := range recorder.current {
+				// Nothing waits for the whole series.
+				So(len(row.Values), ShouldBeLessThanOrEqualTo, 4)
+				So(row.Partial, ShouldEqual, i < len(recorder.current)-1)
+				for _, value := range row.Values {
+					ts, _ := timeOf(value)
+					values = append(values, ts/1000)
+				}
+			}
+			So(len(recorder.current), ShouldBeGreaterThan, 1)
+			expected := make([]int64, 20)
+			for i := range expected {
+				expected[i] = int64(i)
+			}
+			So(values, ShouldResemble, expected)
+		})
+
+		Convey("RFC3339 times should merge in time order", func() {
+			row1 := models.Row{
+				Name:    "alpha",
+				Columns: kTimeValueColumns,
+				Values: [][]interface{}{
+					{"2017-01-01T00:00:00.5Z", json.Number("1")},
+				},
+			}
+			row2 := models.Row{
+				Name:    "alpha",
+				Columns: kTimeValueColumns,
+				Values: [][]interface{}{
+					{"2017-01-01T00:00:00Z", json.Number("2")},
+				},
+			}
+			err := mergeRowStreams(
+				[]rowStreamType{newStream(row1), newStream(row2)},
+				&recorder)
+			So(err, ShouldBeNil)
+			So(recorder.current, ShouldResemble, []models.Row{
+				{
+					Name:    "alpha",
+					Columns: kTimeValueColumns,
+					Values: [][]interface{}{
+						{"2017-01-01T00:00:00Z", json.Number("2")},
+						{"2017-01-01T00:00:00.5Z", json.Number("1")},
+					},
+				},
+			})
+		})
+	})
+
+	Convey("Given fake sources", t, func() {
+		now := time.Date(2016, 12, 1, 0, 1, 0, 0, time.UTC)
+		store := dbQueryerStoreType{
+			"alpha": &fakeDbQueryerType{},
+			"bravo": &fakeDbQueryerType{},
+			"delta": &fakeDbQueryerType{},
+			"error": &fakeDbQueryerType{},
+		}
+		store["alpha"].WhenQueriedReturn(newResponse(1000, 10, 1200, 11), nil)
+		store["bravo"].WhenQueriedReturn(newResponse(1200, 12, 1400, 13), nil)
+		store["delta"].WhenQueriedReturn(newResponse(1400, 24, 1600, 25), nil)
+		store["error"].WhenQueriedReturn(nil, kErrSomeError)
+		proximaConfig := config.Proxima{
+			Dbs: []config.Database{
+				{
+					Name: "both",
+					Influxes: config.InfluxList{
+						{
+							HostAndPort: "alpha",
+							Database:    "a",
+							Duration:    100 * time.Hour,
+						},
+						{
+							HostAndPort: "bravo",
+							Database:    "b",
+							Duration:    10 * time.Hour,
+						},
+						{
+							HostAndPort: "error",
+							Database:    "e",
+							Duration:    time.Hour,
+						},
+					},
+					Scotties: config.ScottyList{
+						{HostAndPort: "delta"},
+					},
+				},
+				{
+					Name: "error",
+					Influxes: config.InfluxList{
+						{
+							HostAndPort: "error",
+							Database:    "e",
+							Duration:    time.Hour,
+						},
+					},
+				},
+			},
+		}
+		proxima, err := newProximaForTesting(proximaConfig, store.Create)
+		So(err, ShouldBeNil)
+		var recorder rowRecorderType
+
+		Convey("Streaming should merge all backends", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from alpha where time >= now() - 50h group by time(1m); select mean(value) from alpha where time >= now() - 50h group by time(1m)",
+				now)
+			So(err, ShouldBeNil)
+			err = proxima.ByName("both").QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldBeNil)
+			expected := []models.Row{
+				newRow("alpha", nil, 1000, 10, 1200, 12, 1400, 24, 1600, 25),
+			}
+			So(recorder.statements, ShouldResemble, [][]models.Row{
+				expected, expected})
+		})
+
+		Convey("Streaming from failed backends should fail", func() {
+			query, err := qlutils.NewQuery(
+				"select mean(value) from alpha where time >= now() - 1h group by time(1m)",
+				now)
+			So(err, ShouldBeNil)
+			err = proxima.ByName("error").QueryStream(
+				context.Background(), query, "ms", now, 0, nil, &recorder)
+			So(err, ShouldNotBeNil)
+			So(recorder.statements, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a fake chunking influx server", t, func() {
+		var chunkSize string
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				chunkSize = r.Form.Get("chunk_size")
+				if r.Form.Get("q") == "bad" {
+					fmt.Fprintln(w, `{"results":[{"statement_id":0,"error":"bad query"}]}`)
+					return
+				}
+				fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"alpha","columns":["time","value"],"values":[[1000,10]],"partial":true}],"partial":true}]}`)
+				if r.Form.Get("q") == "midway" {
+					fmt.Fprintln(w, `{"results":[{"statement_id":0,"error":"shard went away"}]}`)
+					return
+				}
+				fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"alpha","columns":["time","value"],"values":[[1200,11]]}]}]}`)
+			}))
+		defer server.Close()
+		queryer, err := influxCreateDbQueryer(
+			config.Connection{HostAndPort: server.URL})
+		So(err, ShouldBeNil)
+		defer queryer.Close()
+		streamer := queryer.(streamingDbQueryerType)
+
+		Convey("Stream should return rows chunk by chunk", func() {
+			stream, err := streamer.QueryStream(
+				context.Background(), "select * from alpha", "adb", "ms", 1)
+			So(err, ShouldBeNil)
+			defer stream.Close()
+			So(chunkSize, ShouldEqual, "1")
+			var recorder rowRecorderType
+			So(mergeRowStreams([]rowStreamType{stream}, &recorder), ShouldBeNil)
+			So(recorder.current, ShouldResemble, []models.Row{
+				withPartial(newRow("alpha", nil, 1000, 10)),
+				newRow("alpha", nil, 1200, 11),
+			})
+		})
+
+		Convey("Errors in later chunks should fail the merge", func() {
+			stream, err := streamer.QueryStream(
+				context.Background(), "midway", "adb", "ms", 1)
+			So(err, ShouldBeNil)
+			var recorder rowRecorderType
+			err = mergeRowStreams([]rowStreamType{stream}, &recorder)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "shard went away")
+			So(recorder.current, ShouldBeEmpty)
+		})
+
+		Convey("Errors in the first chunk should fail the query", func() {
+			_, err := streamer.QueryStream(
+				context.Background(), "bad", "adb", "ms", 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
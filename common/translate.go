@@ -0,0 +1,395 @@
+package common
+
+import (
+	"encoding/json"
+	"github.com/Symantec/scotty/influx/qlutils"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fieldType is a single field of a select statement.
+type fieldType struct {
+	// The aggregation e.g "mean". Empty means raw values.
+	Aggregate string
+	// Name of the field
+	Name string
+	// The second argument of the aggregation e.g 95 in
+	// percentile(value, 95)
+	Arg float64
+}
+
+// tagFilterType is a condition on a single tag.
+type tagFilterType struct {
+	Key string
+	// One of influxql.EQ, influxql.NEQ, influxql.EQREGEX, influxql.NEQREGEX
+	Op influxql.Token
+	// For EQ, the tag matches any of these; for NEQ, the tag matches
+	// none of these.
+	Values []string
+	// For EQREGEX and NEQREGEX
+	Regex *regexp.Regexp
+}
+
+// simpleSelectType is the subset of influxql that proxima translates
+// for backends that don't speak influxql:
+//
+//	SELECT agg(field), ... FROM measurement
+//	WHERE tag conditions AND time range
+//	GROUP BY time(interval), tag, ... fill(option)
+//
+// Aggregations are optional, but a statement cannot mix raw fields with
+// aggregated fields.
+type simpleSelectType struct {
+	Measurement string
+	Fields      []fieldType
+	// The result columns including time
+	Columns []string
+	// The tag conditions ANDed together
+	Filters []tagFilterType
+	// The time range inclusive. Zero values mean unbounded.
+	Min, Max time.Time
+	// The GROUP BY time interval. 0 means no GROUP BY time.
+	Interval    time.Duration
+	GroupByTags []string
+	Fill        influxql.FillOption
+	FillValue   interface{}
+}
+
+// parseSimpleSelect parses queryStr which must consist of a single
+// select statement that simpleSelectType can represent. Otherwise
+// parseSimpleSelect returns qlutils.ErrUnsupported.
+func parseSimpleSelect(queryStr string) (*simpleSelectType, error) {
+	query, err := influxql.ParseQuery(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(query.Statements) != 1 {
+		return nil, qlutils.ErrUnsupported
+	}
+	stmt, ok := query.Statements[0].(*influxql.SelectStatement)
+	if !ok {
+		return nil, qlutils.ErrUnsupported
+	}
+	return newSimpleSelect(stmt)
+}
+
+func newSimpleSelect(stmt *influxql.SelectStatement) (
+	*simpleSelectType, error) {
+	if stmt.Limit != 0 || stmt.Offset != 0 || stmt.SLimit != 0 ||
+		stmt.SOffset != 0 || stmt.Target != nil {
+		return nil, qlutils.ErrUnsupported
+	}
+	if len(stmt.SortFields) != 0 && !stmt.SortFields[0].Ascending {
+		return nil, qlutils.ErrUnsupported
+	}
+	if len(stmt.Sources) != 1 {
+		return nil, qlutils.ErrUnsupported
+	}
+	measurement, ok := stmt.Sources[0].(*influxql.Measurement)
+	if !ok || measurement.Regex != nil {
+		return nil, qlutils.ErrUnsupported
+	}
+	result := &simpleSelectType{
+		Measurement: measurement.Name,
+		Columns:     stmt.ColumnNames(),
+		Fill:        stmt.Fill,
+		FillValue:   stmt.FillValue,
+	}
+	rawCount := 0
+	for _, field := range stmt.Fields {
+		switch expr := field.Expr.(type) {
+		case *influxql.VarRef:
+			result.Fields = append(result.Fields, fieldType{Name: expr.Val})
+			rawCount++
+		case *influxql.Call:
+			if len(expr.Args) == 0 || len(expr.Args) > 2 {
+				return nil, qlutils.ErrUnsupported
+			}
+			ref, ok := expr.Args[0].(*influxql.VarRef)
+			if !ok {
+				return nil, qlutils.ErrUnsupported
+			}
+			field := fieldType{Aggregate: expr.Name, Name: ref.Val}
+			if len(expr.Args) == 2 {
+				switch arg := expr.Args[1].(type) {
+				case *influxql.IntegerLiteral:
+					field.Arg = float64(arg.Val)
+				case *influxql.NumberLiteral:
+					field.Arg = arg.Val
+				default:
+					return nil, qlutils.ErrUnsupported
+				}
+			}
+			result.Fields = append(result.Fields, field)
+		default:
+			return nil, qlutils.ErrUnsupported
+		}
+	}
+	if rawCount != 0 && rawCount != len(result.Fields) {
+		return nil, qlutils.ErrUnsupported
+	}
+	var err error
+	if result.Min, result.Max, err = influxql.TimeRange(
+		stmt.Condition); err != nil {
+		return nil, err
+	}
+	if result.Filters, err = tagFilters(stmt.Condition); err != nil {
+		return nil, err
+	}
+	if result.Interval, err = stmt.GroupByInterval(); err != nil {
+		return nil, err
+	}
+	// The backends we translate for can't shift their buckets.
+	offset, err := stmt.GroupByOffset()
+	if err != nil {
+		return nil, err
+	}
+	if offset != 0 {
+		return nil, qlutils.ErrUnsupported
+	}
+	for _, dimension := range stmt.Dimensions {
+		switch expr := dimension.Expr.(type) {
+		case *influxql.VarRef:
+			result.GroupByTags = append(result.GroupByTags, expr.Val)
+		case *influxql.Call:
+			// GROUP BY time(..) which we already have.
+			if expr.Name != "time" {
+				return nil, qlutils.ErrUnsupported
+			}
+		default:
+			return nil, qlutils.ErrUnsupported
+		}
+	}
+	if result.Fill == influxql.LinearFill {
+		return nil, qlutils.ErrUnsupported
+	}
+	return result, nil
+}
+
+// tagFilters returns the tag conditions in expr. tagFilters ignores
+// conditions on time as influxql.TimeRange handles those.
+func tagFilters(expr influxql.Expr) ([]tagFilterType, error) {
+	switch e := expr.(type) {
+	case nil:
+		return nil, nil
+	case *influxql.ParenExpr:
+		return tagFilters(e.Expr)
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.AND:
+			lhs, err := tagFilters(e.LHS)
+			if err != nil {
+				return nil, err
+			}
+			rhs, err := tagFilters(e.RHS)
+			if err != nil {
+				return nil, err
+			}
+			return append(lhs, rhs...), nil
+		case influxql.OR:
+			// Only tag = 'a' OR tag = 'b' is supported
+			lhs, err := tagFilters(e.LHS)
+			if err != nil {
+				return nil, err
+			}
+			rhs, err := tagFilters(e.RHS)
+			if err != nil {
+				return nil, err
+			}
+			if len(lhs) != 1 || len(rhs) != 1 || lhs[0].Op != influxql.EQ ||
+				rhs[0].Op != influxql.EQ || lhs[0].Key != rhs[0].Key {
+				return nil, qlutils.ErrUnsupported
+			}
+			lhs[0].Values = append(lhs[0].Values, rhs[0].Values...)
+			return lhs, nil
+		}
+		ref, ok := e.LHS.(*influxql.VarRef)
+		if !ok {
+			return nil, qlutils.ErrUnsupported
+		}
+		if strings.ToLower(ref.Val) == "time" {
+			return nil, nil
+		}
+		switch rhs := e.RHS.(type) {
+		case *influxql.StringLiteral:
+			if e.Op == influxql.EQ || e.Op == influxql.NEQ {
+				return []tagFilterType{
+					{Key: ref.Val, Op: e.Op, Values: []string{rhs.Val}},
+				}, nil
+			}
+		case *influxql.RegexLiteral:
+			if e.Op == influxql.EQREGEX || e.Op == influxql.NEQREGEX {
+				return []tagFilterType{
+					{Key: ref.Val, Op: e.Op, Regex: rhs.Val},
+				}, nil
+			}
+		}
+	}
+	return nil, qlutils.ErrUnsupported
+}
+
+// epochUnit returns the unit of time for epoch. 0 means RFC3339 strings.
+func epochUnit(epoch string) time.Duration {
+	switch epoch {
+	case "":
+		return 0
+	case "u", "µ":
+		return time.Microsecond
+	case "ms":
+		return time.Millisecond
+	case "s":
+		return time.Second
+	case "m":
+		return time.Minute
+	case "h":
+		return time.Hour
+	}
+	return time.Nanosecond
+}
+
+// formatTime returns t, which is in nanoseconds since the epoch, the way
+// influx would for the given epoch.
+func formatTime(t int64, epoch string) interface{} {
+	unit := epochUnit(epoch)
+	if unit == 0 {
+		return time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+	}
+	return json.Number(strconv.FormatInt(t/int64(unit), 10))
+}
+
+// seriesBuilderType builds a response to a simple select statement from
+// values that arrive one at a time in any order.
+type seriesBuilderType struct {
+	stmt   *simpleSelectType
+	epoch  string
+	series map[string]*builtSeriesType
+}
+
+type builtSeriesType struct {
+	tags map[string]string
+	// values keyed by time in nanoseconds. First element is time.
+	values map[int64][]interface{}
+}
+
+func newSeriesBuilder(
+	stmt *simpleSelectType, epoch string) *seriesBuilderType {
+	return &seriesBuilderType{
+		stmt:   stmt,
+		epoch:  epoch,
+		series: make(map[string]*builtSeriesType),
+	}
+}
+
+// Add adds a value for the given field index. Only the tags in the GROUP BY
+// clause count. t is in nanoseconds since the epoch.
+func (b *seriesBuilderType) Add(
+	tags map[string]string, fieldIdx int, t int64, value interface{}) {
+	var groupTags map[string]string
+	if len(b.stmt.GroupByTags) != 0 {
+		groupTags = make(map[string]string, len(b.stmt.GroupByTags))
+		for _, key := range b.stmt.GroupByTags {
+			groupTags[key] = tags[key]
+		}
+	}
+	row := models.Row{Name: b.stmt.Measurement, Tags: groupTags}
+	key := rowKey(&row)
+	series, ok := b.series[key]
+	if !ok {
+		series = &builtSeriesType{
+			tags:   groupTags,
+			values: make(map[int64][]interface{}),
+		}
+		b.series[key] = series
+	}
+	values, ok := series.values[t]
+	if !ok {
+		values = make([]interface{}, len(b.stmt.Fields)+1)
+		series.values[t] = values
+	}
+	values[fieldIdx+1] = value
+}
+
+// fillBuckets adds empty values to series for each missing GROUP BY time
+// bucket within the time range.
+func (b *seriesBuilderType) fillBuckets(series *builtSeriesType) {
+	interval := int64(b.stmt.Interval)
+	if interval <= 0 || b.stmt.Min.IsZero() || b.stmt.Max.IsZero() {
+		return
+	}
+	start := b.stmt.Min.UnixNano()
+	start -= start % interval
+	end := b.stmt.Max.UnixNano()
+	for t := start; t <= end; t += interval {
+		if _, ok := series.values[t]; !ok {
+			series.values[t] = make([]interface{}, len(b.stmt.Fields)+1)
+		}
+	}
+}
+
+// isEmpty returns true if values has no field values
+func isEmpty(values []interface{}) bool {
+	for _, value := range values[1:] {
+		if value != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Response returns the response with rows ordered by tags and values
+// ordered by time. Response applies the fill option of the statement.
+func (b *seriesBuilderType) Response() *client.Response {
+	keys := make([]string, 0, len(b.series))
+	for key := range b.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var result client.Result
+	for _, key := range keys {
+		series := b.series[key]
+		if b.stmt.Fill != influxql.NoFill {
+			b.fillBuckets(series)
+		}
+		times := make([]int64, 0, len(series.values))
+		for t := range series.values {
+			times = append(times, t)
+		}
+		sort.Sort(int64Slice(times))
+		row := models.Row{
+			Name:    b.stmt.Measurement,
+			Tags:    series.tags,
+			Columns: b.stmt.Columns,
+		}
+		var previous []interface{}
+		for _, t := range times {
+			values := series.values[t]
+			values[0] = formatTime(t, b.epoch)
+			if isEmpty(values) {
+				switch b.stmt.Fill {
+				case influxql.NoFill:
+					continue
+				case influxql.NumberFill:
+					for i := 1; i < len(values); i++ {
+						values[i] = b.stmt.FillValue
+					}
+				case influxql.PreviousFill:
+					if previous != nil {
+						copy(values[1:], previous[1:])
+					}
+				}
+			}
+			previous = values
+			row.Values = append(row.Values, values)
+		}
+		if len(row.Values) != 0 {
+			result.Series = append(result.Series, row)
+		}
+	}
+	return &client.Response{Results: []client.Result{result}}
+}
@@ -7,14 +7,80 @@ import (
 	"time"
 )
 
+// TLS represents the TLS settings for connecting to a backend over https.
+type TLS struct {
+	// PEM file of certificate authorities to trust. If empty, use the
+	// host's root certificate authorities.
+	CAFile string `yaml:"caFile"`
+	// PEM file containing the client certificate. Optional.
+	CertFile string `yaml:"certFile"`
+	// PEM file containing the client key. Required if CertFile is set.
+	KeyFile string `yaml:"keyFile"`
+	// If true, do not verify the server's certificate.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+func (t *TLS) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type tlsFields TLS
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*tlsFields)(t))
+}
+
+// Access contains how to authenticate to a backend and secure the
+// connection to it. Every kind of backend embeds Access.
+type Access struct {
+	// Username for basic auth. Optional.
+	Username string `yaml:"username"`
+	// Password for basic auth
+	Password string `yaml:"password"`
+	// File containing the password for basic auth. Use instead of
+	// Password to keep secrets out of the config file.
+	PasswordFile string `yaml:"passwordFile"`
+	// TLS settings for https. nil means use the defaults.
+	TLS *TLS `yaml:"tls"`
+	// Extra headers to send with each request keyed by header name.
+	Headers map[string]string `yaml:"headers"`
+	// Like Headers except that the values are names of files containing
+	// the header values. Use to keep secrets out of the config file.
+	HeaderFiles map[string]string `yaml:"headerFiles"`
+}
+
+// Connection contains everything needed to connect to a single backend.
+type Connection struct {
+	// http://someHost.com:1234.
+	HostAndPort string
+	Access
+}
+
 // Influx represents a single influx backend.
 type Influx struct {
 	// http://someHost.com:1234.
 	HostAndPort string `yaml:"hostAndPort"`
-	// The duration in this instance's retention policy
+	// The duration in this instance's retention policy. 0 means ask
+	// this instance for the duration of its retention policy.
 	Duration time.Duration `yaml:"duration"`
+	// The resolution this instance's data is downsampled to. 0 means
+	// the data is not downsampled.
+	Resolution time.Duration `yaml:"resolution"`
 	// The influx Database to use
 	Database string `yaml:"database"`
+	// The retention policy to query. Empty means the default retention
+	// policy.
+	RetentionPolicy string `yaml:"retentionPolicy"`
+	// Template for measurement names in this instance.
+	// {measurement} stands for the measurement name in the query.
+	// Empty means measurement names are the same as in the query.
+	Measurement string `yaml:"measurement"`
+	// Template for field names in this instance. {field} stands for the
+	// field name in the query; {aggregate} stands for the aggregation
+	// applied to the field such as mean. Empty means field names are the
+	// same as in the query. Queries for raw values fail if Field uses
+	// {aggregate}.
+	Field string `yaml:"field"`
+	// How long to wait for this backend to respond. 0 means no timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// Credentials, TLS settings, and headers
+	Access `yaml:",inline"`
 }
 
 func (i *Influx) UnmarshalYAML(
@@ -23,6 +89,11 @@ func (i *Influx) UnmarshalYAML(
 	return yamlutil.StrictUnmarshalYAML(unmarshal, (*influxFields)(i))
 }
 
+// Connection returns how to connect to this influx backend.
+func (i *Influx) Connection() Connection {
+	return Connection{HostAndPort: i.HostAndPort, Access: i.Access}
+}
+
 // InfluxList represents a group of influx backends.
 // InfluxList instances are to be treated as immutable.
 type InfluxList []Influx
@@ -36,6 +107,173 @@ func (i InfluxList) Order() InfluxList {
 	return result
 }
 
+// OpenTSDB represents a single OpenTSDB backend. Like an influx backend,
+// an OpenTSDB backend has data going back a certain duration.
+type OpenTSDB struct {
+	// http://someHost.com:4242.
+	HostAndPort string `yaml:"hostAndPort"`
+	// How far back data in this OpenTSDB goes
+	Duration time.Duration `yaml:"duration"`
+	// How long to wait for this backend to respond. 0 means no timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// Credentials, TLS settings, and headers
+	Access `yaml:",inline"`
+}
+
+func (o *OpenTSDB) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type openTSDBFields OpenTSDB
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*openTSDBFields)(o))
+}
+
+// Connection returns how to connect to this OpenTSDB backend.
+func (o *OpenTSDB) Connection() Connection {
+	return Connection{HostAndPort: o.HostAndPort, Access: o.Access}
+}
+
+// OpenTSDBList represents a group of OpenTSDB backends.
+// OpenTSDBList instances are to be treated as immutable.
+type OpenTSDBList []OpenTSDB
+
+// Prometheus represents a single prometheus compatible backend. Like an
+// influx backend, a prometheus backend has data going back a certain
+// duration.
+type Prometheus struct {
+	// http://someHost.com:9090.
+	HostAndPort string `yaml:"hostAndPort"`
+	// How far back data in this prometheus goes
+	Duration time.Duration `yaml:"duration"`
+	// How long to wait for this backend to respond. 0 means no timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// Credentials, TLS settings, and headers
+	Access `yaml:",inline"`
+}
+
+func (p *Prometheus) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type prometheusFields Prometheus
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*prometheusFields)(p))
+}
+
+// Connection returns how to connect to this prometheus backend.
+func (p *Prometheus) Connection() Connection {
+	return Connection{HostAndPort: p.HostAndPort, Access: p.Access}
+}
+
+// PrometheusList represents a group of prometheus backends.
+// PrometheusList instances are to be treated as immutable.
+type PrometheusList []Prometheus
+
+// Graphite represents a single graphite backend. Like an influx backend,
+// a graphite backend has data going back a certain duration.
+type Graphite struct {
+	// http://someHost.com:8080.
+	HostAndPort string `yaml:"hostAndPort"`
+	// How far back data in this graphite goes
+	Duration time.Duration `yaml:"duration"`
+	// Maps measurements, fields, and tags onto graphite paths e.g
+	// "servers.{host}.{measurement}.{field}". {measurement} and {field}
+	// stand for the measurement and field; any other {name} stands for
+	// the tag called name. Empty means "{measurement}.{field}".
+	Template string `yaml:"template"`
+	// How long to wait for this backend to respond. 0 means no timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// Credentials, TLS settings, and headers
+	Access `yaml:",inline"`
+}
+
+func (g *Graphite) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type graphiteFields Graphite
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*graphiteFields)(g))
+}
+
+// Connection returns how to connect to this graphite backend.
+func (g *Graphite) Connection() Connection {
+	return Connection{HostAndPort: g.HostAndPort, Access: g.Access}
+}
+
+// GraphiteList represents a group of graphite backends.
+// GraphiteList instances are to be treated as immutable.
+type GraphiteList []Graphite
+
+// Sharding tells how series are divided among scotty partials so that
+// queries go to only the partials that have the data.
+type Sharding struct {
+	// The tag that decides which partial has a series e.g "host"
+	Tag string `yaml:"tag"`
+	// If true, the series with tag value v is in the partial at index
+	// FNV-1a(v) mod the number of partials. Otherwise, each partial lists
+	// the tag values it has with shardPrefixes and shardRegex.
+	Hash bool `yaml:"hash"`
+}
+
+func (s *Sharding) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type shardingFields Sharding
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*shardingFields)(s))
+}
+
+// Redundancy tells how proxima uses a list of redundant scotty servers
+// each having the same data.
+type Redundancy struct {
+	// One of StrategyMergeAll, StrategyFirstHealthy, StrategyRoundRobin,
+	// StrategyLeastLatency, or StrategyHedged. Empty means
+	// StrategyMergeAll.
+	Strategy string `yaml:"strategy"`
+	// For StrategyHedged, how long to wait for a scotty to respond before
+	// sending the same query to the next scotty. 0 means send to all the
+	// scotties at once.
+	HedgeDelay time.Duration `yaml:"hedgeDelay"`
+}
+
+func (r *Redundancy) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type redundancyFields Redundancy
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*redundancyFields)(r))
+}
+
+const (
+	// StrategyMergeAll sends each query to every scotty and merges the
+	// responses.
+	StrategyMergeAll = "merge-all"
+	// StrategyFirstHealthy sends each query to the first scotty, then to
+	// the next scotty if that one fails and so on.
+	StrategyFirstHealthy = "first-healthy"
+	// StrategyRoundRobin works like StrategyFirstHealthy except that
+	// each query starts with the scotty after the one the previous query
+	// started with.
+	StrategyRoundRobin = "round-robin"
+	// StrategyLeastLatency works like StrategyFirstHealthy except that
+	// each query starts with the scotty that has been responding the
+	// fastest.
+	StrategyLeastLatency = "least-latency"
+	// StrategyHedged sends each query to the first scotty and to the
+	// next scotty whenever the scotties queried so far either fail or
+	// take longer than HedgeDelay to respond. The first response wins.
+	StrategyHedged = "hedged"
+)
+
+// Cache tells how proxima caches the responses of the influx, OpenTSDB,
+// prometheus, and graphite backends for times fully in the past.
+type Cache struct {
+	// Proxima caches responses in time buckets of this size. For
+	// queries with GROUP BY time, this must be a multiple of the
+	// interval. 0 means 1 hour.
+	Bucket time.Duration `yaml:"bucket"`
+	// Only buckets that ended at least this long ago get cached since
+	// data for more recent times may still be arriving. 0 means 1 hour.
+	MinAge time.Duration `yaml:"minAge"`
+	// The most values to cache. 0 means 1000000.
+	MaxValues int `yaml:"maxValues"`
+}
+
+func (c *Cache) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type cacheFields Cache
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*cacheFields)(c))
+}
+
 // Scotty represents a single scotty server, a list of redundant scotty
 // servers each having the same data, or a list of scotty servers where
 // each scotty server has different data. One and only one of the fields
@@ -45,8 +283,37 @@ type Scotty struct {
 	HostAndPort string `yaml:"hostAndPort"`
 	// Scotty servers have the same data
 	Scotties ScottyList `yaml:"scotties"`
+	// How to use Scotties. nil means StrategyMergeAll.
+	Redundancy *Redundancy `yaml:"redundancy"`
 	// Scotty servers have different data
 	Partials ScottyList `yaml:"partials"`
+	// How series are divided among Partials. nil means every query goes
+	// to every partial.
+	Sharding *Sharding `yaml:"sharding"`
+	// The most raw points proxima fetches from Partials to compute
+	// aggregations such as percentile and median. 0 means percentile and
+	// median are not supported.
+	MaxRawPoints int `yaml:"maxRawPoints"`
+	// For a partial without hash sharding, the partial has the series
+	// whose shard tag value starts with one of these prefixes.
+	ShardPrefixes []string `yaml:"shardPrefixes"`
+	// For a partial without hash sharding, the partial has the series
+	// whose shard tag value matches this regular expression. A partial
+	// with neither shardPrefixes nor shardRegex may have any series.
+	ShardRegex string `yaml:"shardRegex"`
+	// The database to query. Only applies with HostAndPort. Empty means
+	// "scotty".
+	Database string `yaml:"database"`
+	// How far back data in this scotty or group of scotties goes.
+	// Proxima sends only this recent part of each query's time range.
+	// 0 means proxima sends the whole time range.
+	Duration time.Duration `yaml:"duration"`
+	// How long to wait for this scotty or group of scotties to respond.
+	// 0 means no timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// Credentials, TLS settings, and headers. Only applies with
+	// HostAndPort.
+	Access `yaml:",inline"`
 }
 
 func (s *Scotty) UnmarshalYAML(
@@ -55,6 +322,12 @@ func (s *Scotty) UnmarshalYAML(
 	return yamlutil.StrictUnmarshalYAML(unmarshal, (*scottyFields)(s))
 }
 
+// Connection returns how to connect to this scotty server. Only
+// meaningful if HostAndPort is set.
+func (s *Scotty) Connection() Connection {
+	return Connection{HostAndPort: s.HostAndPort, Access: s.Access}
+}
+
 // ScottyList represents a group of scotty servers.
 // ScottyList instances are to be treated as immutable.
 type ScottyList []Scotty
@@ -67,18 +340,101 @@ type Database struct {
 	Influxes InfluxList `yaml:"influxes"`
 	// The scotty servers
 	Scotties ScottyList `yaml:"scotties"`
+	// How to use Scotties. nil means StrategyMergeAll.
+	Redundancy *Redundancy `yaml:"redundancy"`
+	// The OpenTSDB backends. These split queries by time along with
+	// the influx backends.
+	OpenTSDBs OpenTSDBList `yaml:"openTSDBs"`
+	// The prometheus backends. These split queries by time along with
+	// the influx backends.
+	Prometheuses PrometheusList `yaml:"prometheuses"`
+	// The graphite backends. These split queries by time along with
+	// the influx backends.
+	Graphites GraphiteList `yaml:"graphites"`
+	// How to split queries by time among the influx, OpenTSDB,
+	// prometheus, and graphite backends. Either SplitOverlap or
+	// SplitDisjoint. Empty means SplitOverlap.
+	SplitMode string `yaml:"splitMode"`
+	// What to do when some backends fail while others answer. One of
+	// PartialFailuresIgnore, PartialFailuresWarn, or
+	// PartialFailuresStrict. Empty means PartialFailuresIgnore.
+	PartialFailures string `yaml:"partialFailures"`
+	// How to cache responses for times fully in the past. nil means no
+	// caching.
+	Cache *Cache `yaml:"cache"`
+	// If true, proxima snaps the time range of each query with GROUP BY
+	// time to boundaries of its interval so that repeated queries are
+	// the same and caches can answer them. The results leave out the
+	// first interval if the query starts in the middle of it.
+	AlignTimes bool `yaml:"alignTimes"`
+	// How long to wait for a query against this database to complete.
+	// 0 means use the timeout in Proxima.
+	Timeout time.Duration `yaml:"timeout"`
 }
 
+const (
+	// SplitOverlap queries each backend from as far back as its data
+	// goes up to the present so that backends with coarser grained data
+	// can fill in for backends with finer grained data that go down.
+	SplitOverlap = "overlap"
+	// SplitDisjoint queries each backend only for the times that no
+	// backend with finer grained data covers. If a backend fails,
+	// proxima queries the backends with coarser grained data for its
+	// times instead.
+	SplitDisjoint = "disjoint"
+)
+
+const (
+	// PartialFailuresIgnore answers queries with what the backends that
+	// didn't fail have.
+	PartialFailuresIgnore = "ignore"
+	// PartialFailuresWarn works like PartialFailuresIgnore except that
+	// each result carries a warning message for each backend that failed.
+	PartialFailuresWarn = "warn"
+	// PartialFailuresStrict fails queries when any backend fails.
+	PartialFailuresStrict = "strict"
+)
+
 func (d *Database) UnmarshalYAML(
 	unmarshal func(interface{}) error) error {
 	type databaseFields Database
 	return yamlutil.StrictUnmarshalYAML(unmarshal, (*databaseFields)(d))
 }
 
+// User represents a user allowed to query proxima.
+type User struct {
+	// Name of user
+	Name string `yaml:"name"`
+	// Password of user for basic auth or u and p query parameters
+	Password string `yaml:"password"`
+	// File containing the password of user
+	PasswordFile string `yaml:"passwordFile"`
+	// Bearer token of user
+	Token string `yaml:"token"`
+	// File containing the bearer token of user
+	TokenFile string `yaml:"tokenFile"`
+	// Names of the databases this user may query
+	Databases []string `yaml:"databases"`
+	// If true, this user may query every database
+	AllDatabases bool `yaml:"allDatabases"`
+}
+
+func (u *User) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type userFields User
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*userFields)(u))
+}
+
 // Proxima represents the configuration of proxima. This is what is read
 // from the configuration file using the yamlutil package.
 type Proxima struct {
 	Dbs []Database `yaml:"databases"`
+	// Default timeout for queries against any database. 0 means no
+	// timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// The users who may query proxima. If empty, anyone may query
+	// proxima.
+	Users []User `yaml:"users"`
 }
 
 func (p *Proxima) Reset() {
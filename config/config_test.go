@@ -13,26 +13,41 @@ func TestConfig(t *testing.T) {
 
 	Convey("Normal config", t, func() {
 		configContents := `
+timeout: 1m
 databases:
 - name: foo
+  timeout: 30s
   influxes:
   - hostAndPort: influx1
     duration: 1h
     database: tenant
   - hostAndPort: influx2
     duration: 100h
+    resolution: 5m
     database: mongo
+    retentionPolicy: downsampled
+    measurement: "{measurement}_5m"
+    field: "{aggregate}_{field}"
+    timeout: 10s
   scotties:
   - hostAndPort: scotty1
   - hostAndPort: scotty2
+    database: gateway
+    duration: 24h
+    timeout: 5s
 - name: bar
+  redundancy:
+    strategy: hedged
+    hedgeDelay: 50ms
   scotties:
   - hostAndPort: scotty11
   - hostAndPort: scotty12
   - partials:
     - hostAndPort: scotty21
     - hostAndPort: scotty22
-  - scotties:
+  - redundancy:
+      strategy: round-robin
+    scotties:
     - hostAndPort: scotty31
     - hostAndPort: scotty32
 `
@@ -40,9 +55,11 @@ databases:
 		var proxima config.Proxima
 		So(yamlutil.Read(buffer, &proxima), ShouldBeNil)
 		So(proxima, ShouldResemble, config.Proxima{
+			Timeout: time.Minute,
 			Dbs: []config.Database{
 				{
-					Name: "foo",
+					Name:    "foo",
+					Timeout: 30 * time.Second,
 					Influxes: config.InfluxList{
 						{
 							HostAndPort: "influx1",
@@ -50,18 +67,32 @@ databases:
 							Database:    "tenant",
 						},
 						{
-							HostAndPort: "influx2",
-							Duration:    100 * time.Hour,
-							Database:    "mongo",
+							HostAndPort:     "influx2",
+							Duration:        100 * time.Hour,
+							Resolution:      5 * time.Minute,
+							Database:        "mongo",
+							RetentionPolicy: "downsampled",
+							Measurement:     "{measurement}_5m",
+							Field:           "{aggregate}_{field}",
+							Timeout:         10 * time.Second,
 						},
 					},
 					Scotties: config.ScottyList{
 						{HostAndPort: "scotty1"},
-						{HostAndPort: "scotty2"},
+						{
+							HostAndPort: "scotty2",
+							Database:    "gateway",
+							Duration:    24 * time.Hour,
+							Timeout:     5 * time.Second,
+						},
 					},
 				},
 				{
 					Name: "bar",
+					Redundancy: &config.Redundancy{
+						Strategy:   config.StrategyHedged,
+						HedgeDelay: 50 * time.Millisecond,
+					},
 					Scotties: config.ScottyList{
 						{HostAndPort: "scotty11"},
 						{HostAndPort: "scotty12"},
@@ -69,10 +100,212 @@ databases:
 							{HostAndPort: "scotty21"},
 							{HostAndPort: "scotty22"},
 						}},
-						{Scotties: config.ScottyList{
-							{HostAndPort: "scotty31"},
-							{HostAndPort: "scotty32"},
-						}},
+						{
+							Redundancy: &config.Redundancy{
+								Strategy: config.StrategyRoundRobin,
+							},
+							Scotties: config.ScottyList{
+								{HostAndPort: "scotty31"},
+								{HostAndPort: "scotty32"},
+							},
+						},
+					},
+				},
+			},
+		})
+	})
+
+	Convey("Config with credentials", t, func() {
+		configContents := `
+databases:
+- name: foo
+  influxes:
+  - hostAndPort: https://influx1
+    duration: 1h
+    database: tenant
+    username: proxima
+    passwordFile: /etc/proxima/influx1.password
+    tls:
+      caFile: /etc/proxima/ca.pem
+      certFile: /etc/proxima/client.pem
+      keyFile: /etc/proxima/client.key
+    headers:
+      X-Tenant: foo
+  scotties:
+  - hostAndPort: https://scotty1
+    tls:
+      insecureSkipVerify: true
+    headerFiles:
+      Authorization: /etc/proxima/scotty1.token
+`
+		buffer := bytes.NewBuffer(([]byte)(configContents))
+		var proxima config.Proxima
+		So(yamlutil.Read(buffer, &proxima), ShouldBeNil)
+		influx := proxima.Dbs[0].Influxes[0]
+		So(influx.Connection(), ShouldResemble, config.Connection{
+			HostAndPort: "https://influx1",
+			Access: config.Access{
+				Username:     "proxima",
+				PasswordFile: "/etc/proxima/influx1.password",
+				TLS: &config.TLS{
+					CAFile:   "/etc/proxima/ca.pem",
+					CertFile: "/etc/proxima/client.pem",
+					KeyFile:  "/etc/proxima/client.key",
+				},
+				Headers: map[string]string{"X-Tenant": "foo"},
+			},
+		})
+		scotty := proxima.Dbs[0].Scotties[0]
+		So(scotty.Connection(), ShouldResemble, config.Connection{
+			HostAndPort: "https://scotty1",
+			Access: config.Access{
+				TLS: &config.TLS{InsecureSkipVerify: true},
+				HeaderFiles: map[string]string{
+					"Authorization": "/etc/proxima/scotty1.token",
+				},
+			},
+		})
+	})
+
+	Convey("Config with users", t, func() {
+		configContents := `
+users:
+- name: alice
+  passwordFile: /etc/proxima/alice.password
+  databases:
+  - foo
+  - bar
+- name: bob
+  token: abcd
+  allDatabases: true
+`
+		buffer := bytes.NewBuffer(([]byte)(configContents))
+		var proxima config.Proxima
+		So(yamlutil.Read(buffer, &proxima), ShouldBeNil)
+		So(proxima, ShouldResemble, config.Proxima{
+			Users: []config.User{
+				{
+					Name:         "alice",
+					PasswordFile: "/etc/proxima/alice.password",
+					Databases:    []string{"foo", "bar"},
+				},
+				{
+					Name:         "bob",
+					Token:        "abcd",
+					AllDatabases: true,
+				},
+			},
+		})
+	})
+
+	Convey("Config with OpenTSDB, prometheus, and graphite", t, func() {
+		configContents := `
+databases:
+- name: foo
+  influxes:
+  - hostAndPort: influx1
+    duration: 1h
+    database: tenant
+  openTSDBs:
+  - hostAndPort: tsdb1
+    duration: 1000h
+    timeout: 20s
+  prometheuses:
+  - hostAndPort: prom1
+    duration: 360h
+  graphites:
+  - hostAndPort: graphite1
+    duration: 2000h
+    template: servers.{host}.{measurement}.{field}
+`
+		buffer := bytes.NewBuffer(([]byte)(configContents))
+		var proxima config.Proxima
+		So(yamlutil.Read(buffer, &proxima), ShouldBeNil)
+		So(proxima, ShouldResemble, config.Proxima{
+			Dbs: []config.Database{
+				{
+					Name: "foo",
+					Influxes: config.InfluxList{
+						{
+							HostAndPort: "influx1",
+							Duration:    time.Hour,
+							Database:    "tenant",
+						},
+					},
+					OpenTSDBs: config.OpenTSDBList{
+						{
+							HostAndPort: "tsdb1",
+							Duration:    1000 * time.Hour,
+							Timeout:     20 * time.Second,
+						},
+					},
+					Prometheuses: config.PrometheusList{
+						{
+							HostAndPort: "prom1",
+							Duration:    360 * time.Hour,
+						},
+					},
+					Graphites: config.GraphiteList{
+						{
+							HostAndPort: "graphite1",
+							Duration:    2000 * time.Hour,
+							Template:    "servers.{host}.{measurement}.{field}",
+						},
+					},
+				},
+			},
+		})
+	})
+
+	Convey("Config with sharded partials and disjoint splitting", t, func() {
+		configContents := `
+databases:
+- name: foo
+  splitMode: disjoint
+  partialFailures: warn
+  cache:
+    bucket: 2h
+    maxValues: 5000
+  alignTimes: true
+  scotties:
+  - sharding:
+      tag: host
+    partials:
+    - hostAndPort: scotty1
+      shardPrefixes:
+      - web
+      - db
+    - hostAndPort: scotty2
+      shardRegex: ^app
+`
+		buffer := bytes.NewBuffer(([]byte)(configContents))
+		var proxima config.Proxima
+		So(yamlutil.Read(buffer, &proxima), ShouldBeNil)
+		So(proxima, ShouldResemble, config.Proxima{
+			Dbs: []config.Database{
+				{
+					Name:            "foo",
+					SplitMode:       config.SplitDisjoint,
+					PartialFailures: config.PartialFailuresWarn,
+					Cache: &config.Cache{
+						Bucket:    2 * time.Hour,
+						MaxValues: 5000,
+					},
+					AlignTimes: true,
+					Scotties: config.ScottyList{
+						{
+							Sharding: &config.Sharding{Tag: "host"},
+							Partials: config.ScottyList{
+								{
+									HostAndPort:   "scotty1",
+									ShardPrefixes: []string{"web", "db"},
+								},
+								{
+									HostAndPort: "scotty2",
+									ShardRegex:  "^app",
+								},
+							},
+						},
 					},
 				},
 			},